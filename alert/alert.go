@@ -0,0 +1,242 @@
+package alert
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type Severity int
+
+const (
+	Info Severity = iota
+	Warning
+	Critical
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Info:
+		return "info"
+	case Warning:
+		return "warning"
+	case Critical:
+		return "critical"
+	default:
+		return "unknown"
+	}
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func ParseSeverity(s string) Severity {
+	switch strings.ToLower(s) {
+	case "warning":
+		return Warning
+	case "critical":
+		return Critical
+	default:
+		return Info
+	}
+}
+
+type EventType string
+
+const (
+	PinningDetected EventType = "pinning_detected"
+	TxConflicted    EventType = "tx_conflicted"
+	BroadcastFailed EventType = "broadcast_failed"
+	FeeBumped       EventType = "fee_bumped"
+	FeeBumpFailed   EventType = "fee_bump_failed"
+	FeeCapReached   EventType = "fee_cap_reached"
+	DeadlineAtRisk  EventType = "deadline_at_risk"
+	ReorgDetected   EventType = "reorg_detected"
+
+	PackageRelayUnsupported EventType = "package_relay_unsupported"
+	PoolUnderfunded         EventType = "pool_underfunded"
+	FeeApprovalRequired     EventType = "fee_approval_required"
+	SweepIntegrity          EventType = "sweep_integrity"
+)
+
+// Event is the payload delivered to every sink. The webhook sink posts it as
+// JSON so the field names are part of the public schema.
+type Event struct {
+	Type      EventType              `json:"type"`
+	Severity  Severity               `json:"severity"`
+	Txid      string                 `json:"txid,omitempty"`
+	ReserveId string                 `json:"reserve_id,omitempty"`
+	RoundId   string                 `json:"round_id,omitempty"`
+	Reason    string                 `json:"reason,omitempty"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	Time      time.Time              `json:"time"`
+	// Suppressed counts the alerts dropped by the rate limit since the
+	// previous delivered one.
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+// Key identifies repeats of the same alert for deduplication. Reason is a
+// stable code telling apart alerts of the same type about the same
+// transaction, the message may carry amounts that change every block.
+func (e Event) Key() string {
+	return strings.Join([]string{string(e.Type), e.Txid, e.ReserveId, e.RoundId, e.Reason}, "|")
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("[%s] %s: %s", e.Severity, e.Type, e.Message)
+	if e.Txid != "" {
+		s += " (tx " + e.Txid + ")"
+	}
+	return s
+}
+
+type Sink interface {
+	Name() string
+	Send(event Event) error
+}
+
+type sinkEntry struct {
+	sink        Sink
+	minSeverity Severity
+}
+
+// Notifier delivers events to its sinks in the background. Identical events
+// within the dedup window are dropped and delivery is limited to a number of
+// events per minute, critical events bypass the rate limit.
+type Notifier struct {
+	sinks       []sinkEntry
+	dedupWindow time.Duration
+	ratePerMin  int
+
+	mu          sync.Mutex
+	lastSeen    map[string]time.Time
+	windowStart time.Time
+	sentInWin   int
+	suppressed  int
+
+	queue chan Event
+}
+
+func NewNotifier(dedupWindow time.Duration, ratePerMinute int) *Notifier {
+	n := &Notifier{
+		dedupWindow: dedupWindow,
+		ratePerMin:  ratePerMinute,
+		lastSeen:    make(map[string]time.Time),
+		queue:       make(chan Event, 256),
+	}
+	go n.deliver()
+	return n
+}
+
+// AddSink registers a sink receiving events of at least minSeverity.
+func (n *Notifier) AddSink(sink Sink, minSeverity Severity) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sinks = append(n.sinks, sinkEntry{sink: sink, minSeverity: minSeverity})
+}
+
+func (n *Notifier) Notify(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	fmt.Println("alert : ", event)
+
+	n.mu.Lock()
+	key := event.Key()
+	if last, ok := n.lastSeen[key]; ok && event.Time.Sub(last) < n.dedupWindow {
+		n.mu.Unlock()
+		return
+	}
+	for k, seen := range n.lastSeen {
+		if event.Time.Sub(seen) >= n.dedupWindow {
+			delete(n.lastSeen, k)
+		}
+	}
+
+	if event.Time.Sub(n.windowStart) >= time.Minute {
+		n.windowStart = event.Time
+		n.sentInWin = 0
+	}
+	if n.ratePerMin > 0 && n.sentInWin >= n.ratePerMin && event.Severity < Critical {
+		n.suppressed++
+		n.mu.Unlock()
+		return
+	}
+	event.Suppressed = n.suppressed
+	select {
+	case n.queue <- event:
+	default:
+		n.mu.Unlock()
+		fmt.Println("alert queue full, dropping : ", event)
+		return
+	}
+	// only an alert on its way counts as seen, a dropped one is sent again
+	n.lastSeen[key] = event.Time
+	n.sentInWin++
+	n.suppressed = 0
+	n.mu.Unlock()
+}
+
+func (n *Notifier) deliver() {
+	for event := range n.queue {
+		n.mu.Lock()
+		sinks := append([]sinkEntry{}, n.sinks...)
+		n.mu.Unlock()
+
+		for _, entry := range sinks {
+			if event.Severity < entry.minSeverity {
+				continue
+			}
+			err := entry.sink.Send(event)
+			if err != nil {
+				fmt.Printf("Failed to send alert to %s : %v\n", entry.sink.Name(), err)
+			}
+		}
+	}
+}
+
+var (
+	defaultMu       sync.RWMutex
+	defaultNotifier *Notifier
+)
+
+// Init builds the default notifier from the alerts section of the config.
+func Init() *Notifier {
+	dedup := time.Duration(viper.GetInt64("alerts.dedup_window_seconds")) * time.Second
+	if dedup <= 0 {
+		dedup = 10 * time.Minute
+	}
+	rate := viper.GetInt("alerts.rate_limit_per_minute")
+	if rate <= 0 {
+		rate = 30
+	}
+
+	n := NewNotifier(dedup, rate)
+	for _, configured := range configuredSinks() {
+		n.AddSink(configured.sink, configured.minSeverity)
+		fmt.Printf("alert sink %s enabled for %s and above\n", configured.sink.Name(), configured.minSeverity)
+	}
+
+	defaultMu.Lock()
+	defaultNotifier = n
+	defaultMu.Unlock()
+	return n
+}
+
+// Notify sends event through the default notifier, or only prints it when
+// Init has not been called.
+func Notify(event Event) {
+	defaultMu.RLock()
+	n := defaultNotifier
+	defaultMu.RUnlock()
+	if n == nil {
+		fmt.Println("alert : ", event)
+		return
+	}
+	n.Notify(event)
+}
@@ -0,0 +1,193 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+func postJSON(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// WebhookSink posts the Event as JSON.
+type WebhookSink struct {
+	URL string
+}
+
+func (s *WebhookSink) Name() string { return "webhook" }
+
+func (s *WebhookSink) Send(event Event) error {
+	return postJSON(s.URL, event)
+}
+
+// SlackSink posts to a Slack compatible incoming webhook, which also covers
+// Mattermost and Discord's /slack endpoint.
+type SlackSink struct {
+	URL string
+}
+
+func (s *SlackSink) Name() string { return "slack" }
+
+func (s *SlackSink) Send(event Event) error {
+	return postJSON(s.URL, map[string]string{"text": formatText(event)})
+}
+
+type TelegramSink struct {
+	BotToken string
+	ChatId   string
+	// APIURL defaults to https://api.telegram.org
+	APIURL string
+}
+
+func (s *TelegramSink) Name() string { return "telegram" }
+
+func (s *TelegramSink) Send(event Event) error {
+	api := s.APIURL
+	if api == "" {
+		api = "https://api.telegram.org"
+	}
+	return postJSON(fmt.Sprintf("%s/bot%s/sendMessage", strings.TrimRight(api, "/"), s.BotToken), map[string]string{
+		"chat_id": s.ChatId,
+		"text":    formatText(event),
+	})
+}
+
+type EmailSink struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+func (s *EmailSink) Name() string { return "email" }
+
+func (s *EmailSink) Send(event Event) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: [rbf-node] %s %s\r\n\r\n%s\r\n",
+		s.From,
+		strings.Join(s.To, ", "),
+		strings.ToUpper(event.Severity.String()),
+		event.Type,
+		formatText(event),
+	)
+	return smtp.SendMail(fmt.Sprintf("%s:%d", s.Host, s.Port), auth, s.From, s.To, []byte(msg))
+}
+
+// FileSink appends every event as a JSON line.
+type FileSink struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (s *FileSink) Name() string { return "file" }
+
+func (s *FileSink) Send(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+func formatText(event Event) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s: %s", strings.ToUpper(event.Severity.String()), event.Type, event.Message)
+	if event.Txid != "" {
+		fmt.Fprintf(&b, "\ntx: %s", event.Txid)
+	}
+	if event.ReserveId != "" {
+		fmt.Fprintf(&b, "\nreserve: %s round: %s", event.ReserveId, event.RoundId)
+	}
+	if event.Suppressed > 0 {
+		fmt.Fprintf(&b, "\n(%d alerts suppressed by rate limit)", event.Suppressed)
+	}
+	return b.String()
+}
+
+type configuredSink struct {
+	sink        Sink
+	minSeverity Severity
+}
+
+func configuredSinks() []configuredSink {
+	sinks := []configuredSink{}
+	add := func(name string, sink Sink) {
+		sinks = append(sinks, configuredSink{sink: sink, minSeverity: ParseSeverity(viper.GetString("alerts." + name + ".min_severity"))})
+	}
+
+	if url := viper.GetString("alerts.webhook.url"); url != "" {
+		add("webhook", &WebhookSink{URL: url})
+	}
+	if url := viper.GetString("alerts.slack.url"); url != "" {
+		add("slack", &SlackSink{URL: url})
+	}
+	if token := viper.GetString("alerts.telegram.bot_token"); token != "" {
+		add("telegram", &TelegramSink{
+			BotToken: token,
+			ChatId:   viper.GetString("alerts.telegram.chat_id"),
+			APIURL:   viper.GetString("alerts.telegram.api_url"),
+		})
+	}
+	if host := viper.GetString("alerts.email.smtp_host"); host != "" {
+		port := viper.GetInt("alerts.email.smtp_port")
+		if port == 0 {
+			port = 587
+		}
+		add("email", &EmailSink{
+			Host:     host,
+			Port:     port,
+			Username: viper.GetString("alerts.email.username"),
+			Password: viper.GetString("alerts.email.password"),
+			From:     viper.GetString("alerts.email.from"),
+			To:       viper.GetStringSlice("alerts.email.to"),
+		})
+	}
+	if path := viper.GetString("alerts.file.path"); path != "" {
+		add("file", &FileSink{Path: path})
+	}
+	if viper.GetBool("alerts.syslog.enabled") {
+		sink, err := NewSyslogSink(viper.GetString("alerts.syslog.tag"))
+		if err != nil {
+			fmt.Println("Failed to open syslog : ", err)
+		} else {
+			add("syslog", sink)
+		}
+	}
+	return sinks
+}
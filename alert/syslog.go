@@ -0,0 +1,36 @@
+//go:build !windows && !plan9
+
+package alert
+
+import (
+	"log/syslog"
+)
+
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+func NewSyslogSink(tag string) (*SyslogSink, error) {
+	if tag == "" {
+		tag = "rbf-node"
+	}
+	writer, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogSink{writer: writer}, nil
+}
+
+func (s *SyslogSink) Name() string { return "syslog" }
+
+func (s *SyslogSink) Send(event Event) error {
+	msg := formatText(event)
+	switch event.Severity {
+	case Critical:
+		return s.writer.Crit(msg)
+	case Warning:
+		return s.writer.Warning(msg)
+	default:
+		return s.writer.Info(msg)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build windows || plan9
+
+package alert
+
+import "errors"
+
+type SyslogSink struct{}
+
+func NewSyslogSink(tag string) (*SyslogSink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func (s *SyslogSink) Name() string { return "syslog" }
+
+func (s *SyslogSink) Send(event Event) error {
+	return errors.New("syslog is not supported on this platform")
+}
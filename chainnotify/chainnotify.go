@@ -0,0 +1,322 @@
+package chainnotify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/go-zeromq/zmq4"
+	"github.com/spf13/viper"
+)
+
+type EventType int
+
+const (
+	// TxAdded is sent when a transaction enters the mempool. Tx is only set
+	// when the event comes from zmqpubrawtx.
+	TxAdded EventType = iota
+	TxRemoved
+	BlockConnected
+	BlockDisconnected
+)
+
+func (t EventType) String() string {
+	switch t {
+	case TxAdded:
+		return "tx_added"
+	case TxRemoved:
+		return "tx_removed"
+	case BlockConnected:
+		return "block_connected"
+	case BlockDisconnected:
+		return "block_disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+type Event struct {
+	Type EventType
+	Hash chainhash.Hash
+	Tx   *wire.MsgTx
+}
+
+// ChainClient is the part of the bitcoind rpc client used by the polling
+// fallback.
+type ChainClient interface {
+	GetBestBlockHash() (*chainhash.Hash, error)
+	GetRawMempool() ([]*chainhash.Hash, error)
+}
+
+// Notifier fans bitcoind chain and mempool events out to its subscribers. It
+// reads them from bitcoind's zmq publishers when zmq_pub_rawtx,
+// zmq_pub_hashblock or zmq_pub_sequence are configured and polls the node
+// with backoff otherwise.
+type Notifier struct {
+	client ChainClient
+
+	mu          sync.RWMutex
+	subscribers []chan Event
+}
+
+func NewNotifier(client ChainClient) *Notifier {
+	return &Notifier{client: client}
+}
+
+// Subscribe returns a buffered channel receiving every event published after
+// the call. Events are dropped for subscribers that fall behind, so consumers
+// should treat them as hints and rescan periodically.
+func (n *Notifier) Subscribe() <-chan Event {
+	ch := make(chan Event, 256)
+	n.mu.Lock()
+	n.subscribers = append(n.subscribers, ch)
+	n.mu.Unlock()
+	return ch
+}
+
+func (n *Notifier) publish(event Event) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for _, ch := range n.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Start runs the configured event source and blocks forever.
+func (n *Notifier) Start() {
+	endpoints := zmqEndpoints()
+	if len(endpoints) == 0 {
+		fmt.Println("zmq not configured, polling bitcoind for chain events")
+		n.poll()
+		return
+	}
+
+	var wg sync.WaitGroup
+	for endpoint, topics := range endpoints {
+		wg.Add(1)
+		go func(endpoint string, topics []string) {
+			defer wg.Done()
+			n.listenZmq(endpoint, topics)
+		}(endpoint, topics)
+	}
+	wg.Wait()
+}
+
+// zmqEndpoints groups the configured zmq topics by endpoint since bitcoind
+// allows several publishers on the same address.
+func zmqEndpoints() map[string][]string {
+	endpoints := make(map[string][]string)
+	for topic, key := range map[string]string{
+		"rawtx":     "zmq_pub_rawtx",
+		"hashblock": "zmq_pub_hashblock",
+		"sequence":  "zmq_pub_sequence",
+	} {
+		endpoint := viper.GetString(key)
+		if endpoint != "" {
+			endpoints[endpoint] = append(endpoints[endpoint], topic)
+		}
+	}
+	return endpoints
+}
+
+func (n *Notifier) listenZmq(endpoint string, topics []string) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := n.readZmq(endpoint, topics)
+		fmt.Printf("zmq subscription to %s failed : %v\n", endpoint, err)
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff, time.Minute)
+	}
+}
+
+func (n *Notifier) readZmq(endpoint string, topics []string) error {
+	sub := zmq4.NewSub(context.Background())
+	defer sub.Close()
+
+	err := sub.Dial(endpoint)
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		err = sub.SetOption(zmq4.OptionSubscribe, topic)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("subscribed to zmq %v on %s\n", topics, endpoint)
+
+	for {
+		msg, err := sub.Recv()
+		if err != nil {
+			return err
+		}
+		if len(msg.Frames) < 2 {
+			continue
+		}
+		event, ok := parseZmqMessage(string(msg.Frames[0]), msg.Frames[1])
+		if ok {
+			n.publish(event)
+		}
+	}
+}
+
+// parseZmqMessage decodes a bitcoind zmq notification. Hashes are published
+// in rpc byte order and have to be reversed.
+func parseZmqMessage(topic string, body []byte) (Event, bool) {
+	switch topic {
+	case "rawtx":
+		tx := wire.NewMsgTx(wire.TxVersion)
+		err := tx.Deserialize(bytes.NewReader(body))
+		if err != nil {
+			fmt.Println("error decoding zmq rawtx : ", err)
+			return Event{}, false
+		}
+		return Event{Type: TxAdded, Hash: tx.TxHash(), Tx: tx}, true
+	case "hashblock":
+		hash, ok := reversedHash(body)
+		return Event{Type: BlockConnected, Hash: hash}, ok
+	case "sequence":
+		if len(body) < chainhash.HashSize+1 {
+			return Event{}, false
+		}
+		hash, ok := reversedHash(body[:chainhash.HashSize])
+		if !ok {
+			return Event{}, false
+		}
+		switch body[chainhash.HashSize] {
+		case 'C':
+			return Event{Type: BlockConnected, Hash: hash}, true
+		case 'D':
+			return Event{Type: BlockDisconnected, Hash: hash}, true
+		case 'A':
+			return Event{Type: TxAdded, Hash: hash}, true
+		case 'R':
+			return Event{Type: TxRemoved, Hash: hash}, true
+		}
+	}
+	return Event{}, false
+}
+
+func reversedHash(b []byte) (chainhash.Hash, bool) {
+	var hash chainhash.Hash
+	if len(b) != chainhash.HashSize {
+		return hash, false
+	}
+	for i := 0; i < chainhash.HashSize; i++ {
+		hash[i] = b[chainhash.HashSize-1-i]
+	}
+	return hash, true
+}
+
+// poll is the fallback source when zmq is not configured. It compares the best
+// block and the mempool with the previous poll and backs off while nothing
+// changes or the node is unreachable.
+func (n *Notifier) poll() {
+	minInterval := time.Duration(viper.GetInt64("poll_interval_min_seconds")) * time.Second
+	if minInterval <= 0 {
+		minInterval = 2 * time.Second
+	}
+	maxInterval := time.Duration(viper.GetInt64("poll_interval_max_seconds")) * time.Second
+	if maxInterval < minInterval {
+		maxInterval = 30 * time.Second
+		if maxInterval < minInterval {
+			maxInterval = minInterval
+		}
+	}
+
+	interval := minInterval
+	var bestBlock *chainhash.Hash
+	var mempool map[chainhash.Hash]bool
+	for {
+		changed := false
+
+		best, err := n.client.GetBestBlockHash()
+		if err != nil {
+			fmt.Println("error polling best block : ", err)
+		} else if bestBlock == nil || !best.IsEqual(bestBlock) {
+			if bestBlock != nil {
+				n.publish(Event{Type: BlockConnected, Hash: *best})
+			}
+			bestBlock = best
+			changed = true
+		}
+
+		txids, err := n.client.GetRawMempool()
+		if err != nil {
+			fmt.Println("error polling mempool : ", err)
+		} else {
+			current := make(map[chainhash.Hash]bool, len(txids))
+			for _, txid := range txids {
+				current[*txid] = true
+				if mempool != nil && !mempool[*txid] {
+					n.publish(Event{Type: TxAdded, Hash: *txid})
+					changed = true
+				}
+			}
+			for txid := range mempool {
+				if !current[txid] {
+					n.publish(Event{Type: TxRemoved, Hash: txid})
+					changed = true
+				}
+			}
+			mempool = current
+		}
+
+		if changed {
+			interval = minInterval
+		} else {
+			interval = nextBackoff(interval, maxInterval)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func nextBackoff(current time.Duration, max time.Duration) time.Duration {
+	next := current * 2
+	if next > max {
+		return max
+	}
+	return next
+}
+
+// Wait blocks until an event accepted by match arrives or idle elapses, then
+// drains whatever else is already queued. It returns the matching events, nil
+// when it woke up because of the idle timeout.
+func Wait(events <-chan Event, idle time.Duration, match func(Event) bool) []Event {
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+
+	matched := []Event{}
+	for len(matched) == 0 {
+		select {
+		case event := <-events:
+			if match(event) {
+				matched = append(matched, event)
+			}
+		case <-timer.C:
+			return nil
+		}
+	}
+
+	for {
+		select {
+		case event := <-events:
+			if match(event) {
+				matched = append(matched, event)
+			}
+		default:
+			return matched
+		}
+	}
+}
@@ -0,0 +1,465 @@
+package coinselect
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/spf13/viper"
+)
+
+type ScriptType string
+
+const (
+	P2PKH      ScriptType = "p2pkh"
+	P2SHP2WPKH ScriptType = "p2sh-p2wpkh"
+	P2WPKH     ScriptType = "p2wpkh"
+	P2WSH      ScriptType = "p2wsh"
+	P2TR       ScriptType = "p2tr"
+	Unknown    ScriptType = "unknown"
+)
+
+// ScriptTypeOf classifies a previous output script. Any P2SH output is
+// assumed to wrap P2WPKH, which is what bitcoind wallets create.
+func ScriptTypeOf(pkScript []byte) ScriptType {
+	switch txscript.GetScriptClass(pkScript) {
+	case txscript.PubKeyHashTy:
+		return P2PKH
+	case txscript.ScriptHashTy:
+		return P2SHP2WPKH
+	case txscript.WitnessV0PubKeyHashTy:
+		return P2WPKH
+	case txscript.WitnessV0ScriptHashTy:
+		return P2WSH
+	}
+	if txscript.IsPayToTaproot(pkScript) {
+		return P2TR
+	}
+	return Unknown
+}
+
+// SchnorrSigSize is the size of a taproot key path signature made with
+// SIGHASH_DEFAULT. Any other sighash type appends a byte.
+const SchnorrSigSize = 64
+
+// InputWeight is the weight a signed input spending t adds to a
+// transaction: outpoint, sequence, script sig and witness. P2WSH assumes a
+// 2-of-3 multisig, P2TR a key path spend with an explicit sighash type as fee
+// inputs are signed with SIGHASH_ALL|ANYONECANPAY.
+func InputWeight(t ScriptType) int64 {
+	return InputWeightSigHash(t, txscript.SigHashAll|txscript.SigHashAnyOneCanPay)
+}
+
+// InputWeightSigHash is the weight of an input spending t signed with
+// hashType. Only taproot signatures depend on it, SIGHASH_DEFAULT saves the
+// sighash byte.
+func InputWeightSigHash(t ScriptType, hashType txscript.SigHashType) int64 {
+	const base = (32 + 4 + 4) * 4
+	switch t {
+	case P2PKH:
+		return base + (1+107)*4
+	case P2SHP2WPKH:
+		return base + (1+23)*4 + 1 + 1 + 72 + 1 + 33
+	case P2WPKH:
+		return base + 1*4 + 1 + 1 + 72 + 1 + 33
+	case P2WSH:
+		return base + 1*4 + 1 + 1 + 2*(1+72) + 1 + 105
+	case P2TR:
+		sig := int64(SchnorrSigSize)
+		if hashType != txscript.SigHashDefault {
+			sig++
+		}
+		return base + 1*4 + 1 + 1 + sig
+	default:
+		// as expensive as P2PKH so unknown coins are not favoured
+		return base + (1+107)*4
+	}
+}
+
+// ChangeType is the type of the outputs paying back to the wallet, set by
+// change_address_type: bech32 (P2WPKH, the default) or bech32m (P2TR).
+func ChangeType() ScriptType {
+	switch addressType := viper.GetString("change_address_type"); addressType {
+	case "bech32", "":
+		return P2WPKH
+	case "bech32m":
+		return P2TR
+	default:
+		fmt.Printf("unknown change_address_type %s, using bech32\n", addressType)
+		return P2WPKH
+	}
+}
+
+// AddressType is the bitcoind address type of an output paying to t.
+func AddressType(t ScriptType) string {
+	switch t {
+	case P2PKH:
+		return "legacy"
+	case P2SHP2WPKH:
+		return "p2sh-segwit"
+	case P2TR:
+		return "bech32m"
+	default:
+		return "bech32"
+	}
+}
+
+// OutputWeight is the weight of an output paying to t.
+func OutputWeight(t ScriptType) int64 {
+	const base = (8 + 1) * 4
+	switch t {
+	case P2PKH:
+		return base + 25*4
+	case P2SHP2WPKH:
+		return base + 23*4
+	case P2WPKH:
+		return base + 22*4
+	case P2WSH, P2TR:
+		return base + 34*4
+	default:
+		return base + 25*4
+	}
+}
+
+// DustLimit is the smallest output of type t bitcoind relays, the cost of
+// creating and spending it at the 3 sat/vB dust relay feerate.
+func DustLimit(t ScriptType) int64 {
+	spend := int64(32 + 4 + 1 + 107 + 4)
+	switch t {
+	case P2SHP2WPKH, P2WPKH, P2WSH, P2TR:
+		spend = 32 + 4 + 1 + 107/4 + 4
+	}
+	return (OutputWeight(t)/4 + spend) * 3
+}
+
+// TxOverheadWeight is the weight of the version, locktime, segwit marker and
+// input and output counts of a transaction with less than 253 of each.
+const TxOverheadWeight = (4+4+1+1)*4 + 2
+
+// Fee returns the fee for weight at feeRate sat/kvB, rounded up.
+func Fee(weight int64, feeRate int64) int64 {
+	vsize := (weight + 3) / 4
+	return (vsize*feeRate + 999) / 1000
+}
+
+type Coin struct {
+	OutPoint wire.OutPoint
+	Value    int64
+	PkScript []byte
+	Type     ScriptType
+}
+
+func NewCoin(outPoint wire.OutPoint, value int64, pkScript []byte) Coin {
+	return Coin{OutPoint: outPoint, Value: value, PkScript: pkScript, Type: ScriptTypeOf(pkScript)}
+}
+
+// EffectiveValue is what the coin contributes once the fee for spending it at
+// feeRate is paid.
+func (c Coin) EffectiveValue(feeRate int64) int64 {
+	return c.Value - Fee(InputWeight(c.Type), feeRate)
+}
+
+type Params struct {
+	// Target is the amount the selected coins have to add on top of paying
+	// for their own inputs.
+	Target int64
+	// FeeRate is the feerate of the transaction in sat/kvB.
+	FeeRate int64
+	// LongTermFeeRate is the feerate at which coins are expected to be spent
+	// otherwise, it decides whether spending more inputs now is wasteful.
+	LongTermFeeRate int64
+	ChangeType      ScriptType
+}
+
+// changeFee is the fee for adding the change output now.
+func (p Params) changeFee() int64 {
+	return Fee(OutputWeight(p.ChangeType), p.FeeRate)
+}
+
+// costOfChange is creating the change output now plus spending it later.
+func (p Params) costOfChange() int64 {
+	return p.changeFee() + Fee(InputWeight(p.ChangeType), p.LongTermFeeRate)
+}
+
+func (p Params) minChange() int64 {
+	return DustLimit(p.ChangeType)
+}
+
+type Selection struct {
+	Algorithm string
+	Coins     []Coin
+	// Change is the value of the change output, 0 when the excess is too
+	// small to be worth one and goes to the fee.
+	Change int64
+	// Fee is what the selection adds to the fee: its inputs, the change
+	// output and any excess left to the miner.
+	Fee int64
+}
+
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// sortedCoins returns the coins with a positive effective value, largest
+// first, ties broken by outpoint so results do not depend on the order the
+// wallet listed them in.
+func sortedCoins(coins []Coin, feeRate int64) []Coin {
+	usable := []Coin{}
+	for _, coin := range coins {
+		if coin.EffectiveValue(feeRate) > 0 {
+			usable = append(usable, coin)
+		}
+	}
+	sort.SliceStable(usable, func(i, j int) bool {
+		vi, vj := usable[i].EffectiveValue(feeRate), usable[j].EffectiveValue(feeRate)
+		if vi != vj {
+			return vi > vj
+		}
+		return usable[i].OutPoint.String() < usable[j].OutPoint.String()
+	})
+	return usable
+}
+
+// finish works out change and fee of a set of coins covering the target.
+func finish(algorithm string, coins []Coin, p Params, allowChange bool) *Selection {
+	s := &Selection{Algorithm: algorithm, Coins: coins}
+	total := int64(0)
+	for _, coin := range coins {
+		total += coin.Value
+		s.Fee += Fee(InputWeight(coin.Type), p.FeeRate)
+	}
+	excess := total - s.Fee - p.Target
+	if allowChange && excess-p.changeFee() >= p.minChange() {
+		s.Change = excess - p.changeFee()
+		s.Fee += p.changeFee()
+	} else {
+		s.Fee += excess
+	}
+	return s
+}
+
+// Select runs Branch and Bound to avoid change, then knapsack, then largest
+// first.
+func Select(coins []Coin, p Params) (*Selection, error) {
+	s, err := BranchAndBound(coins, p)
+	if err == nil {
+		return s, nil
+	}
+	s, err = Knapsack(coins, p)
+	if err == nil {
+		return s, nil
+	}
+	return LargestFirst(coins, p)
+}
+
+// SelectWith runs the named algorithm, "auto" or empty runs Select.
+func SelectWith(algorithm string, coins []Coin, p Params) (*Selection, error) {
+	switch algorithm {
+	case "", "auto":
+		return Select(coins, p)
+	case "bnb":
+		return BranchAndBound(coins, p)
+	case "knapsack":
+		return Knapsack(coins, p)
+	case "largest_first":
+		return LargestFirst(coins, p)
+	default:
+		return nil, fmt.Errorf("unknown coin selection algorithm %s", algorithm)
+	}
+}
+
+const bnbMaxTries = 100000
+
+// BranchAndBound looks for a set of coins whose effective value lands
+// between the target and the target plus the cost of change, so no change
+// output is needed. Among those it keeps the one wasting the least.
+func BranchAndBound(coins []Coin, p Params) (*Selection, error) {
+	if p.Target <= 0 {
+		return finish("bnb", nil, p, false), nil
+	}
+	usable := sortedCoins(coins, p.FeeRate)
+	values := make([]int64, len(usable))
+	waste := make([]int64, len(usable))
+	available := int64(0)
+	for i, coin := range usable {
+		values[i] = coin.EffectiveValue(p.FeeRate)
+		waste[i] = Fee(InputWeight(coin.Type), p.FeeRate) - Fee(InputWeight(coin.Type), p.LongTermFeeRate)
+		available += values[i]
+	}
+	if available < p.Target {
+		return nil, ErrInsufficientFunds
+	}
+
+	upper := p.Target + p.costOfChange()
+	selected := make([]bool, len(usable))
+	var best []bool
+	bestWaste := int64(0)
+	tries := 0
+
+	// search decides coin i given the value and waste selected so far and
+	// the effective value of the coins from i on.
+	var search func(i int, value int64, currentWaste int64, remaining int64)
+	search = func(i int, value int64, currentWaste int64, remaining int64) {
+		if tries >= bnbMaxTries || value > upper {
+			return
+		}
+		tries++
+		if value >= p.Target {
+			total := currentWaste + value - p.Target
+			if best == nil || total < bestWaste {
+				best = append([]bool{}, selected...)
+				bestWaste = total
+			}
+			return
+		}
+		if i == len(usable) || value+remaining < p.Target {
+			return
+		}
+		// more inputs only add waste while fees are above the long term rate
+		if best != nil && p.FeeRate > p.LongTermFeeRate && currentWaste > bestWaste {
+			return
+		}
+
+		selected[i] = true
+		search(i+1, value+values[i], currentWaste+waste[i], remaining-values[i])
+		selected[i] = false
+		search(i+1, value, currentWaste, remaining-values[i])
+	}
+	search(0, 0, 0, available)
+
+	if best == nil {
+		return nil, errors.New("no changeless selection found")
+	}
+	chosen := []Coin{}
+	for i, in := range best {
+		if in {
+			chosen = append(chosen, usable[i])
+		}
+	}
+	return finish("bnb", chosen, p, false), nil
+}
+
+// knapsackIterations and knapsackSeed keep the random search of Knapsack
+// deterministic.
+const (
+	knapsackIterations = 1000
+	knapsackSeed       = 1
+)
+
+// Knapsack is bitcoind's legacy selection: an exact match if there is one,
+// otherwise the best random subset of the smaller coins reaching the target
+// plus minimum change, or the smallest single coin above it if that is
+// closer.
+func Knapsack(coins []Coin, p Params) (*Selection, error) {
+	if p.Target <= 0 {
+		return finish("knapsack", nil, p, true), nil
+	}
+	usable := sortedCoins(coins, p.FeeRate)
+	target := p.Target + p.changeFee() + p.minChange()
+
+	smaller := []Coin{}
+	smallerTotal := int64(0)
+	var lowestLarger *Coin
+	for i := range usable {
+		value := usable[i].EffectiveValue(p.FeeRate)
+		if value == p.Target {
+			return finish("knapsack", []Coin{usable[i]}, p, true), nil
+		}
+		if value < target {
+			smaller = append(smaller, usable[i])
+			smallerTotal += value
+		} else if lowestLarger == nil || value < lowestLarger.EffectiveValue(p.FeeRate) {
+			lowestLarger = &usable[i]
+		}
+	}
+
+	if smallerTotal == p.Target || (smallerTotal >= p.Target && smallerTotal < target && lowestLarger == nil) {
+		return finish("knapsack", smaller, p, true), nil
+	}
+	if smallerTotal < p.Target {
+		if lowestLarger == nil {
+			return nil, ErrInsufficientFunds
+		}
+		return finish("knapsack", []Coin{*lowestLarger}, p, true), nil
+	}
+
+	best, bestValue := approximateBestSubset(smaller, p.FeeRate, target)
+	if bestValue < target {
+		best, bestValue = approximateBestSubset(smaller, p.FeeRate, p.Target)
+	}
+	if lowestLarger != nil && (bestValue < p.Target || lowestLarger.EffectiveValue(p.FeeRate) <= bestValue) {
+		return finish("knapsack", []Coin{*lowestLarger}, p, true), nil
+	}
+	return finish("knapsack", best, p, true), nil
+}
+
+func approximateBestSubset(coins []Coin, feeRate int64, target int64) ([]Coin, int64) {
+	rng := rand.New(rand.NewSource(knapsackSeed))
+	values := make([]int64, len(coins))
+	total := int64(0)
+	for i, coin := range coins {
+		values[i] = coin.EffectiveValue(feeRate)
+		total += values[i]
+	}
+
+	best := make([]bool, len(coins))
+	for i := range best {
+		best[i] = true
+	}
+	bestValue := total
+
+	included := make([]bool, len(coins))
+	for rep := 0; rep < knapsackIterations && bestValue != target; rep++ {
+		for i := range included {
+			included[i] = false
+		}
+		value := int64(0)
+		reached := false
+		for pass := 0; pass < 2 && !reached; pass++ {
+			for i := range coins {
+				// first pass picks coins at random, the second fills up with
+				// whatever is left
+				if (pass == 0 && rng.Intn(2) == 1) || (pass == 1 && !included[i]) {
+					value += values[i]
+					included[i] = true
+					if value >= target {
+						reached = true
+						if value < bestValue {
+							bestValue = value
+							copy(best, included)
+						}
+						value -= values[i]
+						included[i] = false
+					}
+				}
+			}
+		}
+	}
+
+	chosen := []Coin{}
+	for i, in := range best {
+		if in {
+			chosen = append(chosen, coins[i])
+		}
+	}
+	return chosen, bestValue
+}
+
+// LargestFirst takes the coins with the highest effective value until the
+// target is covered.
+func LargestFirst(coins []Coin, p Params) (*Selection, error) {
+	if p.Target <= 0 {
+		return finish("largest_first", nil, p, true), nil
+	}
+	chosen := []Coin{}
+	value := int64(0)
+	for _, coin := range sortedCoins(coins, p.FeeRate) {
+		chosen = append(chosen, coin)
+		value += coin.EffectiveValue(p.FeeRate)
+		if value >= p.Target {
+			return finish("largest_first", chosen, p, true), nil
+		}
+	}
+	return nil, ErrInsufficientFunds
+}
@@ -0,0 +1,238 @@
+package coinselect
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// at 1 sat/vB a P2WPKH input costs 68 sats and a P2WPKH change output 31
+const (
+	testFeeRate   = 1000
+	testInputFee  = 68
+	testChangeFee = 31
+)
+
+var testParams = Params{FeeRate: testFeeRate, LongTermFeeRate: testFeeRate, ChangeType: P2WPKH}
+
+// testCoins returns P2WPKH coins with the given effective values at
+// testFeeRate.
+func testCoins(effectiveValues ...int64) []Coin {
+	coins := make([]Coin, len(effectiveValues))
+	for i, value := range effectiveValues {
+		coins[i] = Coin{
+			OutPoint: wire.OutPoint{Hash: chainhash.Hash{byte(i + 1)}, Index: uint32(i)},
+			Value:    value + testInputFee,
+			Type:     P2WPKH,
+		}
+	}
+	return coins
+}
+
+func effectiveValues(coins []Coin) []int64 {
+	values := make([]int64, len(coins))
+	for i, coin := range coins {
+		values[i] = coin.EffectiveValue(testFeeRate)
+	}
+	return values
+}
+
+func withTarget(target int64) Params {
+	p := testParams
+	p.Target = target
+	return p
+}
+
+func TestFeeConstants(t *testing.T) {
+	if fee := Fee(InputWeight(P2WPKH), testFeeRate); fee != testInputFee {
+		t.Fatalf("input fee %d, want %d", fee, testInputFee)
+	}
+	if fee := Fee(OutputWeight(P2WPKH), testFeeRate); fee != testChangeFee {
+		t.Fatalf("change fee %d, want %d", fee, testChangeFee)
+	}
+}
+
+func TestBranchAndBound(t *testing.T) {
+	tests := []struct {
+		name    string
+		coins   []int64
+		target  int64
+		want    []int64
+		wantErr bool
+	}{
+		{"single coin exact", []int64{10000, 20000, 30000, 50000}, 50000, []int64{50000}, false},
+		{"two coins exact", []int64{10000, 25000, 32000, 70000}, 35000, []int64{25000, 10000}, false},
+		// 99 is the cost of the change output now and spending it later
+		{"within the cost of change", []int64{10000, 40050}, 40000, []int64{40050}, false},
+		{"over the cost of change", []int64{10000, 40100}, 40000, nil, true},
+		{"insufficient funds", []int64{10000, 20000}, 40000, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := BranchAndBound(testCoins(test.coins...), withTarget(test.target))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("selected %v, expected an error", effectiveValues(s.Coins))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := effectiveValues(s.Coins); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("selected %v, want %v", got, test.want)
+			}
+			if s.Change != 0 {
+				t.Fatalf("change of %d, want none", s.Change)
+			}
+			excess := int64(0)
+			for _, value := range test.want {
+				excess += value
+			}
+			excess -= test.target
+			if want := int64(len(test.want))*testInputFee + excess; s.Fee != want {
+				t.Fatalf("fee %d, want %d", s.Fee, want)
+			}
+		})
+	}
+}
+
+func TestBranchAndBoundInsufficientFunds(t *testing.T) {
+	_, err := BranchAndBound(testCoins(10000, 20000), withTarget(40000))
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("got %v, want %v", err, ErrInsufficientFunds)
+	}
+}
+
+func TestKnapsack(t *testing.T) {
+	values := []int64{1100, 2300, 3700, 4100, 5900, 6300, 7700, 8900, 9100}
+	p := withTarget(21000)
+
+	first, err := Knapsack(testCoins(values...), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Algorithm != "knapsack" {
+		t.Fatalf("algorithm %s", first.Algorithm)
+	}
+	total := int64(0)
+	for _, value := range effectiveValues(first.Coins) {
+		total += value
+	}
+	if total < p.Target+testChangeFee+DustLimit(P2WPKH) {
+		t.Fatalf("selected %d, below the target plus minimum change", total)
+	}
+	if want := total - p.Target - testChangeFee; first.Change != want {
+		t.Fatalf("change %d, want %d", first.Change, want)
+	}
+
+	// the fixed seed gives the same subset whatever order the wallet lists
+	// the coins in
+	coins := testCoins(values...)
+	reversed := make([]Coin, len(coins))
+	for i, coin := range coins {
+		reversed[len(coins)-1-i] = coin
+	}
+	for i := 0; i < 3; i++ {
+		again, err := Knapsack(reversed, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(again, first) {
+			t.Fatalf("run %d selected %v, first run %v", i, effectiveValues(again.Coins), effectiveValues(first.Coins))
+		}
+	}
+}
+
+func TestKnapsackExactMatch(t *testing.T) {
+	s, err := Knapsack(testCoins(5000, 12000, 30000), withTarget(12000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := effectiveValues(s.Coins); !reflect.DeepEqual(got, []int64{12000}) || s.Change != 0 {
+		t.Fatalf("selected %v with change %d", got, s.Change)
+	}
+}
+
+func TestSelectFallsBackToKnapsack(t *testing.T) {
+	// no changeless combination exists
+	s, err := Select(testCoins(10000, 40100), withTarget(40000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Algorithm != "knapsack" {
+		t.Fatalf("algorithm %s, want knapsack", s.Algorithm)
+	}
+}
+
+func TestLargestFirst(t *testing.T) {
+	tests := []struct {
+		name   string
+		coins  []int64
+		target int64
+		want   []int64
+	}{
+		{"one coin", []int64{5000, 3000, 8000}, 6000, []int64{8000}},
+		{"largest two", []int64{5000, 3000, 8000}, 10000, []int64{8000, 5000}},
+		{"all coins", []int64{5000, 3000, 8000}, 16000, []int64{8000, 5000, 3000}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := LargestFirst(testCoins(test.coins...), withTarget(test.target))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := effectiveValues(s.Coins); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("selected %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestInsufficientFunds(t *testing.T) {
+	// the last coin costs more to spend than it holds and is left out
+	coins := append(testCoins(5000, 3000), Coin{OutPoint: wire.OutPoint{Index: 9}, Value: 50, Type: P2WPKH})
+	p := withTarget(8001)
+	algorithms := []string{"auto", "bnb", "knapsack", "largest_first"}
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			_, err := SelectWith(algorithm, coins, p)
+			if !errors.Is(err, ErrInsufficientFunds) {
+				t.Fatalf("got %v, want %v", err, ErrInsufficientFunds)
+			}
+		})
+	}
+}
+
+func TestChangeThreshold(t *testing.T) {
+	dust := DustLimit(P2WPKH)
+	const target = 20000
+	tests := []struct {
+		name       string
+		excess     int64
+		wantChange int64
+	}{
+		{"change at the dust limit", testChangeFee + dust, dust},
+		{"change above the dust limit", testChangeFee + dust + 1000, dust + 1000},
+		{"excess below the dust limit goes to the fee", testChangeFee + dust - 1, 0},
+		{"no excess", 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := LargestFirst(testCoins(target+test.excess), withTarget(target))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Change != test.wantChange {
+				t.Fatalf("change %d, want %d", s.Change, test.wantChange)
+			}
+			// every sat not going to the target or change is fee
+			if got := s.Fee + s.Change + target; got != target+test.excess+testInputFee {
+				t.Fatalf("fee %d and change %d do not add up", s.Fee, s.Change)
+			}
+		})
+	}
+}
@@ -0,0 +1,840 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/twilight-project/rbf-node/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	signedTxBucket  = []byte("signed_tx")
+	historyBucket   = []byte("tx_state_history")
+	leaseBucket     = []byte("utxo_leases")
+	approvalBucket  = []byte("fee_approvals")
+	spendBucket     = []byte("fee_spends")
+	simulatedBucket = []byte("simulated_broadcasts")
+	boltBucketNames = [][]byte{signedTxBucket, historyBucket, leaseBucket, approvalBucket, spendBucket, simulatedBucket}
+)
+
+// BoltStore keeps the tracked transactions in a single bbolt file so the node
+// can run without an external database. Records are stored as JSON keyed by
+// their big endian id.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+type boltStateHistory struct {
+	SignedTxId    int64
+	State         types.TxState
+	Confirmations int64
+	CreatedAt     time.Time
+}
+
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(btx *bolt.Tx) error {
+		for _, name := range boltBucketNames {
+			_, err := btx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func boltKey(id int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+func getBoltTrackedTx(bucket *bolt.Bucket, id int64) (*types.TrackedTx, error) {
+	value := bucket.Get(boltKey(id))
+	if value == nil {
+		return nil, fmt.Errorf("tracked tx %d not found", id)
+	}
+	tx := types.TrackedTx{}
+	err := json.Unmarshal(value, &tx)
+	if err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+func putBoltTrackedTx(bucket *bolt.Bucket, tx *types.TrackedTx) error {
+	value, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(boltKey(tx.Id), value)
+}
+
+func insertBoltStateHistory(btx *bolt.Tx, id int64, state types.TxState, confirmations int64, at time.Time) error {
+	bucket := btx.Bucket(historyBucket)
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(boltStateHistory{SignedTxId: id, State: state, Confirmations: confirmations, CreatedAt: at})
+	if err != nil {
+		return err
+	}
+	return bucket.Put(append(boltKey(id), boltKey(int64(seq))...), value)
+}
+
+// insertBoltTrackedTx assigns the next id to tx and stores it along with its
+// first state history entry.
+func insertBoltTrackedTx(btx *bolt.Tx, tx *types.TrackedTx) error {
+	bucket := btx.Bucket(signedTxBucket)
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	tx.Id = int64(seq)
+	err = putBoltTrackedTx(bucket, tx)
+	if err != nil {
+		return err
+	}
+	return insertBoltStateHistory(btx, tx.Id, tx.State, tx.Confirmations, tx.UpdatedAt)
+}
+
+func (s *BoltStore) InsertReceivedTx(nyksTx []byte, nyksTxid string, unlockHeight int64, reserveId string, roundId string, txType string) (int64, error) {
+	tx := types.TrackedTx{
+		Txid:         nyksTxid,
+		Tx:           nyksTx,
+		NyksTx:       nyksTx,
+		NyksTxid:     nyksTxid,
+		UnlockHeight: unlockHeight,
+		ReserveId:    reserveId,
+		RoundId:      roundId,
+		TxType:       txType,
+		State:        types.TxStateReceived,
+		UpdatedAt:    time.Now().UTC(),
+	}
+	err := s.db.Update(func(btx *bolt.Tx) error {
+		err := btx.Bucket(signedTxBucket).ForEach(func(k, v []byte) error {
+			tracked := types.TrackedTx{}
+			err := json.Unmarshal(v, &tracked)
+			if err != nil {
+				return err
+			}
+			if nyksTxid != "" && tracked.ReserveId == reserveId && tracked.RoundId == roundId && tracked.NyksTxid == nyksTxid && tracked.BumpCount == 0 {
+				return ErrAlreadyTracked
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return insertBoltTrackedTx(btx, &tx)
+	})
+	if errors.Is(err, ErrAlreadyTracked) {
+		return 0, err
+	}
+	if err != nil {
+		fmt.Printf("An error occured while executing insert received %s tx: %v\n", txType, err)
+		return 0, err
+	}
+	return tx.Id, nil
+}
+
+func (s *BoltStore) UpdateTrackedTx(id int64, tx []byte, txid string, fee int64) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(signedTxBucket)
+		tracked, err := getBoltTrackedTx(bucket, id)
+		if err != nil {
+			return err
+		}
+		tracked.Tx = tx
+		tracked.Txid = txid
+		tracked.Fee = fee
+		tracked.UpdatedAt = time.Now().UTC()
+		return putBoltTrackedTx(bucket, tracked)
+	})
+}
+
+func (s *BoltStore) TransitionTx(id int64, to types.TxState, confirmations int64) error {
+	return s.transitionTx(id, to, confirmations, "")
+}
+
+func (s *BoltStore) FailTx(id int64, cause types.FailureCause) error {
+	return s.transitionTx(id, types.TxStateFailed, 0, cause)
+}
+
+func (s *BoltStore) transitionTx(id int64, to types.TxState, confirmations int64, cause types.FailureCause) error {
+	var from types.TxState
+	changed := false
+	err := s.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(signedTxBucket)
+		tracked, err := getBoltTrackedTx(bucket, id)
+		if err != nil {
+			return err
+		}
+		from = tracked.State
+		if from == to && tracked.Confirmations == confirmations {
+			return nil
+		}
+		if !CanTransition(from, to) {
+			return fmt.Errorf("invalid state transition for tracked tx %d : %s -> %s", id, from, to)
+		}
+
+		tracked.State = to
+		tracked.Confirmations = confirmations
+		tracked.Failure = cause
+		tracked.UpdatedAt = time.Now().UTC()
+		err = putBoltTrackedTx(bucket, tracked)
+		if err != nil {
+			return err
+		}
+		changed = true
+		if releasesLeases(to) {
+			err = updateBoltLeases(btx, id, func(lease *types.UtxoLease) {
+				lease.Released = true
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return insertBoltStateHistory(btx, id, to, confirmations, tracked.UpdatedAt)
+	})
+	if err == nil && changed {
+		fmt.Printf("tracked tx %d : %s -> %s\n", id, from, to)
+	}
+	return err
+}
+
+func (s *BoltStore) ReplaceTrackedTx(id int64, tx []byte, txid string, fee int64) (int64, error) {
+	var newId int64
+	err := s.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(signedTxBucket)
+		original, err := getBoltTrackedTx(bucket, id)
+		if err != nil {
+			return err
+		}
+		if !CanTransition(original.State, types.TxStateReplaced) {
+			return fmt.Errorf("invalid state transition for tracked tx %d : %s -> %s", id, original.State, types.TxStateReplaced)
+		}
+
+		now := time.Now().UTC()
+		replacement := *original
+		replacement.Txid = txid
+		replacement.Tx = tx
+		replacement.Fee = fee
+		replacement.State = types.TxStateBroadcast
+		replacement.Confirmations = 0
+		replacement.ReplacedBy = 0
+		replacement.BlockHash = ""
+		replacement.BlockHeight = 0
+		replacement.BroadcastHeight = 0
+		replacement.BumpCount = original.BumpCount + 1
+		replacement.ChildTx = nil
+		replacement.ChildTxid = ""
+		replacement.ChildFee = 0
+		replacement.Rejections = nil
+		replacement.Failure = ""
+		replacement.UpdatedAt = now
+		err = insertBoltTrackedTx(btx, &replacement)
+		if err != nil {
+			return err
+		}
+		newId = replacement.Id
+		err = updateBoltLeases(btx, id, func(lease *types.UtxoLease) {
+			if !lease.Released {
+				lease.TrackedTxId = newId
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		original.State = types.TxStateReplaced
+		original.Confirmations = 0
+		original.ReplacedBy = newId
+		original.UpdatedAt = now
+		err = putBoltTrackedTx(bucket, original)
+		if err != nil {
+			return err
+		}
+		return insertBoltStateHistory(btx, id, types.TxStateReplaced, 0, now)
+	})
+	return newId, err
+}
+
+func (s *BoltStore) RevertReplacement(id int64, newId int64, state types.TxState) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(signedTxBucket)
+		original, err := getBoltTrackedTx(bucket, id)
+		if err != nil {
+			return err
+		}
+		if original.ReplacedBy != newId {
+			return fmt.Errorf("tracked tx %d is not replaced by %d", id, newId)
+		}
+		err = updateBoltLeases(btx, newId, func(lease *types.UtxoLease) {
+			lease.TrackedTxId = id
+		})
+		if err != nil {
+			return err
+		}
+		history := btx.Bucket(historyBucket)
+		prefix := boltKey(newId)
+		keys := [][]byte{}
+		cursor := history.Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range keys {
+			err = history.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		err = bucket.Delete(boltKey(newId))
+		if err != nil {
+			return err
+		}
+
+		original.State = state
+		original.Confirmations = 0
+		original.ReplacedBy = 0
+		original.UpdatedAt = time.Now().UTC()
+		err = putBoltTrackedTx(bucket, original)
+		if err != nil {
+			return err
+		}
+		return insertBoltStateHistory(btx, id, state, 0, original.UpdatedAt)
+	})
+}
+
+func (s *BoltStore) SetTrackedTxBlock(id int64, blockHash string, blockHeight int64) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(signedTxBucket)
+		tracked, err := getBoltTrackedTx(bucket, id)
+		if err != nil {
+			return err
+		}
+		tracked.BlockHash = blockHash
+		tracked.BlockHeight = blockHeight
+		tracked.UpdatedAt = time.Now().UTC()
+		return putBoltTrackedTx(bucket, tracked)
+	})
+}
+
+func (s *BoltStore) SetTrackedTxBroadcastHeight(id int64, height int64) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(signedTxBucket)
+		tracked, err := getBoltTrackedTx(bucket, id)
+		if err != nil {
+			return err
+		}
+		tracked.BroadcastHeight = height
+		tracked.UpdatedAt = time.Now().UTC()
+		return putBoltTrackedTx(bucket, tracked)
+	})
+}
+
+func (s *BoltStore) SetTrackedTxDeadlineHeight(id int64, height int64) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(signedTxBucket)
+		tracked, err := getBoltTrackedTx(bucket, id)
+		if err != nil {
+			return err
+		}
+		tracked.DeadlineHeight = height
+		tracked.UpdatedAt = time.Now().UTC()
+		return putBoltTrackedTx(bucket, tracked)
+	})
+}
+
+func (s *BoltStore) SetTrackedTxRejections(id int64, rejections []types.Rejection) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(signedTxBucket)
+		tracked, err := getBoltTrackedTx(bucket, id)
+		if err != nil {
+			return err
+		}
+		tracked.Rejections = rejections
+		tracked.UpdatedAt = time.Now().UTC()
+		return putBoltTrackedTx(bucket, tracked)
+	})
+}
+
+func (s *BoltStore) SetTrackedTxChild(id int64, childTx []byte, childTxid string, childFee int64) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(signedTxBucket)
+		tracked, err := getBoltTrackedTx(bucket, id)
+		if err != nil {
+			return err
+		}
+		tracked.ChildTx = childTx
+		tracked.ChildTxid = childTxid
+		tracked.ChildFee = childFee
+		tracked.UpdatedAt = time.Now().UTC()
+		return putBoltTrackedTx(bucket, tracked)
+	})
+}
+
+func (s *BoltStore) DeleteTrackedTx(id int64) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		history := btx.Bucket(historyBucket)
+		prefix := boltKey(id)
+		keys := [][]byte{}
+		cursor := history.Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range keys {
+			err := history.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		err := updateBoltLeases(btx, id, nil)
+		if err != nil {
+			return err
+		}
+		err = deleteBoltRecords(btx.Bucket(approvalBucket), func(v []byte) (bool, error) {
+			approval := boltFeeApproval{}
+			err := json.Unmarshal(v, &approval)
+			return approval.TrackedTxId == id, err
+		})
+		if err != nil {
+			return err
+		}
+		err = deleteBoltRecords(btx.Bucket(spendBucket), func(v []byte) (bool, error) {
+			spend := boltFeeSpend{}
+			err := json.Unmarshal(v, &spend)
+			return spend.SignedTxId == id, err
+		})
+		if err != nil {
+			return err
+		}
+		return btx.Bucket(signedTxBucket).Delete(prefix)
+	})
+}
+
+// updateBoltLeases applies update to every lease held by the tracked
+// transaction id, a nil update deletes them.
+func updateBoltLeases(btx *bolt.Tx, id int64, update func(lease *types.UtxoLease)) error {
+	bucket := btx.Bucket(leaseBucket)
+	leases := []types.UtxoLease{}
+	err := bucket.ForEach(func(k, v []byte) error {
+		lease := types.UtxoLease{}
+		err := json.Unmarshal(v, &lease)
+		if err != nil {
+			return err
+		}
+		if lease.TrackedTxId == id {
+			leases = append(leases, lease)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, lease := range leases {
+		if update == nil {
+			err = bucket.Delete([]byte(lease.OutPoint))
+		} else {
+			update(&lease)
+			err = putBoltLease(bucket, lease)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putBoltLease(bucket *bolt.Bucket, lease types.UtxoLease) error {
+	value, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(lease.OutPoint), value)
+}
+
+func (s *BoltStore) LeaseUtxos(id int64, outPoints []string) error {
+	now := time.Now().UTC()
+	return s.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(leaseBucket)
+		for _, outPoint := range outPoints {
+			value := bucket.Get([]byte(outPoint))
+			if value != nil {
+				lease := types.UtxoLease{}
+				err := json.Unmarshal(value, &lease)
+				if err != nil {
+					return err
+				}
+				if !lease.Released {
+					if lease.TrackedTxId != id {
+						return fmt.Errorf("utxo %s is leased to tracked tx %d", outPoint, lease.TrackedTxId)
+					}
+					continue
+				}
+			}
+			err := putBoltLease(bucket, types.UtxoLease{OutPoint: outPoint, TrackedTxId: id, CreatedAt: now})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) ReleaseUtxos(outPoints []string) error {
+	return s.updateBoltLeasesAt(outPoints, func(bucket *bolt.Bucket, lease types.UtxoLease) error {
+		lease.Released = true
+		return putBoltLease(bucket, lease)
+	})
+}
+
+func (s *BoltStore) DeleteUtxoLeases(outPoints []string) error {
+	return s.updateBoltLeasesAt(outPoints, func(bucket *bolt.Bucket, lease types.UtxoLease) error {
+		if !lease.Released {
+			return nil
+		}
+		return bucket.Delete([]byte(lease.OutPoint))
+	})
+}
+
+// updateBoltLeasesAt calls update with the lease on each of outPoints that
+// has one.
+func (s *BoltStore) updateBoltLeasesAt(outPoints []string, update func(bucket *bolt.Bucket, lease types.UtxoLease) error) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(leaseBucket)
+		for _, outPoint := range outPoints {
+			value := bucket.Get([]byte(outPoint))
+			if value == nil {
+				continue
+			}
+			lease := types.UtxoLease{}
+			err := json.Unmarshal(value, &lease)
+			if err != nil {
+				return err
+			}
+			err = update(bucket, lease)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) ListUtxoLeases() ([]types.UtxoLease, error) {
+	leases := []types.UtxoLease{}
+	err := s.db.View(func(btx *bolt.Tx) error {
+		return btx.Bucket(leaseBucket).ForEach(func(k, v []byte) error {
+			lease := types.UtxoLease{}
+			err := json.Unmarshal(v, &lease)
+			if err != nil {
+				return err
+			}
+			leases = append(leases, lease)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		if !leases[i].CreatedAt.Equal(leases[j].CreatedAt) {
+			return leases[i].CreatedAt.Before(leases[j].CreatedAt)
+		}
+		return leases[i].OutPoint < leases[j].OutPoint
+	})
+	return leases, nil
+}
+
+// filterTrackedTx returns the tracked transactions matching keep, ordered by id.
+func (s *BoltStore) filterTrackedTx(keep func(tx *types.TrackedTx) bool) ([]types.TrackedTx, error) {
+	txs := []types.TrackedTx{}
+	err := s.db.View(func(btx *bolt.Tx) error {
+		return btx.Bucket(signedTxBucket).ForEach(func(k, v []byte) error {
+			tx := types.TrackedTx{}
+			err := json.Unmarshal(v, &tx)
+			if err != nil {
+				return err
+			}
+			if keep(&tx) {
+				txs = append(txs, tx)
+			}
+			return nil
+		})
+	})
+	return txs, err
+}
+
+func (s *BoltStore) QueryTrackedTxByUnlockHeight(unlockHeight int64) ([]types.TrackedTx, error) {
+	return s.filterTrackedTx(func(tx *types.TrackedTx) bool {
+		return tx.UnlockHeight <= unlockHeight && (tx.State == types.TxStateSigned || tx.State == types.TxStateWaitingForHeight)
+	})
+}
+
+func (s *BoltStore) QueryTrackedTxByState(states ...types.TxState) ([]types.TrackedTx, error) {
+	return s.filterTrackedTx(func(tx *types.TrackedTx) bool {
+		for _, state := range states {
+			if tx.State == state {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (s *BoltStore) ListTrackedTx() ([]types.TrackedTx, error) {
+	return s.filterTrackedTx(func(tx *types.TrackedTx) bool { return true })
+}
+
+// latestTrackedTx returns the matching transaction with the highest id.
+func (s *BoltStore) latestTrackedTx(keep func(tx *types.TrackedTx) bool) (*types.TrackedTx, error) {
+	txs, err := s.filterTrackedTx(keep)
+	if err != nil || len(txs) == 0 {
+		return nil, err
+	}
+	sort.Slice(txs, func(i, j int) bool { return txs[i].Id < txs[j].Id })
+	return &txs[len(txs)-1], nil
+}
+
+func (s *BoltStore) GetTrackedTxByNyksTxid(reserveId string, roundId string, nyksTxid string) (*types.TrackedTx, error) {
+	return s.latestTrackedTx(func(tx *types.TrackedTx) bool {
+		return tx.ReserveId == reserveId && tx.RoundId == roundId && tx.NyksTxid == nyksTxid
+	})
+}
+
+func (s *BoltStore) GetTrackedTx(id int64) (*types.TrackedTx, error) {
+	var tracked *types.TrackedTx
+	err := s.db.View(func(btx *bolt.Tx) error {
+		if btx.Bucket(signedTxBucket).Get(boltKey(id)) == nil {
+			return nil
+		}
+		var err error
+		tracked, err = getBoltTrackedTx(btx.Bucket(signedTxBucket), id)
+		return err
+	})
+	return tracked, err
+}
+
+func (s *BoltStore) GetTrackedTxByTxid(txid string) (*types.TrackedTx, error) {
+	return s.latestTrackedTx(func(tx *types.TrackedTx) bool {
+		return tx.Txid == txid
+	})
+}
+
+// boltFeeApproval keeps the transaction the API leaves out.
+type boltFeeApproval struct {
+	types.FeeApproval
+	Tx []byte
+}
+
+type boltFeeSpend struct {
+	SignedTxId int64
+	Amount     int64
+	CreatedAt  time.Time
+}
+
+// deleteBoltRecords deletes the records of bucket match returns true for.
+func deleteBoltRecords(bucket *bolt.Bucket, match func(v []byte) (bool, error)) error {
+	keys := [][]byte{}
+	err := bucket.ForEach(func(k, v []byte) error {
+		matched, err := match(v)
+		if matched {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err = bucket.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putBoltFeeApproval(bucket *bolt.Bucket, approval types.FeeApproval) error {
+	value, err := json.Marshal(boltFeeApproval{FeeApproval: approval, Tx: approval.Tx})
+	if err != nil {
+		return err
+	}
+	return bucket.Put(boltKey(approval.Id), value)
+}
+
+func getBoltFeeApproval(bucket *bolt.Bucket, id int64) (*types.FeeApproval, error) {
+	value := bucket.Get(boltKey(id))
+	if value == nil {
+		return nil, nil
+	}
+	approval := boltFeeApproval{}
+	err := json.Unmarshal(value, &approval)
+	if err != nil {
+		return nil, err
+	}
+	approval.FeeApproval.Tx = approval.Tx
+	return &approval.FeeApproval, nil
+}
+
+func (s *BoltStore) InsertFeeApproval(approval types.FeeApproval) (int64, error) {
+	err := s.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(approvalBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		approval.Id = int64(seq)
+		approval.Status = types.ApprovalPending
+		approval.CreatedAt = time.Now().UTC()
+		return putBoltFeeApproval(bucket, approval)
+	})
+	return approval.Id, err
+}
+
+func (s *BoltStore) GetFeeApproval(id int64) (*types.FeeApproval, error) {
+	var approval *types.FeeApproval
+	err := s.db.View(func(btx *bolt.Tx) error {
+		var err error
+		approval, err = getBoltFeeApproval(btx.Bucket(approvalBucket), id)
+		return err
+	})
+	return approval, err
+}
+
+func (s *BoltStore) ListFeeApprovals(statuses ...types.ApprovalStatus) ([]types.FeeApproval, error) {
+	approvals := []types.FeeApproval{}
+	err := s.db.View(func(btx *bolt.Tx) error {
+		return btx.Bucket(approvalBucket).ForEach(func(k, v []byte) error {
+			approval := boltFeeApproval{}
+			err := json.Unmarshal(v, &approval)
+			if err != nil {
+				return err
+			}
+			approval.FeeApproval.Tx = approval.Tx
+			if len(statuses) == 0 {
+				approvals = append(approvals, approval.FeeApproval)
+				return nil
+			}
+			for _, status := range statuses {
+				if approval.Status == status {
+					approvals = append(approvals, approval.FeeApproval)
+					break
+				}
+			}
+			return nil
+		})
+	})
+	return approvals, err
+}
+
+func (s *BoltStore) UpdateFeeApprovalStatus(id int64, from types.ApprovalStatus, to types.ApprovalStatus) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(approvalBucket)
+		approval, err := getBoltFeeApproval(bucket, id)
+		if err != nil {
+			return err
+		}
+		if approval == nil || approval.Status != from {
+			return fmt.Errorf("fee approval %d is not %s", id, from)
+		}
+		approval.Status = to
+		approval.DecidedAt = time.Now().UTC()
+		return putBoltFeeApproval(bucket, *approval)
+	})
+}
+
+func (s *BoltStore) RecordFeeSpend(id int64, amount int64) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(spendBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(boltFeeSpend{SignedTxId: id, Amount: amount, CreatedAt: time.Now().UTC()})
+		if err != nil {
+			return err
+		}
+		return bucket.Put(boltKey(int64(seq)), value)
+	})
+}
+
+func (s *BoltStore) FeeSpentSince(since time.Time) (int64, error) {
+	spent := int64(0)
+	err := s.db.View(func(btx *bolt.Tx) error {
+		return btx.Bucket(spendBucket).ForEach(func(k, v []byte) error {
+			spend := boltFeeSpend{}
+			err := json.Unmarshal(v, &spend)
+			if err != nil {
+				return err
+			}
+			if !spend.CreatedAt.Before(since) {
+				spent += spend.Amount
+			}
+			return nil
+		})
+	})
+	return spent, err
+}
+
+// boltSimulatedBroadcast keeps the transaction the API leaves out.
+type boltSimulatedBroadcast struct {
+	types.SimulatedBroadcast
+	Tx []byte
+}
+
+func (s *BoltStore) InsertSimulatedBroadcast(broadcast types.SimulatedBroadcast) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(simulatedBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		broadcast.Id = int64(seq)
+		broadcast.CreatedAt = time.Now().UTC()
+		value, err := json.Marshal(boltSimulatedBroadcast{SimulatedBroadcast: broadcast, Tx: broadcast.Tx})
+		if err != nil {
+			return err
+		}
+		return bucket.Put(boltKey(broadcast.Id), value)
+	})
+}
+
+func (s *BoltStore) ListSimulatedBroadcasts() ([]types.SimulatedBroadcast, error) {
+	broadcasts := []types.SimulatedBroadcast{}
+	err := s.db.View(func(btx *bolt.Tx) error {
+		return btx.Bucket(simulatedBucket).ForEach(func(k, v []byte) error {
+			broadcast := boltSimulatedBroadcast{}
+			err := json.Unmarshal(v, &broadcast)
+			if err != nil {
+				return err
+			}
+			broadcast.SimulatedBroadcast.Tx = broadcast.Tx
+			broadcasts = append(broadcasts, broadcast.SimulatedBroadcast)
+			return nil
+		})
+	})
+	return broadcasts, err
+}
@@ -0,0 +1,300 @@
+package db
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/twilight-project/rbf-node/types"
+)
+
+func openTestStore(t *testing.T) *BoltStore {
+	t.Helper()
+	store, err := OpenBoltStore(filepath.Join(t.TempDir(), "rbf.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func insertTestTx(t *testing.T, store *BoltStore, reserveId string, roundId string, nyksTxid string) int64 {
+	t.Helper()
+	id, err := store.InsertReceivedTx([]byte{0x01}, nyksTxid, 100, reserveId, roundId, types.TxTypeSweep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func transition(t *testing.T, store *BoltStore, id int64, states ...types.TxState) {
+	t.Helper()
+	for _, state := range states {
+		err := store.TransitionTx(id, state, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func trackedTx(t *testing.T, store *BoltStore, id int64) *types.TrackedTx {
+	t.Helper()
+	tracked, err := store.GetTrackedTx(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracked == nil {
+		t.Fatalf("tracked tx %d not found", id)
+	}
+	return tracked
+}
+
+// leasesOf returns the outpoints leased to id, released ones included when
+// released is set.
+func leasesOf(t *testing.T, store *BoltStore, id int64, released bool) []string {
+	t.Helper()
+	leases, err := store.ListUtxoLeases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outPoints := []string{}
+	for _, lease := range leases {
+		if lease.TrackedTxId == id && (released || !lease.Released) {
+			outPoints = append(outPoints, lease.OutPoint)
+		}
+	}
+	return outPoints
+}
+
+func TestBoltTransitionTx(t *testing.T) {
+	store := openTestStore(t)
+	id := insertTestTx(t, store, "1", "1", "nyks")
+
+	err := store.TransitionTx(id, types.TxStateBroadcast, 0)
+	if err == nil {
+		t.Fatal("received -> broadcast was accepted")
+	}
+	if tracked := trackedTx(t, store, id); tracked.State != types.TxStateReceived {
+		t.Fatalf("state %s after a rejected transition, want %s", tracked.State, types.TxStateReceived)
+	}
+
+	transition(t, store, id, types.TxStateFunded, types.TxStateSigned, types.TxStateBroadcast, types.TxStateConfirmed)
+	transition(t, store, id, types.TxStateConfirmed)
+	err = store.TransitionTx(id, types.TxStateConfirmed, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracked := trackedTx(t, store, id); tracked.Confirmations != 3 {
+		t.Fatalf("%d confirmations, want 3", tracked.Confirmations)
+	}
+
+	transition(t, store, id, types.TxStateFinal)
+	for _, state := range []types.TxState{types.TxStateConfirmed, types.TxStateFailed, types.TxStateReceived} {
+		if store.TransitionTx(id, state, 0) == nil {
+			t.Errorf("final -> %s was accepted", state)
+		}
+	}
+	if err = store.FailTx(id, types.FailureBroadcast); err == nil {
+		t.Error("a final transaction was failed")
+	}
+}
+
+func TestBoltFailTx(t *testing.T) {
+	store := openTestStore(t)
+	id := insertTestTx(t, store, "1", "1", "nyks")
+
+	err := store.FailTx(id, types.FailureApprovalRejected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracked := trackedTx(t, store, id)
+	if tracked.State != types.TxStateFailed || tracked.Failure != types.FailureApprovalRejected {
+		t.Fatalf("%s with cause %q, want failed with cause %q", tracked.State, tracked.Failure, types.FailureApprovalRejected)
+	}
+
+	transition(t, store, id, types.TxStateReceived)
+	if tracked := trackedTx(t, store, id); tracked.Failure != "" {
+		t.Fatalf("cause %q kept after leaving failed", tracked.Failure)
+	}
+}
+
+func TestBoltLeaseUtxos(t *testing.T) {
+	store := openTestStore(t)
+	first := insertTestTx(t, store, "1", "1", "first")
+	second := insertTestTx(t, store, "1", "2", "second")
+
+	err := store.LeaseUtxos(first, []string{"a:0", "b:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// leasing again to the same transaction is a no-op
+	err = store.LeaseUtxos(first, []string{"a:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.LeaseUtxos(second, []string{"c:0", "b:1"})
+	if err == nil {
+		t.Fatal("a coin leased to another transaction was leased")
+	}
+	if leased := leasesOf(t, store, second, true); len(leased) != 0 {
+		t.Fatalf("%v leased although the lease failed", leased)
+	}
+
+	err = store.ReleaseUtxos([]string{"b:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.LeaseUtxos(second, []string{"c:0", "b:1"})
+	if err != nil {
+		t.Fatalf("taking over a released lease : %v", err)
+	}
+	if leased := leasesOf(t, store, first, false); len(leased) != 1 || leased[0] != "a:0" {
+		t.Fatalf("first holds %v, want [a:0]", leased)
+	}
+	if leased := leasesOf(t, store, second, false); len(leased) != 2 {
+		t.Fatalf("second holds %v, want [b:1 c:0]", leased)
+	}
+
+	// failing releases the leases, only released ones are deleted
+	err = store.FailTx(first, types.FailureFunding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leased := leasesOf(t, store, first, false); len(leased) != 0 {
+		t.Fatalf("failed transaction still holds %v", leased)
+	}
+	err = store.DeleteUtxoLeases([]string{"a:0", "b:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leases, err := store.ListUtxoLeases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 2 {
+		t.Fatalf("%d leases left, want b:1 and c:0", len(leases))
+	}
+}
+
+func TestBoltReplaceTrackedTx(t *testing.T) {
+	store := openTestStore(t)
+	id := insertTestTx(t, store, "1", "1", "nyks")
+	transition(t, store, id, types.TxStateFunded, types.TxStateSigned, types.TxStateBroadcast)
+	err := store.UpdateTrackedTx(id, []byte{0x02}, "funded", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.LeaseUtxos(id, []string{"a:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newId, err := store.ReplaceTrackedTx(id, []byte{0x03}, "bumped", 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := trackedTx(t, store, id)
+	if original.State != types.TxStateReplaced || original.ReplacedBy != newId {
+		t.Fatalf("original is %s replaced by %d, want replaced by %d", original.State, original.ReplacedBy, newId)
+	}
+	replacement := trackedTx(t, store, newId)
+	if replacement.State != types.TxStateBroadcast || replacement.Txid != "bumped" || replacement.Fee != 2000 || replacement.BumpCount != 1 {
+		t.Fatalf("unexpected replacement %+v", replacement)
+	}
+	if replacement.NyksTxid != "nyks" || replacement.ReserveId != "1" || replacement.RoundId != "1" {
+		t.Fatalf("replacement does not inherit the nyks data : %+v", replacement)
+	}
+	if leased := leasesOf(t, store, newId, false); len(leased) != 1 {
+		t.Fatalf("replacement holds %v, want [a:0]", leased)
+	}
+
+	// a replaced transaction can not be replaced again
+	_, err = store.ReplaceTrackedTx(id, []byte{0x04}, "again", 3000)
+	if err == nil {
+		t.Fatal("a replaced transaction was replaced")
+	}
+
+	err = store.RevertReplacement(id, newId+1, types.TxStateBroadcast)
+	if err == nil {
+		t.Fatal("reverted a replacement that is not the one recorded")
+	}
+	err = store.RevertReplacement(id, newId, types.TxStateBroadcast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original = trackedTx(t, store, id)
+	if original.State != types.TxStateBroadcast || original.ReplacedBy != 0 {
+		t.Fatalf("original is %s replaced by %d after revert", original.State, original.ReplacedBy)
+	}
+	if tracked, err := store.GetTrackedTx(newId); err != nil || tracked != nil {
+		t.Fatalf("replacement still stored after revert : %+v, %v", tracked, err)
+	}
+	if leased := leasesOf(t, store, id, false); len(leased) != 1 {
+		t.Fatalf("original holds %v after revert, want [a:0]", leased)
+	}
+}
+
+func TestBoltGetTrackedTxByNyksTxid(t *testing.T) {
+	store := openTestStore(t)
+	if tracked, err := store.GetTrackedTxByNyksTxid("1", "1", "nyks"); err != nil || tracked != nil {
+		t.Fatalf("found %+v, %v in an empty store", tracked, err)
+	}
+
+	id := insertTestTx(t, store, "1", "1", "nyks")
+	other := insertTestTx(t, store, "2", "1", "nyks")
+	transition(t, store, id, types.TxStateFunded, types.TxStateSigned, types.TxStateBroadcast)
+	first, err := store.ReplaceTrackedTx(id, []byte{0x02}, "first", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := store.ReplaceTrackedTx(first, []byte{0x03}, "second", 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracked, err := store.GetTrackedTxByNyksTxid("1", "1", "nyks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracked == nil || tracked.Id != second {
+		t.Fatalf("got %+v, want the newest replacement %d", tracked, second)
+	}
+	tracked, err = store.GetTrackedTxByNyksTxid("2", "1", "nyks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracked == nil || tracked.Id != other {
+		t.Fatalf("got %+v, want %d of reserve 2", tracked, other)
+	}
+}
+
+func TestBoltInsertReceivedTxOnce(t *testing.T) {
+	store := openTestStore(t)
+	id := insertTestTx(t, store, "1", "1", "nyks")
+
+	_, err := store.InsertReceivedTx([]byte{0x01}, "nyks", 100, "1", "1", types.TxTypeSweep)
+	if !errors.Is(err, ErrAlreadyTracked) {
+		t.Fatalf("inserting twice returned %v, want ErrAlreadyTracked", err)
+	}
+	// the same nyks transaction in another round is tracked separately
+	insertTestTx(t, store, "1", "2", "nyks")
+
+	// replacing it does not let the nyks transaction be inserted again
+	transition(t, store, id, types.TxStateFunded, types.TxStateSigned, types.TxStateBroadcast)
+	_, err = store.ReplaceTrackedTx(id, []byte{0x02}, "bumped", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.InsertReceivedTx([]byte{0x01}, "nyks", 100, "1", "1", types.TxTypeSweep)
+	if !errors.Is(err, ErrAlreadyTracked) {
+		t.Fatalf("inserting after a replacement returned %v, want ErrAlreadyTracked", err)
+	}
+	txs, err := store.ListTrackedTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 3 {
+		t.Fatalf("%d rows, want the original, its replacement and the other round", len(txs))
+	}
+}
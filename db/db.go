@@ -8,78 +8,51 @@ import (
 	"github.com/spf13/viper"
 )
 
-func InitDB() *sql.DB {
-	psqlconn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", viper.Get("DB_host"), viper.Get("DB_port"), viper.Get("DB_user"), viper.Get("DB_password"), viper.Get("DB_name"))
-	db, err := sql.Open("postgres", psqlconn)
-	if err != nil {
-		log.Println("DB error : ", err)
-		panic(err)
-	}
-	fmt.Println("DB initialized")
-	return db
-}
-
-func QuerySignedTx(dbconn *sql.DB, unlock_height int64) [][]byte {
-	DB_reader, err := dbconn.Query("select tx from signed_tx where unlock_height <= $1", unlock_height)
-	if err != nil {
-		fmt.Println("An error occured while query script signed tx: ", err)
-	}
-
-	defer DB_reader.Close()
-	txs := [][]byte{}
-
-	for DB_reader.Next() {
-		tx := []byte{}
-		err := DB_reader.Scan(
-			&tx,
-		)
+// InitStore opens the store selected by DB_backend, "postgres" (default) or
+// "bolt" for a single file database at DB_path.
+func InitStore() Store {
+	switch viper.GetString("DB_backend") {
+	case "", "postgres":
+		return NewPostgresStore(InitDB())
+	case "bolt":
+		path := viper.GetString("DB_path")
+		if path == "" {
+			path = "rbf-node.db"
+		}
+		store, err := OpenBoltStore(path)
 		if err != nil {
-			fmt.Println(err)
+			log.Println("DB error : ", err)
+			panic(err)
 		}
-
-		txs = append(txs, tx)
+		fmt.Println("DB initialized at ", path)
+		return store
+	default:
+		panic(fmt.Sprintf("unknown DB_backend %q", viper.GetString("DB_backend")))
 	}
-	return txs
 }
 
-func QuerySignedTxAll(dbconn *sql.DB) [][]byte {
-	DB_reader, err := dbconn.Query("select tx from signed_tx;")
+func InitDB() *sql.DB {
+	db, err := OpenDB()
 	if err != nil {
-		fmt.Println("An error occured while query script signed tx: ", err)
+		log.Println("DB error : ", err)
+		panic(err)
 	}
+	fmt.Println("DB initialized")
 
-	defer DB_reader.Close()
-	txs := [][]byte{}
-
-	for DB_reader.Next() {
-		tx := []byte{}
-		err := DB_reader.Scan(
-			&tx,
-		)
-		if err != nil {
-			fmt.Println(err)
-		}
-
-		txs = append(txs, tx)
+	if viper.GetBool("DB_skip_migrations") {
+		return db
 	}
-	return txs
-}
-
-func DeleteSignedTx(dbconn *sql.DB, tx []byte) {
-	_, err := dbconn.Exec("DELETE FROM signed_tx WHERE tx = $1", tx)
+	applied, err := MigrateUp(db)
 	if err != nil {
-		fmt.Println("An error occurred while executing delete signed tx: ", err)
-	} else {
-		fmt.Println("Transaction successfully deleted")
+		log.Println("DB migration error : ", err)
+		panic(err)
 	}
+	fmt.Printf("DB schema up to date, %d migrations applied\n", applied)
+	return db
 }
 
-func InsertSignedtx(dbconn *sql.DB, tx []byte, unlock_height int64) {
-	_, err := dbconn.Exec("INSERT into signed_tx VALUES ($1, $2)",
-		tx,
-		unlock_height,
-	)
-	if err != nil {
-		fmt.Println("An error occured while executing insert signed sweep tx: ", err)
-	}
+// OpenDB opens the postgres connection from the config without migrating it.
+func OpenDB() (*sql.DB, error) {
+	psqlconn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", viper.Get("DB_host"), viper.Get("DB_port"), viper.Get("DB_user"), viper.Get("DB_password"), viper.Get("DB_name"))
+	return sql.Open("postgres", psqlconn)
 }
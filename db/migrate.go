@@ -0,0 +1,318 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the postgres advisory lock held while migrating so two
+// nodes sharing a database never migrate it at the same time.
+const migrationLockKey = 7278630011
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// migrationHooks run in the same transaction right after the up migration of
+// the given version, for data fixes that can not be expressed in SQL.
+var migrationHooks = map[int]func(*sql.Tx) error{
+	3: backfillTxids,
+}
+
+func LoadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		parts := strings.SplitN(base, "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid migration file name %s", name)
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %v", name, err)
+		}
+
+		content, err := migrationFiles.ReadFile("migrations/" + name)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d is missing its up or down file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// withMigrationLock runs fn on a dedicated connection holding the migration
+// advisory lock. Advisory locks are per session so the same connection has to
+// be used for the whole migration.
+func withMigrationLock(dbconn *sql.DB, fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := dbconn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey)
+	if err != nil {
+		return fmt.Errorf("failed to take migration lock: %v", err)
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockKey)
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+	return fn(conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, "select version, applied_at from schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		err := rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// MigrateUp applies every pending migration in order and returns the number of
+// migrations applied.
+func MigrateUp(dbconn *sql.DB) (int, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = withMigrationLock(dbconn, func(conn *sql.Conn) error {
+		ctx := context.Background()
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			err := runMigration(ctx, conn, m, true)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s failed: %v", m.Version, m.Name, err)
+			}
+			fmt.Printf("Applied migration %d_%s\n", m.Version, m.Name)
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// MigrateDown rolls back the given number of most recently applied migrations.
+func MigrateDown(dbconn *sql.DB, steps int) (int, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = withMigrationLock(dbconn, func(conn *sql.Conn) error {
+		ctx := context.Background()
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			err := runMigration(ctx, conn, m, false)
+			if err != nil {
+				return fmt.Errorf("rollback of migration %d_%s failed: %v", m.Version, m.Name, err)
+			}
+			fmt.Printf("Rolled back migration %d_%s\n", m.Version, m.Name)
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// MigrationsStatus reports which migrations are applied without changing the
+// database, every migration is pending while schema_migrations does not exist.
+func MigrationsStatus(dbconn *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	conn, err := dbconn.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var table sql.NullString
+	err = conn.QueryRowContext(ctx, "select to_regclass('schema_migrations')::text").Scan(&table)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]time.Time)
+	if table.Valid {
+		applied, err = appliedMigrations(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.Version]
+		statuses = append(statuses, MigrationStatus{Migration: m, Applied: ok, AppliedAt: appliedAt})
+	}
+	return statuses, nil
+}
+
+func runMigration(ctx context.Context, conn *sql.Conn, m Migration, up bool) error {
+	sqlTx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer sqlTx.Rollback()
+
+	if up {
+		_, err = sqlTx.ExecContext(ctx, m.Up)
+		if err != nil {
+			return err
+		}
+		if hook, ok := migrationHooks[m.Version]; ok {
+			err = hook(sqlTx)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = sqlTx.ExecContext(ctx, "INSERT into schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)", m.Version, m.Name, time.Now().UTC())
+	} else {
+		_, err = sqlTx.ExecContext(ctx, m.Down)
+		if err != nil {
+			return err
+		}
+		_, err = sqlTx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return sqlTx.Commit()
+}
+
+// backfillTxids fills in the txid of rows stored before transactions were
+// tracked by id.
+func backfillTxids(sqlTx *sql.Tx) error {
+	rows, err := sqlTx.Query("select id, tx from signed_tx where txid = ''")
+	if err != nil {
+		return err
+	}
+
+	txids := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var raw []byte
+		err := rows.Scan(&id, &raw)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tx := wire.NewMsgTx(wire.TxVersion)
+		err = tx.Deserialize(bytes.NewReader(raw))
+		if err != nil {
+			fmt.Printf("Skipping txid backfill of signed tx %d: %v\n", id, err)
+			continue
+		}
+		txids[id] = tx.TxHash().String()
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, txid := range txids {
+		_, err := sqlTx.Exec("UPDATE signed_tx SET txid = $1 WHERE id = $2", txid, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
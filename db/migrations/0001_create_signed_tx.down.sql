@@ -0,0 +1,3 @@
+-- 0001 adopts the signed_tx table of nodes that predate the migrations, so
+-- rolling it back keeps the table and its data.
+SELECT 1;
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS signed_tx (
+    tx bytea NOT NULL,
+    unlock_height bigint NOT NULL
+);
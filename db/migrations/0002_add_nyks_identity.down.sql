@@ -0,0 +1,4 @@
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS tx_type;
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS nyks_txid;
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS round_id;
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS reserve_id;
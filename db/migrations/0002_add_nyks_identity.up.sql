@@ -0,0 +1,4 @@
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS reserve_id text NOT NULL DEFAULT '';
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS round_id text NOT NULL DEFAULT '';
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS nyks_txid text NOT NULL DEFAULT '';
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS tx_type text NOT NULL DEFAULT 'sweep';
@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS tx_state_history;
+DROP INDEX IF EXISTS signed_tx_txid_idx;
+DROP INDEX IF EXISTS signed_tx_state_idx;
+DROP INDEX IF EXISTS signed_tx_nyks_idx;
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS confirmations;
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS state;
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS nyks_tx;
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS txid;
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS id;
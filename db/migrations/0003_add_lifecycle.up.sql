@@ -0,0 +1,22 @@
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS id bigserial PRIMARY KEY;
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS txid text NOT NULL DEFAULT '';
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS nyks_tx bytea;
+-- rows stored before the nyks transaction was kept hold the funded
+-- transaction only, they are left without one and are never replaced
+UPDATE signed_tx SET nyks_tx = ''::bytea WHERE nyks_tx IS NULL;
+ALTER TABLE signed_tx ALTER COLUMN nyks_tx SET NOT NULL;
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS state text NOT NULL DEFAULT 'signed';
+ALTER TABLE signed_tx ALTER COLUMN state SET DEFAULT 'received';
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS confirmations bigint NOT NULL DEFAULT 0;
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS updated_at timestamptz NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS signed_tx_nyks_idx ON signed_tx (reserve_id, round_id, nyks_txid);
+CREATE INDEX IF NOT EXISTS signed_tx_state_idx ON signed_tx (state);
+CREATE INDEX IF NOT EXISTS signed_tx_txid_idx ON signed_tx (txid);
+
+CREATE TABLE IF NOT EXISTS tx_state_history (
+    signed_tx_id bigint NOT NULL REFERENCES signed_tx (id),
+    state text NOT NULL,
+    confirmations bigint NOT NULL DEFAULT 0,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
@@ -0,0 +1,2 @@
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS replaced_by;
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS fee;
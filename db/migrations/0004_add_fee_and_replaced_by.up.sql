@@ -0,0 +1,2 @@
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS fee bigint NOT NULL DEFAULT 0;
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS replaced_by bigint REFERENCES signed_tx (id);
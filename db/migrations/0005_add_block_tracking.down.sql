@@ -0,0 +1,2 @@
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS block_height;
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS block_hash;
@@ -0,0 +1,2 @@
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS block_hash text NOT NULL DEFAULT '';
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS block_height bigint NOT NULL DEFAULT 0;
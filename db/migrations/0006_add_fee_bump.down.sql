@@ -0,0 +1,2 @@
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS bump_count;
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS broadcast_height;
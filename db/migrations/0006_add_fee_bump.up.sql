@@ -0,0 +1,2 @@
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS broadcast_height bigint NOT NULL DEFAULT 0;
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS bump_count integer NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS child_fee;
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS child_txid;
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS child_tx;
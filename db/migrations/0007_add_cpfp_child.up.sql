@@ -0,0 +1,3 @@
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS child_tx bytea;
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS child_txid text NOT NULL DEFAULT '';
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS child_fee bigint NOT NULL DEFAULT 0;
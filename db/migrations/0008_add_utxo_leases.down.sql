@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS utxo_leases_signed_tx_idx;
+DROP TABLE IF EXISTS utxo_leases;
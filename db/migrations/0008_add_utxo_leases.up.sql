@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS utxo_leases (
+    outpoint text PRIMARY KEY,
+    signed_tx_id bigint NOT NULL REFERENCES signed_tx (id),
+    released boolean NOT NULL DEFAULT false,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS utxo_leases_signed_tx_idx ON utxo_leases (signed_tx_id);
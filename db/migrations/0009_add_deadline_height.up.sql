@@ -0,0 +1 @@
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS deadline_height bigint NOT NULL DEFAULT 0;
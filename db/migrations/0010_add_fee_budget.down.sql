@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS fee_spends;
+DROP TABLE IF EXISTS fee_approvals;
@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS fee_approvals (
+    id bigserial PRIMARY KEY,
+    signed_tx_id bigint NOT NULL REFERENCES signed_tx (id),
+    kind text NOT NULL,
+    tx bytea,
+    txid text NOT NULL DEFAULT '',
+    fee bigint NOT NULL DEFAULT 0,
+    fee_rate bigint NOT NULL DEFAULT 0,
+    spend bigint NOT NULL DEFAULT 0,
+    reason text NOT NULL DEFAULT '',
+    status text NOT NULL DEFAULT 'pending',
+    created_at timestamptz NOT NULL DEFAULT now(),
+    decided_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS fee_approvals_status_idx ON fee_approvals (status);
+
+CREATE TABLE IF NOT EXISTS fee_spends (
+    id bigserial PRIMARY KEY,
+    signed_tx_id bigint NOT NULL REFERENCES signed_tx (id),
+    amount bigint NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS fee_spends_created_idx ON fee_spends (created_at);
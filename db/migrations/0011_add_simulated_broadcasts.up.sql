@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS simulated_broadcasts (
+    id bigserial PRIMARY KEY,
+    txid text NOT NULL,
+    tx bytea NOT NULL,
+    package boolean NOT NULL DEFAULT false,
+    allowed boolean NOT NULL,
+    reject_reason text NOT NULL DEFAULT '',
+    vsize bigint NOT NULL DEFAULT 0,
+    fee bigint NOT NULL DEFAULT 0,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
@@ -0,0 +1 @@
+ALTER TABLE signed_tx DROP COLUMN IF EXISTS rejections;
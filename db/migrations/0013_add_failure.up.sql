@@ -0,0 +1 @@
+ALTER TABLE signed_tx ADD COLUMN IF NOT EXISTS failure text NOT NULL DEFAULT '';
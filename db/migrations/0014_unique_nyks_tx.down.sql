@@ -0,0 +1 @@
+DROP INDEX IF EXISTS signed_tx_nyks_bump_idx;
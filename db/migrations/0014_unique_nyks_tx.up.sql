@@ -0,0 +1,3 @@
+-- one row per nyks transaction and fee bump, rows stored before the nyks
+-- identity was kept have none and are left out
+CREATE UNIQUE INDEX IF NOT EXISTS signed_tx_nyks_bump_idx ON signed_tx (reserve_id, round_id, nyks_txid, bump_count) WHERE nyks_txid <> '';
@@ -0,0 +1,651 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/twilight-project/rbf-node/types"
+)
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(dbconn *sql.DB) *PostgresStore {
+	return &PostgresStore{db: dbconn}
+}
+
+// DB returns the underlying connection, used by the migration commands.
+func (s *PostgresStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+const trackedTxColumns = "id, txid, tx, nyks_tx, nyks_txid, unlock_height, reserve_id, round_id, tx_type, state, confirmations, fee, replaced_by, block_hash, block_height, broadcast_height, bump_count, child_tx, child_txid, child_fee, deadline_height, rejections, failure, updated_at"
+
+func scanTrackedTx(row interface{ Scan(...interface{}) error }) (types.TrackedTx, error) {
+	tx := types.TrackedTx{}
+	var replacedBy sql.NullInt64
+	var rejections []byte
+	err := row.Scan(
+		&tx.Id,
+		&tx.Txid,
+		&tx.Tx,
+		&tx.NyksTx,
+		&tx.NyksTxid,
+		&tx.UnlockHeight,
+		&tx.ReserveId,
+		&tx.RoundId,
+		&tx.TxType,
+		&tx.State,
+		&tx.Confirmations,
+		&tx.Fee,
+		&replacedBy,
+		&tx.BlockHash,
+		&tx.BlockHeight,
+		&tx.BroadcastHeight,
+		&tx.BumpCount,
+		&tx.ChildTx,
+		&tx.ChildTxid,
+		&tx.ChildFee,
+		&tx.DeadlineHeight,
+		&rejections,
+		&tx.Failure,
+		&tx.UpdatedAt,
+	)
+	if err != nil {
+		return tx, err
+	}
+	tx.ReplacedBy = replacedBy.Int64
+	err = json.Unmarshal(rejections, &tx.Rejections)
+	return tx, err
+}
+
+func (s *PostgresStore) queryTrackedTx(query string, args ...interface{}) ([]types.TrackedTx, error) {
+	DB_reader, err := s.db.Query(query, args...)
+	if err != nil {
+		fmt.Println("An error occured while query tracked tx: ", err)
+		return nil, err
+	}
+	defer DB_reader.Close()
+
+	txs := []types.TrackedTx{}
+	for DB_reader.Next() {
+		tx, err := scanTrackedTx(DB_reader)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		txs = append(txs, tx)
+	}
+	return txs, DB_reader.Err()
+}
+
+func (s *PostgresStore) getTrackedTx(query string, args ...interface{}) (*types.TrackedTx, error) {
+	tx, err := scanTrackedTx(s.db.QueryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		fmt.Println("An error occured while query tracked tx: ", err)
+		return nil, err
+	}
+	return &tx, nil
+}
+
+func (s *PostgresStore) InsertReceivedTx(nyksTx []byte, nyksTxid string, unlockHeight int64, reserveId string, roundId string, txType string) (int64, error) {
+	now := time.Now().UTC()
+	sqlTx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer sqlTx.Rollback()
+
+	var id int64
+	err = sqlTx.QueryRow("INSERT into signed_tx (txid, tx, nyks_tx, nyks_txid, unlock_height, reserve_id, round_id, tx_type, state, confirmations, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, 0, $10) ON CONFLICT (reserve_id, round_id, nyks_txid, bump_count) WHERE nyks_txid <> '' DO NOTHING RETURNING id",
+		nyksTxid,
+		nyksTx,
+		nyksTx,
+		nyksTxid,
+		unlockHeight,
+		reserveId,
+		roundId,
+		txType,
+		types.TxStateReceived,
+		now,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrAlreadyTracked
+	}
+	if err != nil {
+		fmt.Printf("An error occured while executing insert received %s tx: %v\n", txType, err)
+		return 0, err
+	}
+
+	err = insertStateHistory(sqlTx, id, types.TxStateReceived, 0, now)
+	if err != nil {
+		return 0, err
+	}
+	return id, sqlTx.Commit()
+}
+
+func (s *PostgresStore) UpdateTrackedTx(id int64, tx []byte, txid string, fee int64) error {
+	_, err := s.db.Exec("UPDATE signed_tx SET tx = $1, txid = $2, fee = $3, updated_at = $4 WHERE id = $5", tx, txid, fee, time.Now().UTC(), id)
+	if err != nil {
+		fmt.Println("An error occured while executing update tracked tx: ", err)
+	}
+	return err
+}
+
+func (s *PostgresStore) TransitionTx(id int64, to types.TxState, confirmations int64) error {
+	return s.transitionTx(id, to, confirmations, "")
+}
+
+func (s *PostgresStore) FailTx(id int64, cause types.FailureCause) error {
+	return s.transitionTx(id, types.TxStateFailed, 0, cause)
+}
+
+func (s *PostgresStore) transitionTx(id int64, to types.TxState, confirmations int64, cause types.FailureCause) error {
+	now := time.Now().UTC()
+	sqlTx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer sqlTx.Rollback()
+
+	var from types.TxState
+	var currentConfirmations int64
+	err = sqlTx.QueryRow("select state, confirmations from signed_tx where id = $1 for update", id).Scan(&from, &currentConfirmations)
+	if err != nil {
+		return err
+	}
+	if from == to && currentConfirmations == confirmations {
+		return nil
+	}
+	if !CanTransition(from, to) {
+		return fmt.Errorf("invalid state transition for tracked tx %d : %s -> %s", id, from, to)
+	}
+
+	_, err = sqlTx.Exec("UPDATE signed_tx SET state = $1, confirmations = $2, failure = $3, updated_at = $4 WHERE id = $5", to, confirmations, cause, now, id)
+	if err != nil {
+		return err
+	}
+	if releasesLeases(to) {
+		_, err = sqlTx.Exec("UPDATE utxo_leases SET released = true WHERE signed_tx_id = $1", id)
+		if err != nil {
+			return err
+		}
+	}
+	err = insertStateHistory(sqlTx, id, to, confirmations, now)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("tracked tx %d : %s -> %s\n", id, from, to)
+	return sqlTx.Commit()
+}
+
+func (s *PostgresStore) ReplaceTrackedTx(id int64, tx []byte, txid string, fee int64) (int64, error) {
+	now := time.Now().UTC()
+	sqlTx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer sqlTx.Rollback()
+
+	var from types.TxState
+	err = sqlTx.QueryRow("select state from signed_tx where id = $1 for update", id).Scan(&from)
+	if err != nil {
+		return 0, err
+	}
+	if !CanTransition(from, types.TxStateReplaced) {
+		return 0, fmt.Errorf("invalid state transition for tracked tx %d : %s -> %s", id, from, types.TxStateReplaced)
+	}
+
+	var newId int64
+	err = sqlTx.QueryRow(`INSERT into signed_tx (txid, tx, nyks_tx, nyks_txid, unlock_height, deadline_height, reserve_id, round_id, tx_type, state, confirmations, fee, bump_count, updated_at)
+		SELECT $1, $2, nyks_tx, nyks_txid, unlock_height, deadline_height, reserve_id, round_id, tx_type, $3, 0, $4, bump_count + 1, $5 FROM signed_tx WHERE id = $6 RETURNING id`,
+		txid,
+		tx,
+		types.TxStateBroadcast,
+		fee,
+		now,
+		id,
+	).Scan(&newId)
+	if err != nil {
+		return 0, err
+	}
+	_, err = sqlTx.Exec("UPDATE signed_tx SET state = $1, confirmations = 0, replaced_by = $2, updated_at = $3 WHERE id = $4", types.TxStateReplaced, newId, now, id)
+	if err != nil {
+		return 0, err
+	}
+	_, err = sqlTx.Exec("UPDATE utxo_leases SET signed_tx_id = $1 WHERE signed_tx_id = $2 AND NOT released", newId, id)
+	if err != nil {
+		return 0, err
+	}
+	err = insertStateHistory(sqlTx, newId, types.TxStateBroadcast, 0, now)
+	if err != nil {
+		return 0, err
+	}
+	err = insertStateHistory(sqlTx, id, types.TxStateReplaced, 0, now)
+	if err != nil {
+		return 0, err
+	}
+	err = sqlTx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	fmt.Printf("tracked tx %d : %s -> %s\n", id, from, types.TxStateReplaced)
+	return newId, nil
+}
+
+func (s *PostgresStore) RevertReplacement(id int64, newId int64, state types.TxState) error {
+	now := time.Now().UTC()
+	sqlTx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer sqlTx.Rollback()
+
+	_, err = sqlTx.Exec("UPDATE utxo_leases SET signed_tx_id = $1 WHERE signed_tx_id = $2", id, newId)
+	if err != nil {
+		return err
+	}
+	_, err = sqlTx.Exec("DELETE FROM tx_state_history WHERE signed_tx_id = $1", newId)
+	if err != nil {
+		return err
+	}
+	result, err := sqlTx.Exec("UPDATE signed_tx SET state = $1, confirmations = 0, replaced_by = NULL, updated_at = $2 WHERE id = $3 AND replaced_by = $4", state, now, id, newId)
+	if err != nil {
+		return err
+	}
+	reverted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if reverted == 0 {
+		return fmt.Errorf("tracked tx %d is not replaced by %d", id, newId)
+	}
+	_, err = sqlTx.Exec("DELETE FROM signed_tx WHERE id = $1", newId)
+	if err != nil {
+		return err
+	}
+	err = insertStateHistory(sqlTx, id, state, 0, now)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("tracked tx %d : %s -> %s\n", id, types.TxStateReplaced, state)
+	return sqlTx.Commit()
+}
+
+func (s *PostgresStore) SetTrackedTxBlock(id int64, blockHash string, blockHeight int64) error {
+	_, err := s.db.Exec("UPDATE signed_tx SET block_hash = $1, block_height = $2, updated_at = $3 WHERE id = $4", blockHash, blockHeight, time.Now().UTC(), id)
+	if err != nil {
+		fmt.Println("An error occured while executing update tracked tx block: ", err)
+	}
+	return err
+}
+
+func (s *PostgresStore) SetTrackedTxBroadcastHeight(id int64, height int64) error {
+	_, err := s.db.Exec("UPDATE signed_tx SET broadcast_height = $1, updated_at = $2 WHERE id = $3", height, time.Now().UTC(), id)
+	if err != nil {
+		fmt.Println("An error occured while executing update tracked tx broadcast height: ", err)
+	}
+	return err
+}
+
+func (s *PostgresStore) SetTrackedTxDeadlineHeight(id int64, height int64) error {
+	_, err := s.db.Exec("UPDATE signed_tx SET deadline_height = $1, updated_at = $2 WHERE id = $3", height, time.Now().UTC(), id)
+	if err != nil {
+		fmt.Println("An error occured while executing update tracked tx deadline height: ", err)
+	}
+	return err
+}
+
+func (s *PostgresStore) SetTrackedTxRejections(id int64, rejections []types.Rejection) error {
+	if rejections == nil {
+		rejections = []types.Rejection{}
+	}
+	value, err := json.Marshal(rejections)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("UPDATE signed_tx SET rejections = $1, updated_at = $2 WHERE id = $3", value, time.Now().UTC(), id)
+	if err != nil {
+		fmt.Println("An error occured while executing update tracked tx rejections: ", err)
+	}
+	return err
+}
+
+func (s *PostgresStore) SetTrackedTxChild(id int64, childTx []byte, childTxid string, childFee int64) error {
+	_, err := s.db.Exec("UPDATE signed_tx SET child_tx = $1, child_txid = $2, child_fee = $3, updated_at = $4 WHERE id = $5", childTx, childTxid, childFee, time.Now().UTC(), id)
+	if err != nil {
+		fmt.Println("An error occured while executing update tracked tx child: ", err)
+	}
+	return err
+}
+
+func (s *PostgresStore) DeleteTrackedTx(id int64) error {
+	sqlTx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer sqlTx.Rollback()
+
+	_, err = sqlTx.Exec("DELETE FROM tx_state_history WHERE signed_tx_id = $1", id)
+	if err != nil {
+		return err
+	}
+	_, err = sqlTx.Exec("DELETE FROM utxo_leases WHERE signed_tx_id = $1", id)
+	if err != nil {
+		return err
+	}
+	_, err = sqlTx.Exec("DELETE FROM fee_approvals WHERE signed_tx_id = $1", id)
+	if err != nil {
+		return err
+	}
+	_, err = sqlTx.Exec("DELETE FROM fee_spends WHERE signed_tx_id = $1", id)
+	if err != nil {
+		return err
+	}
+	_, err = sqlTx.Exec("UPDATE signed_tx SET replaced_by = NULL WHERE replaced_by = $1", id)
+	if err != nil {
+		return err
+	}
+	_, err = sqlTx.Exec("DELETE FROM signed_tx WHERE id = $1", id)
+	if err != nil {
+		fmt.Println("An error occurred while executing delete signed tx: ", err)
+		return err
+	}
+	return sqlTx.Commit()
+}
+
+func (s *PostgresStore) LeaseUtxos(id int64, outPoints []string) error {
+	now := time.Now().UTC()
+	sqlTx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer sqlTx.Rollback()
+
+	for _, outPoint := range outPoints {
+		var holder int64
+		// a released lease is taken over, an active one keeps its holder
+		err = sqlTx.QueryRow(`INSERT into utxo_leases (outpoint, signed_tx_id, released, created_at) VALUES ($1, $2, false, $3)
+			ON CONFLICT (outpoint) DO UPDATE SET
+				signed_tx_id = CASE WHEN utxo_leases.released THEN excluded.signed_tx_id ELSE utxo_leases.signed_tx_id END,
+				created_at = CASE WHEN utxo_leases.released THEN excluded.created_at ELSE utxo_leases.created_at END,
+				released = false
+			RETURNING signed_tx_id`,
+			outPoint,
+			id,
+			now,
+		).Scan(&holder)
+		if err != nil {
+			fmt.Println("An error occured while executing insert utxo lease: ", err)
+			return err
+		}
+		if holder != id {
+			return fmt.Errorf("utxo %s is leased to tracked tx %d", outPoint, holder)
+		}
+	}
+	return sqlTx.Commit()
+}
+
+func (s *PostgresStore) ReleaseUtxos(outPoints []string) error {
+	return s.execForOutPoints("UPDATE utxo_leases SET released = true WHERE outpoint in ", outPoints)
+}
+
+func (s *PostgresStore) DeleteUtxoLeases(outPoints []string) error {
+	return s.execForOutPoints("DELETE FROM utxo_leases WHERE released AND outpoint in ", outPoints)
+}
+
+func (s *PostgresStore) execForOutPoints(query string, outPoints []string) error {
+	if len(outPoints) == 0 {
+		return nil
+	}
+	placeholders := make([]string, len(outPoints))
+	args := make([]interface{}, len(outPoints))
+	for i, outPoint := range outPoints {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = outPoint
+	}
+	_, err := s.db.Exec(query+"("+strings.Join(placeholders, ", ")+")", args...)
+	if err != nil {
+		fmt.Println("An error occured while executing update utxo leases: ", err)
+	}
+	return err
+}
+
+func (s *PostgresStore) ListUtxoLeases() ([]types.UtxoLease, error) {
+	rows, err := s.db.Query("SELECT outpoint, signed_tx_id, released, created_at FROM utxo_leases ORDER BY created_at, outpoint")
+	if err != nil {
+		fmt.Println("An error occured while query utxo leases: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	leases := []types.UtxoLease{}
+	for rows.Next() {
+		lease := types.UtxoLease{}
+		err := rows.Scan(&lease.OutPoint, &lease.TrackedTxId, &lease.Released, &lease.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		leases = append(leases, lease)
+	}
+	return leases, rows.Err()
+}
+
+const feeApprovalColumns = "id, signed_tx_id, kind, tx, txid, fee, fee_rate, spend, reason, status, created_at, decided_at"
+
+func scanFeeApproval(row interface{ Scan(...interface{}) error }) (types.FeeApproval, error) {
+	approval := types.FeeApproval{}
+	var decidedAt sql.NullTime
+	err := row.Scan(
+		&approval.Id,
+		&approval.TrackedTxId,
+		&approval.Kind,
+		&approval.Tx,
+		&approval.Txid,
+		&approval.Fee,
+		&approval.FeeRate,
+		&approval.Spend,
+		&approval.Reason,
+		&approval.Status,
+		&approval.CreatedAt,
+		&decidedAt,
+	)
+	approval.DecidedAt = decidedAt.Time
+	return approval, err
+}
+
+func (s *PostgresStore) InsertFeeApproval(approval types.FeeApproval) (int64, error) {
+	var id int64
+	err := s.db.QueryRow("INSERT into fee_approvals (signed_tx_id, kind, tx, txid, fee, fee_rate, spend, reason, status, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id",
+		approval.TrackedTxId,
+		approval.Kind,
+		approval.Tx,
+		approval.Txid,
+		approval.Fee,
+		approval.FeeRate,
+		approval.Spend,
+		approval.Reason,
+		types.ApprovalPending,
+		time.Now().UTC(),
+	).Scan(&id)
+	if err != nil {
+		fmt.Println("An error occured while executing insert fee approval: ", err)
+	}
+	return id, err
+}
+
+func (s *PostgresStore) GetFeeApproval(id int64) (*types.FeeApproval, error) {
+	approval, err := scanFeeApproval(s.db.QueryRow("select "+feeApprovalColumns+" from fee_approvals where id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		fmt.Println("An error occured while query fee approval: ", err)
+		return nil, err
+	}
+	return &approval, nil
+}
+
+func (s *PostgresStore) ListFeeApprovals(statuses ...types.ApprovalStatus) ([]types.FeeApproval, error) {
+	query := "select " + feeApprovalColumns + " from fee_approvals"
+	args := make([]interface{}, len(statuses))
+	if len(statuses) > 0 {
+		placeholders := make([]string, len(statuses))
+		for i, status := range statuses {
+			placeholders[i] = fmt.Sprintf("$%d", i+1)
+			args[i] = status
+		}
+		query += " where status in (" + strings.Join(placeholders, ", ") + ")"
+	}
+	rows, err := s.db.Query(query+" order by id", args...)
+	if err != nil {
+		fmt.Println("An error occured while query fee approvals: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	approvals := []types.FeeApproval{}
+	for rows.Next() {
+		approval, err := scanFeeApproval(rows)
+		if err != nil {
+			return nil, err
+		}
+		approvals = append(approvals, approval)
+	}
+	return approvals, rows.Err()
+}
+
+func (s *PostgresStore) UpdateFeeApprovalStatus(id int64, from types.ApprovalStatus, to types.ApprovalStatus) error {
+	result, err := s.db.Exec("UPDATE fee_approvals SET status = $1, decided_at = $2 WHERE id = $3 AND status = $4", to, time.Now().UTC(), id, from)
+	if err != nil {
+		fmt.Println("An error occured while executing update fee approval: ", err)
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("fee approval %d is not %s", id, from)
+	}
+	return nil
+}
+
+func (s *PostgresStore) RecordFeeSpend(id int64, amount int64) error {
+	_, err := s.db.Exec("INSERT into fee_spends (signed_tx_id, amount, created_at) VALUES ($1, $2, $3)", id, amount, time.Now().UTC())
+	if err != nil {
+		fmt.Println("An error occured while executing insert fee spend: ", err)
+	}
+	return err
+}
+
+func (s *PostgresStore) FeeSpentSince(since time.Time) (int64, error) {
+	var spent int64
+	err := s.db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM fee_spends WHERE created_at >= $1", since).Scan(&spent)
+	if err != nil {
+		fmt.Println("An error occured while query fee spends: ", err)
+	}
+	return spent, err
+}
+
+func (s *PostgresStore) InsertSimulatedBroadcast(broadcast types.SimulatedBroadcast) error {
+	_, err := s.db.Exec("INSERT into simulated_broadcasts (txid, tx, package, allowed, reject_reason, vsize, fee, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		broadcast.Txid,
+		broadcast.Tx,
+		broadcast.Package,
+		broadcast.Allowed,
+		broadcast.RejectReason,
+		broadcast.VSize,
+		broadcast.Fee,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		fmt.Println("An error occured while executing insert simulated broadcast: ", err)
+	}
+	return err
+}
+
+func (s *PostgresStore) ListSimulatedBroadcasts() ([]types.SimulatedBroadcast, error) {
+	rows, err := s.db.Query("SELECT id, txid, tx, package, allowed, reject_reason, vsize, fee, created_at FROM simulated_broadcasts ORDER BY id")
+	if err != nil {
+		fmt.Println("An error occured while query simulated broadcasts: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	broadcasts := []types.SimulatedBroadcast{}
+	for rows.Next() {
+		broadcast := types.SimulatedBroadcast{}
+		err := rows.Scan(&broadcast.Id, &broadcast.Txid, &broadcast.Tx, &broadcast.Package, &broadcast.Allowed, &broadcast.RejectReason, &broadcast.VSize, &broadcast.Fee, &broadcast.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		broadcasts = append(broadcasts, broadcast)
+	}
+	return broadcasts, rows.Err()
+}
+
+func insertStateHistory(sqlTx *sql.Tx, id int64, state types.TxState, confirmations int64, at time.Time) error {
+	_, err := sqlTx.Exec("INSERT into tx_state_history (signed_tx_id, state, confirmations, created_at) VALUES ($1, $2, $3, $4)",
+		id,
+		state,
+		confirmations,
+		at,
+	)
+	if err != nil {
+		fmt.Println("An error occured while executing insert tx state history: ", err)
+	}
+	return err
+}
+
+func (s *PostgresStore) QueryTrackedTxByUnlockHeight(unlockHeight int64) ([]types.TrackedTx, error) {
+	return s.queryTrackedTx("select "+trackedTxColumns+" from signed_tx where unlock_height <= $1 and state in ($2, $3) order by id",
+		unlockHeight,
+		types.TxStateSigned,
+		types.TxStateWaitingForHeight,
+	)
+}
+
+func (s *PostgresStore) QueryTrackedTxByState(states ...types.TxState) ([]types.TrackedTx, error) {
+	if len(states) == 0 {
+		return []types.TrackedTx{}, nil
+	}
+	placeholders := make([]string, len(states))
+	args := make([]interface{}, len(states))
+	for i, state := range states {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = state
+	}
+	return s.queryTrackedTx("select "+trackedTxColumns+" from signed_tx where state in ("+strings.Join(placeholders, ", ")+") order by id", args...)
+}
+
+func (s *PostgresStore) ListTrackedTx() ([]types.TrackedTx, error) {
+	return s.queryTrackedTx("select " + trackedTxColumns + " from signed_tx order by id")
+}
+
+func (s *PostgresStore) GetTrackedTxByNyksTxid(reserveId string, roundId string, nyksTxid string) (*types.TrackedTx, error) {
+	return s.getTrackedTx("select "+trackedTxColumns+" from signed_tx where reserve_id = $1 and round_id = $2 and nyks_txid = $3 order by id desc limit 1",
+		reserveId,
+		roundId,
+		nyksTxid,
+	)
+}
+
+func (s *PostgresStore) GetTrackedTx(id int64) (*types.TrackedTx, error) {
+	return s.getTrackedTx("select "+trackedTxColumns+" from signed_tx where id = $1", id)
+}
+
+func (s *PostgresStore) GetTrackedTxByTxid(txid string) (*types.TrackedTx, error) {
+	return s.getTrackedTx("select "+trackedTxColumns+" from signed_tx where txid = $1 order by id desc limit 1", txid)
+}
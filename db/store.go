@@ -0,0 +1,139 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/twilight-project/rbf-node/types"
+)
+
+// ErrAlreadyTracked is returned by InsertReceivedTx when the transaction is
+// already tracked for the reserve and round.
+var ErrAlreadyTracked = errors.New("transaction is already tracked")
+
+// Store persists the transactions tracked by the node. PostgresStore is used
+// by default, BoltStore keeps everything in a single local file.
+type Store interface {
+	// InsertReceivedTx starts tracking a transaction published on nyks in
+	// the received state and returns the id of the new row. It fails with
+	// ErrAlreadyTracked when a row tracks it already.
+	InsertReceivedTx(nyksTx []byte, nyksTxid string, unlockHeight int64, reserveId string, roundId string, txType string) (int64, error)
+	// UpdateTrackedTx stores a new version of the transaction tracked under
+	// id, e.g. once fee inputs have been added or signed.
+	UpdateTrackedTx(id int64, tx []byte, txid string, fee int64) error
+	// TransitionTx moves the tracked transaction to a new state and records
+	// the timestamped transition. Transitions not allowed by CanTransition
+	// are rejected.
+	TransitionTx(id int64, to types.TxState, confirmations int64) error
+	// FailTx moves the transaction to failed for cause. Every other
+	// transition clears the cause.
+	FailTx(id int64, cause types.FailureCause) error
+	// ReplaceTrackedTx marks the tracked transaction as replaced and starts
+	// tracking its replacement, which inherits the reserve, round and nyks
+	// data and counts one more fee bump.
+	ReplaceTrackedTx(id int64, tx []byte, txid string, fee int64) (int64, error)
+	// RevertReplacement undoes ReplaceTrackedTx when the replacement newId
+	// could not be broadcast: its leases go back to id, which returns to
+	// state, and the replacement row is deleted.
+	RevertReplacement(id int64, newId int64, state types.TxState) error
+	// SetTrackedTxBroadcastHeight records the height at which the
+	// transaction was broadcast.
+	SetTrackedTxBroadcastHeight(id int64, height int64) error
+	// SetTrackedTxDeadlineHeight records the height by which the
+	// transaction has to confirm, 0 when it has no deadline of its own.
+	SetTrackedTxDeadlineHeight(id int64, height int64) error
+	// SetTrackedTxChild records the CPFP child broadcast for the transaction,
+	// replacing any previous one.
+	SetTrackedTxChild(id int64, childTx []byte, childTxid string, childFee int64) error
+	// SetTrackedTxRejections records why the transaction was refused
+	// before or at broadcast, nil clears them.
+	SetTrackedTxRejections(id int64, rejections []types.Rejection) error
+	// SetTrackedTxBlock records the block the transaction was mined in, an
+	// empty hash clears it after a reorg.
+	SetTrackedTxBlock(id int64, blockHash string, blockHeight int64) error
+	DeleteTrackedTx(id int64) error
+
+	// LeaseUtxos reserves wallet coins for the tracked transaction. It fails
+	// without leasing any if one is held by another transaction. Leases move
+	// to the replacement of a transaction and are released when it fails,
+	// conflicts or becomes final.
+	LeaseUtxos(id int64, outPoints []string) error
+	// ReleaseUtxos releases the leases on the given coins.
+	ReleaseUtxos(outPoints []string) error
+	// DeleteUtxoLeases forgets released leases once their coins are unlocked.
+	DeleteUtxoLeases(outPoints []string) error
+	ListUtxoLeases() ([]types.UtxoLease, error)
+
+	// InsertFeeApproval queues a fee spending for approval and returns its
+	// id.
+	InsertFeeApproval(approval types.FeeApproval) (int64, error)
+	// GetFeeApproval returns the approval id, or nil if there is none.
+	GetFeeApproval(id int64) (*types.FeeApproval, error)
+	// ListFeeApprovals returns the approvals in the given states, all of them
+	// when none is given, oldest first.
+	ListFeeApprovals(statuses ...types.ApprovalStatus) ([]types.FeeApproval, error)
+	// UpdateFeeApprovalStatus moves the approval from one status to another
+	// and fails if it is not in status from.
+	UpdateFeeApprovalStatus(id int64, from types.ApprovalStatus, to types.ApprovalStatus) error
+	// RecordFeeSpend adds what the wallet paid in fees for the tracked
+	// transaction to the spending ledger.
+	RecordFeeSpend(id int64, amount int64) error
+	// FeeSpentSince sums the ledger from since on.
+	FeeSpentSince(since time.Time) (int64, error)
+
+	// InsertSimulatedBroadcast records a transaction a dry run would have
+	// broadcast.
+	InsertSimulatedBroadcast(broadcast types.SimulatedBroadcast) error
+	// ListSimulatedBroadcasts returns the recorded dry run broadcasts, oldest
+	// first.
+	ListSimulatedBroadcasts() ([]types.SimulatedBroadcast, error)
+
+	// QueryTrackedTxByUnlockHeight returns the transactions that can be
+	// broadcast at the given height.
+	QueryTrackedTxByUnlockHeight(unlockHeight int64) ([]types.TrackedTx, error)
+	QueryTrackedTxByState(states ...types.TxState) ([]types.TrackedTx, error)
+	ListTrackedTx() ([]types.TrackedTx, error)
+	// GetTrackedTxByNyksTxid returns the most recent row tracking the
+	// transaction published on nyks for the given reserve and round, or nil
+	// if there is none.
+	GetTrackedTxByNyksTxid(reserveId string, roundId string, nyksTxid string) (*types.TrackedTx, error)
+	// GetTrackedTx returns the row id, or nil if there is none.
+	GetTrackedTx(id int64) (*types.TrackedTx, error)
+	GetTrackedTxByTxid(txid string) (*types.TrackedTx, error)
+
+	Close() error
+}
+
+// transitions lists the states a tracked transaction may move to from each
+// state. confirmed -> confirmed is allowed so the confirmation count can grow,
+// confirmed -> in_mempool and confirmed -> signed happen when the block it was
+// mined in leaves the best chain.
+var transitions = map[types.TxState][]types.TxState{
+	types.TxStateReceived:         {types.TxStateFunded, types.TxStateConflicted, types.TxStateFailed},
+	types.TxStateFunded:           {types.TxStateSigned, types.TxStateAwaitingApproval, types.TxStateFailed},
+	types.TxStateAwaitingApproval: {types.TxStateSigned, types.TxStateFailed},
+	types.TxStateSigned:           {types.TxStateWaitingForHeight, types.TxStateBroadcast, types.TxStateConflicted, types.TxStateFailed},
+	types.TxStateWaitingForHeight: {types.TxStateBroadcast, types.TxStateConflicted, types.TxStateFailed},
+	types.TxStateBroadcast:        {types.TxStateInMempool, types.TxStateConfirmed, types.TxStateReplaced, types.TxStateConflicted, types.TxStateFailed},
+	types.TxStateInMempool:        {types.TxStateConfirmed, types.TxStateReplaced, types.TxStateConflicted, types.TxStateFailed},
+	types.TxStateConfirmed:        {types.TxStateConfirmed, types.TxStateFinal, types.TxStateInMempool, types.TxStateSigned},
+	types.TxStateReplaced:         {types.TxStateConfirmed},
+	types.TxStateConflicted:       {types.TxStateFailed},
+	types.TxStateFailed:           {types.TxStateReceived},
+	types.TxStateFinal:            {},
+}
+
+// releasesLeases tells whether a transaction moving to state no longer needs
+// the wallet coins leased to it.
+func releasesLeases(state types.TxState) bool {
+	return state == types.TxStateFailed || state == types.TxStateConflicted || state == types.TxStateFinal
+}
+
+func CanTransition(from types.TxState, to types.TxState) bool {
+	for _, state := range transitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/twilight-project/rbf-node/types"
+)
+
+var allStates = []types.TxState{
+	types.TxStateReceived,
+	types.TxStateFunded,
+	types.TxStateAwaitingApproval,
+	types.TxStateSigned,
+	types.TxStateWaitingForHeight,
+	types.TxStateBroadcast,
+	types.TxStateInMempool,
+	types.TxStateConfirmed,
+	types.TxStateReplaced,
+	types.TxStateConflicted,
+	types.TxStateFailed,
+	types.TxStateFinal,
+}
+
+func TestTransitionsCoverEveryState(t *testing.T) {
+	for _, state := range allStates {
+		if _, ok := transitions[state]; !ok {
+			t.Errorf("no transitions listed from %s", state)
+		}
+	}
+	for from, targets := range transitions {
+		for _, to := range targets {
+			if _, ok := transitions[to]; !ok {
+				t.Errorf("%s -> %s leads to an unknown state", from, to)
+			}
+		}
+	}
+}
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from types.TxState
+		to   types.TxState
+		want bool
+	}{
+		{types.TxStateReceived, types.TxStateFunded, true},
+		{types.TxStateReceived, types.TxStateConflicted, true},
+		{types.TxStateReceived, types.TxStateFailed, true},
+		{types.TxStateReceived, types.TxStateBroadcast, false},
+		{types.TxStateFunded, types.TxStateAwaitingApproval, true},
+		{types.TxStateFunded, types.TxStateBroadcast, false},
+		{types.TxStateAwaitingApproval, types.TxStateSigned, true},
+		{types.TxStateAwaitingApproval, types.TxStateReceived, false},
+		{types.TxStateSigned, types.TxStateWaitingForHeight, true},
+		{types.TxStateSigned, types.TxStateConfirmed, false},
+		{types.TxStateBroadcast, types.TxStateReplaced, true},
+		{types.TxStateInMempool, types.TxStateConfirmed, true},
+		{types.TxStateInMempool, types.TxStateSigned, false},
+		{types.TxStateConfirmed, types.TxStateConfirmed, true},
+		{types.TxStateConfirmed, types.TxStateInMempool, true},
+		{types.TxStateConfirmed, types.TxStateSigned, true},
+		{types.TxStateConfirmed, types.TxStateFailed, false},
+		{types.TxStateReplaced, types.TxStateConfirmed, true},
+		{types.TxStateReplaced, types.TxStateBroadcast, false},
+		{types.TxStateConflicted, types.TxStateFailed, true},
+		{types.TxStateConflicted, types.TxStateReceived, false},
+		{types.TxStateFailed, types.TxStateReceived, true},
+		{types.TxStateFailed, types.TxStateSigned, false},
+		{types.TxStateFinal, types.TxStateConfirmed, false},
+		{types.TxStateFinal, types.TxStateFailed, false},
+	}
+	for _, test := range tests {
+		if got := CanTransition(test.from, test.to); got != test.want {
+			t.Errorf("CanTransition(%s, %s) = %v, want %v", test.from, test.to, got, test.want)
+		}
+	}
+}
+
+func TestReleasesLeases(t *testing.T) {
+	for _, state := range allStates {
+		want := state == types.TxStateFailed || state == types.TxStateConflicted || state == types.TxStateFinal
+		if got := releasesLeases(state); got != want {
+			t.Errorf("releasesLeases(%s) = %v, want %v", state, got, want)
+		}
+	}
+}
@@ -2,19 +2,23 @@ package eventhandler
 
 import (
 	"bytes"
-	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
+	"github.com/btcsuite/btcd/wire"
 	"github.com/gorilla/websocket"
 	"github.com/spf13/viper"
+	"github.com/twilight-project/rbf-node/alert"
 	"github.com/twilight-project/rbf-node/db"
+	"github.com/twilight-project/rbf-node/types"
 	"github.com/twilight-project/rbf-node/utils"
 )
 
-func NyksEventListener(event string, functionCall string, dbconn *sql.DB) {
+func NyksEventListener(event string, functionCall string, store db.Store) {
 	headers := make(map[string][]string)
 	headers["Content-Type"] = []string{"application/json"}
 	nyksd_url := fmt.Sprintf("%v", viper.Get("nyksd_socket_url"))
@@ -83,56 +87,241 @@ func NyksEventListener(event string, functionCall string, dbconn *sql.DB) {
 
 		switch functionCall {
 		case "broadcastSweep":
-			go BroadcastSweep(dbconn)
+			go BroadcastSweep(store)
+		case "broadcastRefund":
+			go BroadcastRefund(store)
 		default:
 			log.Println("Unknown function :", functionCall)
 		}
 	}
 }
 
-func BroadcastSweep(dbconn *sql.DB) {
-	fmt.Println("broadcasting sweep transaction")
-	tx, err := utils.GetBroadCastedSweepTx()
+// ingestMu serialises sweep and refund ingestion so that concurrent nyks
+// events can not fee bump and store the same transaction twice.
+var ingestMu sync.Mutex
+
+func BroadcastSweep(store db.Store) {
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+
+	fmt.Println("broadcasting sweep transactions")
+	sweeps, err := utils.GetBroadCastedSweepTxs()
 	if err != nil {
-		fmt.Println("Failed to get broadcasted sweep transaction : ", err)
+		fmt.Println("Failed to get broadcasted sweep transactions : ", err)
 		return
 	}
-	sweepTx, err := utils.CreateTxFromHex(tx.SignedSweepTx)
+	if len(sweeps) == 0 {
+		fmt.Println("No sweep transaction found")
+		return
+	}
+
+	for _, sweep := range sweeps {
+		err := processSignedTx(store, sweep.ReserveId, sweep.RoundId, sweep.SignedSweepTx, types.TxTypeSweep)
+		if err != nil {
+			fmt.Printf("Failed to process sweep for reserve %s round %s : %v\n", sweep.ReserveId, sweep.RoundId, err)
+			notifyIngestFailure(sweep.ReserveId, sweep.RoundId, types.TxTypeSweep, err)
+		}
+	}
+}
+
+func BroadcastRefund(store db.Store) {
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+
+	fmt.Println("broadcasting refund transactions")
+	refunds, err := utils.GetBroadCastedRefundTxs()
 	if err != nil {
-		fmt.Println("Failed to create sweep transaction : ", err)
+		fmt.Println("Failed to get broadcasted refund transactions : ", err)
+		return
+	}
+	if len(refunds) == 0 {
+		fmt.Println("No refund transaction found")
 		return
 	}
 
-	decodedScript := utils.DecodeBtcScript(hex.EncodeToString(sweepTx.TxIn[0].Witness[len(sweepTx.TxIn[0].Witness)-1]))
+	for _, refund := range refunds {
+		err := processSignedTx(store, refund.ReserveId, refund.RoundId, refund.SignedRefundTx, types.TxTypeRefund)
+		if err != nil {
+			fmt.Printf("Failed to process refund for reserve %s round %s : %v\n", refund.ReserveId, refund.RoundId, err)
+			notifyIngestFailure(refund.ReserveId, refund.RoundId, types.TxTypeRefund, err)
+		}
+	}
+}
+
+func notifyIngestFailure(reserveId string, roundId string, txType string, err error) {
+	alert.Notify(alert.Event{
+		Type:      alert.FeeBumpFailed,
+		Severity:  alert.Critical,
+		ReserveId: reserveId,
+		RoundId:   roundId,
+		Reason:    txType,
+		Message:   fmt.Sprintf("failed to add fee inputs to %s transaction : %v", txType, err),
+	})
+}
+
+// processSignedTx fee bumps a transaction pre-signed on nyks and stores it
+// together with the height from which it can be broadcast. Transactions that
+// failed or were interrupted before signing are picked up again, anything
+// further along is skipped.
+func processSignedTx(store db.Store, reserveId string, roundId string, txHex string, txType string) error {
+	signedNyksTx, err := utils.CreateTxFromHex(txHex)
+	if err != nil {
+		return fmt.Errorf("failed to create %s transaction : %v", txType, err)
+	}
+	nyksTxid := signedNyksTx.TxHash().String()
+
+	tracked, err := store.GetTrackedTxByNyksTxid(reserveId, roundId, nyksTxid)
+	if err != nil {
+		return err
+	}
+	if tracked != nil && !reprocessable(*tracked) {
+		return nil
+	}
+
+	if len(signedNyksTx.TxIn) == 0 || len(signedNyksTx.TxIn[0].Witness) == 0 {
+		return fmt.Errorf("%s transaction %s has no witness script", txType, nyksTxid)
+	}
+	decodedScript := utils.DecodeBtcScript(hex.EncodeToString(signedNyksTx.TxIn[0].Witness[len(signedNyksTx.TxIn[0].Witness)-1]))
 	height := utils.GetHeightFromScript(decodedScript)
+	// a sweep has to confirm before the refund branch of the reserve opens,
+	// refunds only have the deadline of the fee bump policy
+	deadline := utils.GetRefundHeightFromScript(decodedScript, signedNyksTx.TxIn[0].PreviousOutPoint)
+	if txType == types.TxTypeRefund {
+		height = deadline
+		if height == 0 {
+			height = int64(signedNyksTx.LockTime)
+		}
+	}
+	if txType == types.TxTypeRefund || deadline <= height {
+		deadline = 0
+	}
 
-	fee, err := utils.GetFeeFromBtcNode(sweepTx)
+	var id int64
+	switch {
+	case tracked == nil:
+		var buf bytes.Buffer
+		err = signedNyksTx.Serialize(&buf)
+		if err != nil {
+			return fmt.Errorf("failed to serialize transaction : %v", err)
+		}
+		id, err = store.InsertReceivedTx(buf.Bytes(), nyksTxid, height, reserveId, roundId, txType)
+		if errors.Is(err, db.ErrAlreadyTracked) {
+			// the same event processed concurrently got there first
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	case tracked.State == types.TxStateFunded:
+		// the node stopped before the fee inputs were signed, start over from
+		// the nyks transaction
+		id = tracked.Id
+		err = store.FailTx(id, types.FailureFunding)
+		if err == nil {
+			err = store.TransitionTx(id, types.TxStateReceived, 0)
+		}
+		if err != nil {
+			return err
+		}
+	case tracked.State == types.TxStateFailed:
+		id = tracked.Id
+		err = store.TransitionTx(id, types.TxStateReceived, 0)
+		if err != nil {
+			return err
+		}
+	default:
+		id = tracked.Id
+	}
+	err = store.SetTrackedTxDeadlineHeight(id, deadline)
 	if err != nil {
-		fmt.Println("Failed to get fee from btc node : ", err)
-		return
+		return err
 	}
 
-	newTx, n, err := utils.AddInputsToCoverFee(sweepTx, "", fee)
+	packageFunding := utils.PackageFunding()
+	if packageFunding && !utils.HasWalletOutput(signedNyksTx) {
+		// a child needs an output of ours to spend and the sweep is signed
+		// without one, pay the fee with inputs so it can be bumped with RBF
+		fmt.Printf("%s transaction has no output paying to the wallet for a child, adding fee inputs instead\n", txType)
+		packageFunding = false
+	}
+	if packageFunding {
+		// keep the transaction as signed on nyks, the broadcaster pays for it
+		// with a child when it is below the mempool minimum
+		fee, err := utils.TxFee(signedNyksTx)
+		if err != nil {
+			failFunding(store, id, err)
+			return fmt.Errorf("failed to get fee of %s transaction : %v", txType, err)
+		}
+		err = storeTrackedTx(store, id, signedNyksTx, fee, types.TxStateFunded)
+		if err != nil {
+			return err
+		}
+		return storeTrackedTx(store, id, signedNyksTx, fee, types.TxStateSigned)
+	}
+
+	newTx, signedTx, fee, err := utils.FundTx(store, id, signedNyksTx, height, deadline)
 	if err != nil {
-		fmt.Println("Failed to add inputs to cover fee : ", err)
-		return
+		failFunding(store, id, err)
+		return fmt.Errorf("failed to add inputs to cover fee : %v", err)
 	}
-	signedTx, err := utils.SignNewFeeInputs(sweepTx, n)
+	err = storeTrackedTx(store, id, newTx, fee, types.TxStateFunded)
 	if err != nil {
-		fmt.Println("Failed to sign new fee inputs : ", err)
-		return
+		return err
+	}
+
+	fmt.Printf("Fee for %s transaction : %d\n", txType, fee)
+	fmt.Printf("%s transaction new inputs : %v\n", txType, newTx)
+	fmt.Printf("%s transaction signed inputs : %v\n", txType, signedTx)
+
+	// over the fee budget the transaction waits for an operator before it
+	// can be broadcast
+	state := types.TxStateSigned
+	err = utils.AuthorizeFunding(store, id, reserveId, roundId, txType, signedNyksTx, signedTx, fee)
+	if errors.Is(err, utils.ErrApprovalRequired) {
+		fmt.Printf("%s transaction waits for approval : %v\n", txType, err)
+		state = types.TxStateAwaitingApproval
+	} else if err != nil {
+		_ = store.FailTx(id, types.FailureFunding)
+		return err
+	}
+	return storeTrackedTx(store, id, signedTx, fee, state)
+}
+
+// reprocessable tells whether a transaction nyks publishes again is funded
+// again: one not funded yet, or one that failed for a cause that may go away.
+func reprocessable(tracked types.TrackedTx) bool {
+	switch tracked.State {
+	case types.TxStateReceived, types.TxStateFunded:
+		return true
+	case types.TxStateFailed:
+		return tracked.Failure.Retryable()
+	default:
+		return false
 	}
+}
 
-	fmt.Println("Fee for sweep transaction : ", fee)
-	fmt.Println("sweep transaction new inputs : ", newTx)
-	fmt.Println("sweep transaction signed inputs : ", signedTx)
+// failFunding moves a transaction that could not be funded to conflicted
+// when an input of the nyks transaction is already spent, nyks keeps
+// publishing past sweeps. Any other failure is retried.
+func failFunding(store db.Store, id int64, err error) {
+	if errors.Is(err, utils.ErrSpentOrUnknown) {
+		_ = store.TransitionTx(id, types.TxStateConflicted, 0)
+		return
+	}
+	_ = store.FailTx(id, types.FailureFunding)
+}
 
+func storeTrackedTx(store db.Store, id int64, tx *wire.MsgTx, fee int64, state types.TxState) error {
 	var buf bytes.Buffer
-	err = signedTx.Serialize(&buf)
+	err := tx.Serialize(&buf)
 	if err != nil {
-		log.Fatalf("Failed to serialize transaction: %v", err)
+		_ = store.FailTx(id, types.FailureFunding)
+		return fmt.Errorf("failed to serialize transaction : %v", err)
 	}
-	byteArray := buf.Bytes()
 
-	db.InsertSignedtx(dbconn, byteArray, height)
+	err = store.UpdateTrackedTx(id, buf.Bytes(), tx.TxHash().String(), fee)
+	if err != nil {
+		return err
+	}
+	return store.TransitionTx(id, state, 0)
 }
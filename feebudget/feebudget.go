@@ -0,0 +1,99 @@
+package feebudget
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Window is the period the daily cap applies to.
+const Window = 24 * time.Hour
+
+// Default limits, overridable from the config. Setting one to 0 disables it.
+const (
+	defaultMaxFee          = 1000000 // sats
+	defaultMaxFeeRate      = 500     // sat/vB
+	defaultMaxValuePercent = 5
+	defaultDailyCap        = 5000000 // sats
+)
+
+// Limits bound what the node pays in fees without an operator approving it.
+type Limits struct {
+	// MaxFee caps the absolute fee of a transaction, or of a transaction and
+	// its CPFP child.
+	MaxFee     int64
+	MaxFeeRate int64 // sat/kvB
+	// MaxValuePercent caps the fee as a percentage of the value swept.
+	MaxValuePercent float64
+	// DailyCap caps what the wallet spends on fees over Window.
+	DailyCap int64
+}
+
+func NewLimits() *Limits {
+	l := &Limits{
+		MaxFee:          defaultMaxFee,
+		MaxFeeRate:      defaultMaxFeeRate * 1000,
+		MaxValuePercent: defaultMaxValuePercent,
+		DailyCap:        defaultDailyCap,
+	}
+	if viper.IsSet("fee_budget.max_fee_sats") {
+		l.MaxFee = viper.GetInt64("fee_budget.max_fee_sats")
+	}
+	if viper.IsSet("fee_budget.max_sat_per_vb") {
+		l.MaxFeeRate = int64(viper.GetFloat64("fee_budget.max_sat_per_vb") * 1000)
+	}
+	if viper.IsSet("fee_budget.max_percent_of_value") {
+		l.MaxValuePercent = viper.GetFloat64("fee_budget.max_percent_of_value")
+	}
+	if viper.IsSet("fee_budget.daily_cap_sats") {
+		l.DailyCap = viper.GetInt64("fee_budget.daily_cap_sats")
+	}
+	return l
+}
+
+// Spend describes a fee about to be paid.
+type Spend struct {
+	// Fee is the total fee of the transaction, CPFP child included, and
+	// VSize the size it pays for.
+	Fee   int64
+	VSize int64
+	// Value is the value of the sweep or refund outputs.
+	Value int64
+	// Added is what the wallet pays on top of what it already paid for the
+	// transaction, counted against the daily cap.
+	Added int64
+	// Spent is what the wallet paid in fees over the last Window.
+	Spent int64
+}
+
+func (s Spend) FeeRate() int64 {
+	if s.VSize <= 0 {
+		return 0
+	}
+	return s.Fee * 1000 / s.VSize
+}
+
+// Check returns the limits the spend exceeds, none when it can go ahead.
+func (l *Limits) Check(s Spend) []string {
+	exceeded := []string{}
+	if l.MaxFee > 0 && s.Fee > l.MaxFee {
+		exceeded = append(exceeded, fmt.Sprintf("fee %d sats above %d sats", s.Fee, l.MaxFee))
+	}
+	if l.MaxFeeRate > 0 && s.FeeRate() > l.MaxFeeRate {
+		exceeded = append(exceeded, fmt.Sprintf("feerate %d sat/kvB above %d sat/kvB", s.FeeRate(), l.MaxFeeRate))
+	}
+	if l.MaxValuePercent > 0 && s.Value > 0 && float64(s.Fee)*100 > float64(s.Value)*l.MaxValuePercent {
+		exceeded = append(exceeded, fmt.Sprintf("fee is %.2f%% of the %d sats swept, above %.2f%%", float64(s.Fee)*100/float64(s.Value), s.Value, l.MaxValuePercent))
+	}
+	if l.DailyCap > 0 && s.Added > 0 && s.Spent+s.Added > l.DailyCap {
+		exceeded = append(exceeded, fmt.Sprintf("%d sats spent in the last %s plus %d sats above the cap of %d sats", s.Spent, Window, s.Added, l.DailyCap))
+	}
+	return exceeded
+}
+
+// Reason joins the limits Check returned.
+func Reason(exceeded []string) string {
+	return strings.Join(exceeded, ", ")
+}
@@ -0,0 +1,338 @@
+package feebump
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/spf13/viper"
+)
+
+type Schedule string
+
+const (
+	// Linear raises the feerate by a fixed step per bump.
+	Linear Schedule = "linear"
+	// Exponential multiplies the feerate by a factor per bump.
+	Exponential Schedule = "exponential"
+	// Deadline spreads what is left of the fee cap over the blocks remaining
+	// until the deadline, paying everything up to the cap once it is missed.
+	Deadline Schedule = "deadline"
+)
+
+// Default policy values, overridable from the config.
+const (
+	defaultIncrementalRelayFee = 1000 // sat/kvB
+	defaultLinearStep          = 2    // sat/vB
+	defaultExponentialFactor   = 1.5
+	defaultDeadlineBlocks      = 6
+	defaultMaxFee              = 200000 // sats
+	defaultMinBlocksBetween    = 1
+	defaultMaxConfTarget       = 6
+	defaultUrgentBlocks        = 2
+)
+
+type Policy struct {
+	Schedule            Schedule
+	IncrementalRelayFee int64 // sat/kvB
+	LinearStep          int64 // sat/vB
+	ExponentialFactor   float64
+	// DeadlineBlocks is the number of blocks after the unlock height within
+	// which the transaction should confirm.
+	DeadlineBlocks int64
+	// MaxFee caps the absolute fee of a sweep or refund across all bumps,
+	// CPFP children included.
+	MaxFee           int64
+	MinBlocksBetween int64
+	Mode             Mode
+	// MaxConfTarget is the confirmation target used while the deadline is
+	// far away, the target shrinks as it gets closer.
+	MaxConfTarget int64
+	// UrgentBlocks is the number of blocks left before the deadline from
+	// which the Deadline schedule is used whatever the configured one.
+	UrgentBlocks int64
+}
+
+func NewPolicy() *Policy {
+	p := &Policy{
+		Schedule:            Exponential,
+		IncrementalRelayFee: defaultIncrementalRelayFee,
+		LinearStep:          defaultLinearStep,
+		ExponentialFactor:   defaultExponentialFactor,
+		DeadlineBlocks:      defaultDeadlineBlocks,
+		MaxFee:              defaultMaxFee,
+		MinBlocksBetween:    defaultMinBlocksBetween,
+		Mode:                Auto,
+		MaxConfTarget:       defaultMaxConfTarget,
+		UrgentBlocks:        defaultUrgentBlocks,
+	}
+	switch schedule := Schedule(viper.GetString("fee_bump_schedule")); schedule {
+	case Linear, Exponential, Deadline:
+		p.Schedule = schedule
+	case "":
+	default:
+		fmt.Printf("unknown fee_bump_schedule %s, using %s\n", schedule, p.Schedule)
+	}
+	switch mode := Mode(viper.GetString("fee_bump_mode")); mode {
+	case Auto, RBF, CPFP:
+		p.Mode = mode
+	case "":
+	default:
+		fmt.Printf("unknown fee_bump_mode %s, using %s\n", mode, p.Mode)
+	}
+	if v := viper.GetInt64("incremental_relay_fee_sat_per_kvb"); v > 0 {
+		p.IncrementalRelayFee = v
+	}
+	if v := viper.GetInt64("fee_bump_linear_step_sat_per_vb"); v > 0 {
+		p.LinearStep = v
+	}
+	if v := viper.GetFloat64("fee_bump_exponential_factor"); v > 1 {
+		p.ExponentialFactor = v
+	}
+	if v := viper.GetInt64("fee_bump_deadline_blocks"); v > 0 {
+		p.DeadlineBlocks = v
+	}
+	if v := viper.GetInt64("fee_bump_max_fee_sats"); v > 0 {
+		p.MaxFee = v
+	}
+	if v := viper.GetInt64("fee_max_conf_target"); v > 0 {
+		p.MaxConfTarget = v
+	}
+	if viper.IsSet("fee_bump_urgent_blocks") {
+		p.UrgentBlocks = viper.GetInt64("fee_bump_urgent_blocks")
+	}
+	if viper.IsSet("fee_bump_min_blocks_between") {
+		p.MinBlocksBetween = viper.GetInt64("fee_bump_min_blocks_between")
+	}
+	return p
+}
+
+type Mode string
+
+const (
+	// Auto picks whichever of RBF and CPFP is allowed and costs less.
+	Auto Mode = "auto"
+	RBF  Mode = "rbf"
+	CPFP Mode = "cpfp"
+)
+
+// State is what the policy needs to know about a broadcast transaction.
+type State struct {
+	Fee   int64 // sats
+	VSize int64
+	// ChildFee and ChildVSize describe the CPFP child already paying for the
+	// transaction, if any.
+	ChildFee   int64
+	ChildVSize int64
+	// ReplacedFees is the fee of the transaction plus all its mempool
+	// descendants, which a replacement has to pay for under BIP125 rule 3.
+	ReplacedFees int64
+	// AncestorFees and AncestorVSize include the transaction itself and its
+	// unconfirmed ancestors, a CPFP child pays for all of them.
+	AncestorFees  int64
+	AncestorVSize int64
+	// EstimatedFeeRate is the current estimate for ConfTarget, in sat/kvB.
+	EstimatedFeeRate int64
+	Height           int64
+	BroadcastHeight  int64
+	UnlockHeight     int64
+	// DeadlineHeight is the deadline of the transaction itself, if it has
+	// one, e.g. the height at which a reserve can be refunded.
+	DeadlineHeight int64
+}
+
+// PackageFeeRate is the feerate of the transaction and its CPFP child in
+// sat/kvB.
+func (s State) PackageFeeRate() int64 {
+	if s.VSize+s.ChildVSize <= 0 {
+		return 0
+	}
+	return (s.Fee + s.ChildFee) * 1000 / (s.VSize + s.ChildVSize)
+}
+
+type Decision struct {
+	Bump bool
+	// FeeRate is the package feerate to aim for in sat/kvB.
+	FeeRate int64
+	Reason  string
+	// AtRisk is set when the fee cap does not cover the estimate for the
+	// confirmation target, so the deadline will likely be missed.
+	AtRisk bool
+}
+
+// MinReplacementFee is the lowest absolute fee BIP125 rules 3, 4 and 6 accept
+// for a replacement of vsize vbytes.
+func (p *Policy) MinReplacementFee(s State, vsize int64) int64 {
+	replaced := s.ReplacedFees
+	if replaced < s.Fee+s.ChildFee {
+		replaced = s.Fee + s.ChildFee
+	}
+	fee := replaced + p.incrementalFee(vsize)
+	if s.VSize > 0 {
+		rule6 := int64(math.Floor(float64(s.Fee)/float64(s.VSize)*float64(vsize))) + 1
+		if rule6 > fee {
+			fee = rule6
+		}
+	}
+	return fee
+}
+
+// Deadline returns the height by which the transaction should be confirmed:
+// its own deadline if it has one, DeadlineBlocks after it could first be
+// broadcast otherwise.
+func (p *Policy) Deadline(s State) int64 {
+	if s.DeadlineHeight > 0 {
+		return s.DeadlineHeight
+	}
+	start := s.UnlockHeight
+	if start == 0 {
+		start = s.BroadcastHeight
+	}
+	return start + p.DeadlineBlocks
+}
+
+// Remaining returns the number of blocks in which the transaction can still
+// be mined before its deadline, counting from the unlock height when it is
+// not reached yet.
+func (p *Policy) Remaining(s State) int64 {
+	from := s.Height
+	if s.UnlockHeight > from {
+		from = s.UnlockHeight
+	}
+	return p.Deadline(s) - from
+}
+
+// ConfTarget returns the confirmation target to estimate fees for. It is half
+// the blocks remaining before the deadline, leaving room for bumps, between 1
+// and MaxConfTarget.
+func (p *Policy) ConfTarget(s State) int64 {
+	target := p.Remaining(s) / 2
+	if target > p.MaxConfTarget {
+		target = p.MaxConfTarget
+	}
+	if target < 1 {
+		target = 1
+	}
+	return target
+}
+
+// Next decides whether the transaction should be bumped and which package
+// feerate the bump should reach.
+func (p *Policy) Next(s State) Decision {
+	if s.VSize <= 0 {
+		return Decision{}
+	}
+	paid := s.Fee + s.ChildFee
+	packageSize := s.VSize + s.ChildVSize
+	atRisk := s.EstimatedFeeRate*packageSize/1000 > p.MaxFee
+	if s.BroadcastHeight > 0 && s.Height-s.BroadcastHeight < p.MinBlocksBetween {
+		return Decision{AtRisk: atRisk}
+	}
+
+	feeRate := s.PackageFeeRate()
+	deadline := p.Deadline(s)
+	remaining := deadline - s.Height
+	behind := s.EstimatedFeeRate > 0 && feeRate < s.EstimatedFeeRate
+	missed := remaining <= 0
+	if !behind && !missed {
+		return Decision{AtRisk: atRisk}
+	}
+
+	reason := fmt.Sprintf("feerate %d sat/kvB below estimate %d sat/kvB", feeRate, s.EstimatedFeeRate)
+	if missed {
+		reason = fmt.Sprintf("not confirmed by deadline height %d", deadline)
+	}
+
+	// escalate along the deadline curve once it is close whatever the
+	// configured schedule
+	schedule := p.Schedule
+	if remaining <= p.UrgentBlocks {
+		schedule = Deadline
+	}
+
+	var target int64
+	switch schedule {
+	case Linear:
+		target = feeRate + p.LinearStep*1000
+	case Exponential:
+		target = int64(float64(feeRate) * p.ExponentialFactor)
+	case Deadline:
+		total := p.MaxFee
+		if remaining > 0 {
+			total = paid + (p.MaxFee-paid)/(remaining+1)
+		}
+		target = total * 1000 / packageSize
+	}
+	if behind && s.EstimatedFeeRate > target {
+		target = s.EstimatedFeeRate
+	}
+	return Decision{Bump: true, FeeRate: target, Reason: reason, AtRisk: atRisk}
+}
+
+// ReplacementFee returns the fee of an RBF replacement of vsize vbytes at
+// feeRate, raised to the BIP125 minimum, and whether the fee cap allows it.
+func (p *Policy) ReplacementFee(s State, vsize int64, feeRate int64) (int64, bool) {
+	fee := feeRate * vsize / 1000
+	minFee := p.MinReplacementFee(s, vsize)
+	if fee < minFee {
+		fee = minFee
+	}
+	if minFee > p.MaxFee {
+		return minFee, false
+	}
+	if fee > p.MaxFee {
+		fee = p.MaxFee
+	}
+	return fee, true
+}
+
+// ChildFee returns the fee a CPFP child of childVSize vbytes has to pay to
+// bring the transaction and its ancestors to feeRate, and whether the fee cap
+// allows it. A child replacing a previous one also has to satisfy BIP125
+// against it.
+func (p *Policy) ChildFee(s State, childVSize int64, feeRate int64) (int64, bool) {
+	ancestorFees := s.AncestorFees
+	ancestorSize := s.AncestorVSize
+	if ancestorSize == 0 {
+		ancestorFees = s.Fee
+		ancestorSize = s.VSize
+	}
+	fee := feeRate*(ancestorSize+childVSize)/1000 - ancestorFees
+	minFee := p.incrementalFee(childVSize)
+	if s.ChildFee > 0 {
+		minFee += s.ChildFee
+	}
+	if fee < minFee {
+		fee = minFee
+	}
+	return fee, s.Fee+fee <= p.MaxFee
+}
+
+func (p *Policy) incrementalFee(vsize int64) int64 {
+	return (vsize*p.IncrementalRelayFee + 999) / 1000
+}
+
+// Option is one way of bumping a transaction. Total is what the transaction,
+// its replacement or child included, ends up paying.
+type Option struct {
+	Mode    Mode
+	Fee     int64
+	Total   int64
+	Blocked string
+}
+
+// Choose returns the cheapest option that is not blocked and allowed by mode.
+// ok is false when there is none, the options then explain why.
+func Choose(mode Mode, options ...Option) (Option, bool) {
+	var best Option
+	found := false
+	for _, option := range options {
+		if option.Blocked != "" || (mode != Auto && mode != option.Mode) {
+			continue
+		}
+		if !found || option.Total < best.Total {
+			best = option
+			found = true
+		}
+	}
+	return best, found
+}
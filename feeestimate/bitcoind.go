@@ -0,0 +1,117 @@
+package feeestimate
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/rpcclient"
+)
+
+// blockVSize is the vsize of a full block.
+const blockVSize = 1000000
+
+func btcToSats(btc float64) int64 {
+	return int64(math.Round(btc * 1e8))
+}
+
+// Bitcoind asks estimatesmartfee in conservative mode.
+type Bitcoind struct {
+	Client *rpcclient.Client
+}
+
+func (b *Bitcoind) Name() string {
+	return "bitcoind"
+}
+
+func (b *Bitcoind) EstimateFeeRate(target int64) (int64, error) {
+	result, err := b.Client.EstimateSmartFee(target, &btcjson.EstimateModeConservative)
+	if err != nil {
+		return 0, err
+	}
+	if result.FeeRate == nil {
+		return 0, fmt.Errorf("no fee estimate available : %v", result.Errors)
+	}
+	return btcToSats(*result.FeeRate), nil
+}
+
+// MempoolHistogram estimates from the node's mempool the feerate needed to
+// be among the transactions filling the next target blocks, ranking each
+// transaction by the feerate of its ancestor package as miners do.
+type MempoolHistogram struct {
+	Client *rpcclient.Client
+}
+
+type mempoolEntry struct {
+	VSize        int64 `json:"vsize"`
+	AncestorSize int64 `json:"ancestorsize"`
+	Fees         struct {
+		Base     float64 `json:"base"`
+		Ancestor float64 `json:"ancestor"`
+	} `json:"fees"`
+}
+
+func (m *MempoolHistogram) Name() string {
+	return "mempool"
+}
+
+func (m *MempoolHistogram) EstimateFeeRate(target int64) (int64, error) {
+	raw, err := m.Client.RawRequest("getrawmempool", []json.RawMessage{json.RawMessage("true")})
+	if err != nil {
+		return 0, err
+	}
+	entries := map[string]mempoolEntry{}
+	err = json.Unmarshal(raw, &entries)
+	if err != nil {
+		return 0, err
+	}
+
+	type bucket struct {
+		feeRate int64
+		vsize   int64
+	}
+	buckets := make([]bucket, 0, len(entries))
+	for _, entry := range entries {
+		if entry.VSize <= 0 {
+			continue
+		}
+		fee, vsize := entry.Fees.Base, entry.VSize
+		if entry.AncestorSize > 0 && entry.Fees.Ancestor*float64(vsize) < fee*float64(entry.AncestorSize) {
+			fee, vsize = entry.Fees.Ancestor, entry.AncestorSize
+		}
+		buckets = append(buckets, bucket{feeRate: btcToSats(fee) * 1000 / vsize, vsize: entry.VSize})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].feeRate > buckets[j].feeRate })
+
+	// the transaction has to fit in the blocks before the target one
+	space := target * blockVSize
+	filled := int64(0)
+	for _, b := range buckets {
+		filled += b.vsize
+		if filled >= space {
+			// pay a bit more than the transaction at the edge
+			return b.feeRate + 1, nil
+		}
+	}
+	return minRelayFeeRate(m.Client)
+}
+
+// minRelayFeeRate returns the lowest feerate the node accepts when the
+// mempool does not even fill the target blocks.
+func minRelayFeeRate(client *rpcclient.Client) (int64, error) {
+	raw, err := client.RawRequest("getmempoolinfo", nil)
+	if err != nil {
+		return 0, err
+	}
+	info := struct {
+		MempoolMinFee float64 `json:"mempoolminfee"`
+		MinRelayTxFee float64 `json:"minrelaytxfee"`
+	}{}
+	err = json.Unmarshal(raw, &info)
+	if err != nil {
+		return 0, err
+	}
+	return btcToSats(math.Max(info.MempoolMinFee, info.MinRelayTxFee)), nil
+}
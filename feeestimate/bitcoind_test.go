@@ -0,0 +1,104 @@
+package feeestimate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/rpcclient"
+)
+
+// rpcServer answers the JSON-RPC methods in results, by method name, and
+// fails any other method.
+func rpcServer(t *testing.T, results map[string]string) *rpcclient.Client {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := struct {
+			Method string          `json:"method"`
+			ID     json.RawMessage `json:"id"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, ok := results[request.Method]
+		if !ok {
+			w.Write([]byte(`{"result":null,"error":{"code":-32601,"message":"Method not found"},"id":` + string(request.ID) + `}`))
+			return
+		}
+		w.Write([]byte(`{"result":` + result + `,"error":null,"id":` + string(request.ID) + `}`))
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := rpcclient.New(&rpcclient.ConnConfig{
+		Host:         strings.TrimPrefix(server.URL, "http://"),
+		User:         "user",
+		Pass:         "pass",
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Shutdown)
+	return client
+}
+
+func TestBitcoind(t *testing.T) {
+	client := rpcServer(t, map[string]string{
+		"estimatesmartfee": `{"feerate": 0.00012345, "blocks": 2}`,
+	})
+	got, err := (&Bitcoind{Client: client}).EstimateFeeRate(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 12345 {
+		t.Fatalf("EstimateFeeRate = %d, want 12345", got)
+	}
+
+	client = rpcServer(t, map[string]string{
+		"estimatesmartfee": `{"errors": ["Insufficient data or no feerate found"], "blocks": 0}`,
+	})
+	_, err = (&Bitcoind{Client: client}).EstimateFeeRate(2)
+	if err == nil {
+		t.Fatal("expected an error without a feerate")
+	}
+}
+
+func TestMempoolHistogram(t *testing.T) {
+	// b pays 20 sat/vB. c pays 50 sat/vB itself but spends a, which pays 4,
+	// so miners take the package at 13.2 sat/vB.
+	const mempool = `{
+		"b": {"vsize": 950000, "ancestorsize": 950000, "fees": {"base": 0.19, "ancestor": 0.19}},
+		"c": {"vsize": 100000, "ancestorsize": 500000, "fees": {"base": 0.05, "ancestor": 0.066}},
+		"a": {"vsize": 400000, "ancestorsize": 400000, "fees": {"base": 0.016, "ancestor": 0.016}}
+	}`
+	client := rpcServer(t, map[string]string{
+		"getrawmempool":  mempool,
+		"getmempoolinfo": `{"mempoolminfee": 0.00002, "minrelaytxfee": 0.00001}`,
+	})
+	m := &MempoolHistogram{Client: client}
+
+	tests := []struct {
+		name   string
+		target int64
+		want   int64
+	}{
+		{"the next block is filled by the package of c", 1, 13201},
+		{"the mempool does not fill two blocks", 2, 2000},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := m.EstimateFeeRate(test.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Fatalf("EstimateFeeRate(%d) = %d, want %d", test.target, got, test.want)
+			}
+		})
+	}
+}
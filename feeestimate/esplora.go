@@ -0,0 +1,74 @@
+package feeestimate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Esplora reads the /fee-estimates endpoint of an esplora or mempool.space
+// compatible API, e.g. https://mempool.space/api or https://blockstream.info/api.
+type Esplora struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewEsplora(url string, timeout time.Duration) *Esplora {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &Esplora{URL: strings.TrimRight(url, "/"), Client: &http.Client{Timeout: timeout}}
+}
+
+func (e *Esplora) Name() string {
+	return "esplora"
+}
+
+// EstimateFeeRate uses the estimate for the largest confirmation target not
+// above target, or the smallest one available.
+func (e *Esplora) EstimateFeeRate(target int64) (int64, error) {
+	resp, err := e.Client.Get(e.URL + "/fee-estimates")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("fee-estimates returned %s : %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	// confirmation target in blocks to feerate in sat/vB
+	estimates := map[string]float64{}
+	err = json.Unmarshal(body, &estimates)
+	if err != nil {
+		return 0, err
+	}
+	best, smallest := int64(0), int64(0)
+	var bestRate, smallestRate float64
+	for key, rate := range estimates {
+		blocks, err := strconv.ParseInt(key, 10, 64)
+		if err != nil || blocks <= 0 {
+			continue
+		}
+		if blocks <= target && blocks > best {
+			best, bestRate = blocks, rate
+		}
+		if smallest == 0 || blocks < smallest {
+			smallest, smallestRate = blocks, rate
+		}
+	}
+	if best == 0 {
+		if smallest == 0 {
+			return 0, fmt.Errorf("no fee estimates returned")
+		}
+		bestRate = smallestRate
+	}
+	return int64(bestRate*1000 + 0.5), nil
+}
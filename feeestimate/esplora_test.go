@@ -0,0 +1,62 @@
+package feeestimate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func esploraServer(t *testing.T, status int, body string) *Esplora {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/fee-estimates" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return NewEsplora(server.URL+"/api/", time.Second)
+}
+
+func TestEsplora(t *testing.T) {
+	const estimates = `{"1": 25.5, "2": 20.1, "3": 18.0, "6": 12.3456, "144": 1.004}`
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		target  int64
+		want    int64
+		wantErr bool
+	}{
+		{"exact target", http.StatusOK, estimates, 2, 20100, false},
+		{"largest target below", http.StatusOK, estimates, 5, 18000, false},
+		{"rounded to sat/kvB", http.StatusOK, estimates, 6, 12346, false},
+		{"beyond the last target", http.StatusOK, estimates, 1008, 1004, false},
+		{"below the first target", http.StatusOK, `{"3": 18.0, "6": 12.0}`, 1, 18000, false},
+		{"keys that are not targets are skipped", http.StatusOK, `{"x": 99, "0": 99, "2": 7.5}`, 2, 7500, false},
+		{"no estimates", http.StatusOK, `{}`, 2, 0, true},
+		{"invalid json", http.StatusOK, `not json`, 2, 0, true},
+		{"server error", http.StatusInternalServerError, `overloaded`, 2, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := esploraServer(t, test.status, test.body)
+			got, err := e.EstimateFeeRate(test.target)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %d, expected an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Fatalf("EstimateFeeRate(%d) = %d, want %d", test.target, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package feeestimate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/spf13/viper"
+)
+
+// Estimator returns the feerate in sat/kvB a transaction needs to confirm
+// within target blocks.
+type Estimator interface {
+	Name() string
+	EstimateFeeRate(target int64) (int64, error)
+}
+
+type Strategy string
+
+const (
+	// Median takes the median of the sources that answered, the lower one
+	// of the two middle values for an even count.
+	Median Strategy = "median"
+	// Max takes the highest estimate.
+	Max Strategy = "max"
+)
+
+// Default bounds in sat/vB, overridable from the config.
+const (
+	defaultMinFeeRate = 1
+	defaultMaxFeeRate = 500
+)
+
+// Combined asks every source and combines their answers with Strategy,
+// clamped to [MinFeeRate, MaxFeeRate]. Fallback is only used when no source
+// answers.
+type Combined struct {
+	Sources    []Estimator
+	Fallback   Estimator
+	Strategy   Strategy
+	MinFeeRate int64 // sat/kvB
+	MaxFeeRate int64 // sat/kvB
+}
+
+// New builds the estimator configured under fee_estimation. client is used by
+// the bitcoind and mempool sources.
+func New(client *rpcclient.Client) *Combined {
+	c := &Combined{
+		Strategy:   Median,
+		MinFeeRate: defaultMinFeeRate * 1000,
+		MaxFeeRate: defaultMaxFeeRate * 1000,
+	}
+
+	sources := viper.GetStringSlice("fee_estimation.sources")
+	if len(sources) == 0 {
+		sources = []string{"bitcoind"}
+	}
+	for _, source := range sources {
+		switch source {
+		case "bitcoind":
+			c.Sources = append(c.Sources, &Bitcoind{Client: client})
+		case "mempool":
+			c.Sources = append(c.Sources, &MempoolHistogram{Client: client})
+		case "esplora":
+			url := viper.GetString("fee_estimation.esplora_url")
+			if url == "" {
+				fmt.Println("fee_estimation.esplora_url is not set, esplora fee source disabled")
+				continue
+			}
+			timeout := time.Duration(viper.GetInt64("fee_estimation.esplora_timeout_seconds")) * time.Second
+			c.Sources = append(c.Sources, NewEsplora(url, timeout))
+		default:
+			fmt.Printf("unknown fee source %s, ignored\n", source)
+		}
+	}
+	if v := viper.GetFloat64("fee_estimation.static_sat_per_vb"); v > 0 {
+		c.Fallback = Static{FeeRate: int64(v * 1000)}
+	}
+
+	switch strategy := Strategy(viper.GetString("fee_estimation.strategy")); strategy {
+	case Median, Max:
+		c.Strategy = strategy
+	case "":
+	default:
+		fmt.Printf("unknown fee_estimation.strategy %s, using %s\n", strategy, c.Strategy)
+	}
+	if v := viper.GetFloat64("fee_estimation.min_sat_per_vb"); v > 0 {
+		c.MinFeeRate = int64(v * 1000)
+	}
+	if v := viper.GetFloat64("fee_estimation.max_sat_per_vb"); v > 0 {
+		c.MaxFeeRate = int64(v * 1000)
+	}
+	return c
+}
+
+func (c *Combined) Name() string {
+	return "combined"
+}
+
+func (c *Combined) EstimateFeeRate(target int64) (int64, error) {
+	estimates := []int64{}
+	failures := []string{}
+	for _, source := range c.Sources {
+		feeRate, err := source.EstimateFeeRate(target)
+		if err != nil {
+			failures = append(failures, source.Name()+" : "+err.Error())
+			continue
+		}
+		estimates = append(estimates, feeRate)
+	}
+	if len(failures) > 0 {
+		fmt.Println("Fee sources failed : ", strings.Join(failures, ", "))
+	}
+
+	if len(estimates) == 0 {
+		if c.Fallback == nil {
+			return 0, fmt.Errorf("no fee estimate available : %s", strings.Join(failures, ", "))
+		}
+		feeRate, err := c.Fallback.EstimateFeeRate(target)
+		if err != nil {
+			return 0, err
+		}
+		estimates = append(estimates, feeRate)
+	}
+
+	sort.Slice(estimates, func(i, j int) bool { return estimates[i] < estimates[j] })
+	feeRate := estimates[len(estimates)-1]
+	if c.Strategy == Median {
+		feeRate = estimates[(len(estimates)-1)/2]
+	}
+	return c.clamp(feeRate), nil
+}
+
+func (c *Combined) clamp(feeRate int64) int64 {
+	if c.MinFeeRate > 0 && feeRate < c.MinFeeRate {
+		return c.MinFeeRate
+	}
+	if c.MaxFeeRate > 0 && feeRate > c.MaxFeeRate {
+		return c.MaxFeeRate
+	}
+	return feeRate
+}
+
+// Static always returns the same feerate.
+type Static struct {
+	FeeRate int64 // sat/kvB
+}
+
+func (s Static) Name() string {
+	return "static"
+}
+
+func (s Static) EstimateFeeRate(target int64) (int64, error) {
+	return s.FeeRate, nil
+}
@@ -0,0 +1,100 @@
+package feeestimate
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+type stubEstimator struct {
+	feeRate int64
+	err     error
+}
+
+func (s stubEstimator) Name() string {
+	return "stub"
+}
+
+func (s stubEstimator) EstimateFeeRate(target int64) (int64, error) {
+	return s.feeRate, s.err
+}
+
+func TestCombined(t *testing.T) {
+	failing := stubEstimator{err: errors.New("unreachable")}
+	rate := func(feeRate int64) Estimator { return stubEstimator{feeRate: feeRate} }
+
+	tests := []struct {
+		name     string
+		sources  []Estimator
+		fallback Estimator
+		strategy Strategy
+		want     int64
+		wantErr  bool
+	}{
+		{"median of three", []Estimator{rate(9000), rate(3000), rate(5000)}, nil, Median, 5000, false},
+		{"median of two takes the lower", []Estimator{rate(9000), rate(3000)}, nil, Median, 3000, false},
+		{"max", []Estimator{rate(3000), rate(9000), rate(5000)}, nil, Max, 9000, false},
+		{"failed sources are left out", []Estimator{failing, rate(3000), failing, rate(9000), rate(5000)}, nil, Median, 5000, false},
+		{"fallback unused when a source answers", []Estimator{failing, rate(3000)}, Static{FeeRate: 7000}, Median, 3000, false},
+		{"fallback when no source answers", []Estimator{failing, failing}, Static{FeeRate: 7000}, Median, 7000, false},
+		{"no source and no fallback", []Estimator{failing}, nil, Median, 0, true},
+		{"failing fallback", []Estimator{failing}, failing, Median, 0, true},
+		{"clamped to the minimum", []Estimator{rate(200)}, nil, Median, 1000, false},
+		{"clamped to the maximum", []Estimator{rate(900000), rate(800000)}, nil, Max, 500000, false},
+		{"fallback is clamped too", nil, Static{FeeRate: 600000}, Median, 500000, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Combined{
+				Sources:    test.sources,
+				Fallback:   test.fallback,
+				Strategy:   test.strategy,
+				MinFeeRate: 1000,
+				MaxFeeRate: 500000,
+			}
+			got, err := c.EstimateFeeRate(2)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %d, expected an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Fatalf("EstimateFeeRate = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewDefaults(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	c := New(nil)
+	if c.Strategy != Median {
+		t.Fatalf("strategy %s, want %s", c.Strategy, Median)
+	}
+	if c.MinFeeRate != 1000 || c.MaxFeeRate != 500000 {
+		t.Fatalf("bounds [%d, %d], want [1000, 500000]", c.MinFeeRate, c.MaxFeeRate)
+	}
+	if len(c.Sources) != 1 || c.Sources[0].Name() != "bitcoind" || c.Fallback != nil {
+		t.Fatalf("sources %v, fallback %v", c.Sources, c.Fallback)
+	}
+
+	viper.Set("fee_estimation.sources", []string{"bitcoind", "mempool", "esplora"})
+	viper.Set("fee_estimation.esplora_url", "http://localhost/api")
+	viper.Set("fee_estimation.strategy", "max")
+	viper.Set("fee_estimation.static_sat_per_vb", 2.5)
+	viper.Set("fee_estimation.max_sat_per_vb", 100)
+	c = New(nil)
+	if len(c.Sources) != 3 || c.Strategy != Max || c.MaxFeeRate != 100000 {
+		t.Fatalf("sources %d, strategy %s, max %d", len(c.Sources), c.Strategy, c.MaxFeeRate)
+	}
+	if fallback, ok := c.Fallback.(Static); !ok || fallback.FeeRate != 2500 {
+		t.Fatalf("fallback %v, want 2500 sat/kvB", c.Fallback)
+	}
+}
@@ -0,0 +1,134 @@
+package feemath
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/twilight-project/rbf-node/coinselect"
+)
+
+// bareInputWeight is an input without script sig or witness: outpoint,
+// sequence and the empty script sig length.
+const bareInputWeight = (32 + 4 + 4 + 1) * 4
+
+// Weight is the weight of tx as it is serialized.
+func Weight(tx *wire.MsgTx) int64 {
+	return int64(tx.SerializeSizeStripped()*3 + tx.SerializeSize())
+}
+
+// VSize converts weight to virtual bytes, rounded up.
+func VSize(weight int64) int64 {
+	return (weight + 3) / 4
+}
+
+// FeeRate returns the feerate in sat/kvB fee pays for weight.
+func FeeRate(fee int64, weight int64) int64 {
+	return fee * 1000 / VSize(weight)
+}
+
+// PrevOut is the output an input spends. WitnessScript is the script behind
+// a P2WSH output, when known.
+type PrevOut struct {
+	PkScript      []byte
+	WitnessScript []byte
+}
+
+// MultisigInputWeight is the weight of an input spending an m-of-n P2WSH
+// multisig: the empty dummy element, m signatures and the witness script.
+func MultisigInputWeight(m int, n int) int64 {
+	// OP_m, n compressed keys, OP_n, OP_CHECKMULTISIG
+	script := 1 + n*34 + 1 + 1
+	witness := wire.VarIntSerializeSize(uint64(m+2)) + 1 + m*(1+72) + wire.VarIntSerializeSize(uint64(script)) + script
+	return bareInputWeight + int64(witness)
+}
+
+// InputWeight is the weight of a signed input spending prevOut.
+func InputWeight(prevOut PrevOut) int64 {
+	if len(prevOut.WitnessScript) > 0 && coinselect.ScriptTypeOf(prevOut.PkScript) == coinselect.P2WSH {
+		n, m, err := txscript.CalcMultiSigStats(prevOut.WitnessScript)
+		if err == nil {
+			return MultisigInputWeight(m, n)
+		}
+	}
+	return coinselect.InputWeight(coinselect.ScriptTypeOf(prevOut.PkScript))
+}
+
+func isWitness(t coinselect.ScriptType) bool {
+	switch t {
+	case coinselect.P2SHP2WPKH, coinselect.P2WPKH, coinselect.P2WSH, coinselect.P2TR:
+		return true
+	}
+	return false
+}
+
+func signed(txIn *wire.TxIn) bool {
+	return len(txIn.SignatureScript) > 0 || len(txIn.Witness) > 0
+}
+
+// EstimateWeight returns the weight tx will have once every input is signed.
+// Signed inputs count as they are, an unsigned input i is sized from
+// prevOuts[i], the output it spends.
+func EstimateWeight(tx *wire.MsgTx, prevOuts []PrevOut) int64 {
+	prevOut := func(i int) PrevOut {
+		if i < len(prevOuts) {
+			return prevOuts[i]
+		}
+		return PrevOut{}
+	}
+
+	segwit := false
+	for i, txIn := range tx.TxIn {
+		if signed(txIn) {
+			segwit = segwit || len(txIn.Witness) > 0
+		} else {
+			segwit = segwit || isWitness(coinselect.ScriptTypeOf(prevOut(i).PkScript))
+		}
+	}
+
+	weight := int64(4+4+wire.VarIntSerializeSize(uint64(len(tx.TxIn)))+wire.VarIntSerializeSize(uint64(len(tx.TxOut)))) * 4
+	for _, txOut := range tx.TxOut {
+		weight += int64(txOut.SerializeSize()) * 4
+	}
+	if segwit {
+		// marker and flag
+		weight += 2
+	}
+	for i, txIn := range tx.TxIn {
+		if !signed(txIn) {
+			weight += InputWeight(prevOut(i))
+			if segwit && !isWitness(coinselect.ScriptTypeOf(prevOut(i).PkScript)) {
+				// empty witness
+				weight++
+			}
+			continue
+		}
+		scriptSig := wire.VarIntSerializeSize(uint64(len(txIn.SignatureScript))) + len(txIn.SignatureScript)
+		weight += int64(32+4+4+scriptSig) * 4
+		if segwit {
+			weight += int64(txIn.Witness.SerializeSize())
+		}
+	}
+	return weight
+}
+
+// Converge builds a transaction paying fee and, while the signed result pays
+// less than feeRate for its measured weight, builds it again paying the
+// difference, at most attempts times. build returns the signed transaction
+// and the fee it pays, which may be more than asked for. discard is called
+// with every transaction not kept.
+func Converge(fee int64, feeRate int64, attempts int, build func(fee int64) (*wire.MsgTx, int64, error), discard func(tx *wire.MsgTx)) (*wire.MsgTx, int64, error) {
+	for attempt := 0; attempt < attempts; attempt++ {
+		tx, paid, err := build(fee)
+		if err != nil {
+			return nil, 0, err
+		}
+		required := coinselect.Fee(Weight(tx), feeRate)
+		if paid >= required {
+			return tx, paid, nil
+		}
+		discard(tx)
+		fee += required - paid
+	}
+	return nil, 0, fmt.Errorf("transaction does not reach %d sat/kvB after %d attempts", feeRate, attempts)
+}
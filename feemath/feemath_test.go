@@ -0,0 +1,282 @@
+package feemath
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func testKey(t *testing.T, seed byte) *btcec.PrivateKey {
+	t.Helper()
+	key, _ := btcec.PrivKeyFromBytes(bytes.Repeat([]byte{seed}, 32))
+	return key
+}
+
+func p2wpkhScript(t *testing.T, key *btcec.PrivateKey) []byte {
+	t.Helper()
+	addr, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(key.PubKey().SerializeCompressed()), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+func p2trScript(t *testing.T, key *btcec.PrivateKey) []byte {
+	t.Helper()
+	outputKey := txscript.ComputeTaprootKeyNoScript(key.PubKey())
+	script, err := txscript.PayToTaprootScript(outputKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+func multisigScripts(t *testing.T, m int, n int) ([]byte, []byte) {
+	t.Helper()
+	keys := make([]*btcutil.AddressPubKey, n)
+	for i := range keys {
+		pubKey, err := btcutil.NewAddressPubKey(testKey(t, byte(10+i)).PubKey().SerializeCompressed(), &chaincfg.RegressionNetParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = pubKey
+	}
+	witnessScript, err := txscript.MultiSigScript(keys, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scriptHash := chainhash.HashB(witnessScript)
+	addr, err := btcutil.NewAddressWitnessScriptHash(scriptHash, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkScript, witnessScript
+}
+
+func unsignedTx(inputs int, outputs ...[]byte) *wire.MsgTx {
+	tx := wire.NewMsgTx(2)
+	for i := 0; i < inputs; i++ {
+		tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: chainhash.Hash{byte(i + 1)}}, nil, nil))
+	}
+	for _, pkScript := range outputs {
+		tx.AddTxOut(wire.NewTxOut(50000, pkScript))
+	}
+	return tx
+}
+
+func TestMultisigInputWeight(t *testing.T) {
+	tests := []struct {
+		m, n int
+		want int64
+	}{
+		// 164 bare input, witness count, dummy, m signatures, script
+		{1, 1, 164 + 1 + 1 + 73 + 1 + 37},
+		{2, 3, 164 + 1 + 1 + 2*73 + 1 + 105},
+		{3, 5, 164 + 1 + 1 + 3*73 + 1 + 173},
+		// the script no longer fits a one byte length
+		{11, 15, 164 + 1 + 1 + 11*73 + 3 + 513},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d-of-%d", test.m, test.n), func(t *testing.T) {
+			got := MultisigInputWeight(test.m, test.n)
+			if got != test.want {
+				t.Fatalf("MultisigInputWeight(%d, %d) = %d, want %d", test.m, test.n, got, test.want)
+			}
+		})
+	}
+}
+
+func TestInputWeight(t *testing.T) {
+	pkScript, witnessScript := multisigScripts(t, 2, 3)
+	tests := []struct {
+		name    string
+		prevOut PrevOut
+		want    int64
+	}{
+		{"p2wpkh", PrevOut{PkScript: p2wpkhScript(t, testKey(t, 1))}, 272},
+		{"p2tr", PrevOut{PkScript: p2trScript(t, testKey(t, 1))}, 231},
+		{"p2wsh 2-of-3", PrevOut{PkScript: pkScript, WitnessScript: witnessScript}, 418},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := InputWeight(test.prevOut)
+			if got != test.want {
+				t.Fatalf("InputWeight = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEstimateWeight(t *testing.T) {
+	key := testKey(t, 1)
+	wpkh := p2wpkhScript(t, key)
+	tr := p2trScript(t, key)
+	msPkScript, msWitnessScript := multisigScripts(t, 2, 3)
+	multisig := PrevOut{PkScript: msPkScript, WitnessScript: msWitnessScript}
+
+	// overhead of 10 bytes and the segwit marker, 124 per p2wpkh output and
+	// 172 per p2tr output
+	tests := []struct {
+		name     string
+		tx       *wire.MsgTx
+		prevOuts []PrevOut
+		want     int64
+	}{
+		{"p2wpkh no change", unsignedTx(1, wpkh), []PrevOut{{PkScript: wpkh}}, 42 + 124 + 272},
+		{"p2wpkh with change", unsignedTx(1, wpkh, wpkh), []PrevOut{{PkScript: wpkh}}, 42 + 2*124 + 272},
+		{"p2tr no change", unsignedTx(1, tr), []PrevOut{{PkScript: tr}}, 42 + 172 + 231},
+		{"p2tr with change", unsignedTx(1, tr, tr), []PrevOut{{PkScript: tr}}, 42 + 2*172 + 231},
+		{"p2wsh 2-of-3 and p2wpkh fee input with change", unsignedTx(2, wpkh, wpkh), []PrevOut{multisig, {PkScript: wpkh}}, 42 + 2*124 + 418 + 272},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := EstimateWeight(test.tx, test.prevOuts)
+			if got != test.want {
+				t.Fatalf("EstimateWeight = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+// TestEstimateWeightSigned checks the estimate against the weight of the
+// transaction once signed. ECDSA signatures are 71 or 72 bytes with their
+// sighash, the estimate assumes 72.
+func TestEstimateWeightSigned(t *testing.T) {
+	key := testKey(t, 1)
+	wpkh := p2wpkhScript(t, key)
+	tr := p2trScript(t, key)
+
+	tests := []struct {
+		name     string
+		pkScript []byte
+		outputs  [][]byte
+		slack    int64
+	}{
+		{"p2wpkh no change", wpkh, [][]byte{wpkh}, 1},
+		{"p2wpkh with change", wpkh, [][]byte{wpkh, wpkh}, 1},
+		{"p2tr no change", tr, [][]byte{tr}, 0},
+		{"p2tr with change", tr, [][]byte{tr, tr}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tx := unsignedTx(1, test.outputs...)
+			estimate := EstimateWeight(tx, []PrevOut{{PkScript: test.pkScript}})
+
+			const value = 100000
+			fetcher := txscript.NewCannedPrevOutputFetcher(test.pkScript, value)
+			sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+			hashType := txscript.SigHashAll | txscript.SigHashAnyOneCanPay
+			if txscript.IsPayToTaproot(test.pkScript) {
+				sig, err := txscript.RawTxInTaprootSignature(tx, sigHashes, 0, value, test.pkScript, nil, hashType, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(sig) != schnorr.SignatureSize+1 {
+					t.Fatalf("signature of %d bytes", len(sig))
+				}
+				tx.TxIn[0].Witness = wire.TxWitness{sig}
+			} else {
+				witness, err := txscript.WitnessSignature(tx, sigHashes, 0, value, test.pkScript, hashType, key, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tx.TxIn[0].Witness = witness
+			}
+
+			actual := Weight(tx)
+			if estimate < actual || estimate > actual+test.slack {
+				t.Fatalf("estimate %d for signed weight %d", estimate, actual)
+			}
+			// a signed input counts as it is
+			if got := EstimateWeight(tx, nil); got != actual {
+				t.Fatalf("EstimateWeight of the signed tx = %d, want %d", got, actual)
+			}
+		})
+	}
+}
+
+func TestConverge(t *testing.T) {
+	wpkh := p2wpkhScript(t, testKey(t, 1))
+
+	// build pays what it is asked for but the signed transaction carries a
+	// witness of extra bytes the estimate did not count
+	builder := func(extra int, overpay int64) func(fee int64) (*wire.MsgTx, int64, error) {
+		return func(fee int64) (*wire.MsgTx, int64, error) {
+			tx := unsignedTx(1, wpkh)
+			tx.TxIn[0].Witness = wire.TxWitness{make([]byte, 72), make([]byte, 33+extra)}
+			tx.TxOut[0].Value = 100000 - fee - overpay
+			return tx, fee + overpay, nil
+		}
+	}
+
+	const feeRate = 2000
+	tests := []struct {
+		name     string
+		fee      int64
+		extra    int
+		overpay  int64
+		attempts int
+		builds   int
+		wantErr  bool
+	}{
+		{"first build pays enough", 2000, 0, 0, 3, 1, false},
+		{"signed larger than estimated", 100, 0, 0, 3, 2, false},
+		{"witness grows", 100, 40, 0, 3, 2, false},
+		{"build pays more than asked", 100, 0, 500, 3, 1, false},
+		{"out of attempts", 100, 0, 0, 1, 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			builds := 0
+			discarded := 0
+			build := builder(test.extra, test.overpay)
+			tx, paid, err := Converge(test.fee, feeRate, test.attempts, func(fee int64) (*wire.MsgTx, int64, error) {
+				builds++
+				return build(fee)
+			}, func(*wire.MsgTx) {
+				discarded++
+			})
+			if builds != test.builds {
+				t.Fatalf("built %d times, want %d", builds, test.builds)
+			}
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if discarded != builds {
+					t.Fatalf("discarded %d of %d transactions", discarded, builds)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if discarded != builds-1 {
+				t.Fatalf("discarded %d of %d transactions", discarded, builds)
+			}
+			required := (VSize(Weight(tx))*feeRate + 999) / 1000
+			if paid < required {
+				t.Fatalf("pays %d, %d needed at %d sat/kvB", paid, required, feeRate)
+			}
+			if test.overpay == 0 && test.builds > 1 && paid != required {
+				t.Fatalf("pays %d, want exactly %d", paid, required)
+			}
+		})
+	}
+}
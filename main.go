@@ -1,24 +1,32 @@
 package main
 
 import (
-	"database/sql"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/spf13/viper"
+	"github.com/twilight-project/rbf-node/alert"
+	"github.com/twilight-project/rbf-node/chainnotify"
 	"github.com/twilight-project/rbf-node/db"
 	"github.com/twilight-project/rbf-node/eventhandler"
+	"github.com/twilight-project/rbf-node/signer"
 	"github.com/twilight-project/rbf-node/types"
 	"github.com/twilight-project/rbf-node/utils"
 )
 
-var DbConn *sql.DB
+var Store db.Store
 
-func initialize() {
+func loadConfig() {
 	viper.AddConfigPath("./configs")
 	viper.SetConfigName("config") // Register config file name (no extension)
 	viper.SetConfigType("json")   // Look for specific type
@@ -26,6 +34,10 @@ func initialize() {
 	if err != nil {
 		fmt.Println("Error reading config file: ", err)
 	}
+}
+
+func initialize() {
+	loadConfig()
 
 	walletName := viper.GetString("btc_core_wallet_name")
 
@@ -41,18 +53,49 @@ func initialize() {
 	// 		os.Exit(1)
 	// 	}
 	// }
-	DbConn = db.InitDB()
+	Store = db.InitStore()
+	alert.Init()
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		loadConfig()
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "signer" {
+		loadConfig()
+		os.Exit(runSigner(os.Args[2:]))
+	}
+
+	dryRun := flag.Bool("dry-run", false, "check transactions with testmempoolaccept and record them instead of broadcasting")
+	flag.Parse()
+
 	initialize()
-	eventhandler.BroadcastSweep(DbConn)
-	go eventhandler.NyksEventListener("broadcast_tx_sweep", "broadcastSweep", DbConn)
-	go utils.BroadcastOnBtc(DbConn)
-	go http.HandleFunc("/rbf", handleRequest)
+	if *dryRun || viper.GetBool("dry_run") {
+		fmt.Println("Running in dry run mode, nothing will be broadcast")
+		utils.EnableDryRun(Store)
+	}
+	eventhandler.BroadcastSweep(Store)
+	eventhandler.BroadcastRefund(Store)
+	go eventhandler.NyksEventListener("broadcast_tx_sweep", "broadcastSweep", Store)
+	go eventhandler.NyksEventListener("broadcast_tx_refund", "broadcastRefund", Store)
+	notifier := chainnotify.NewNotifier(utils.NewBitcoinRpcClient())
+	go utils.BroadcastOnBtc(Store, notifier.Subscribe())
+	go utils.ConfirmTx(Store, notifier.Subscribe())
+	go utils.CheckPinning(Store, notifier.Subscribe())
+	go utils.BumpFees(Store, notifier.Subscribe())
+	go utils.ManageUtxoLeases(Store, notifier.Subscribe())
+	go utils.ManageUtxoPool(Store, notifier.Subscribe())
+	go notifier.Start()
+	http.HandleFunc("/rbf", handleRequest)
+	http.HandleFunc("/pool", handlePoolHealth)
+	approvalToken := viper.GetString("fee_budget.approval_token")
+	if approvalToken == "" {
+		fmt.Println("fee_budget.approval_token is not set, /approvals is disabled")
+	}
+	http.HandleFunc("/approvals", requireToken(approvalToken, handleApprovals))
+	http.HandleFunc("/dryrun", handleDryRun)
 	fmt.Println(http.ListenAndServe(":8080", nil))
-	go utils.ConfirmTx(DbConn)
-	utils.CheckPinning(DbConn)
 
 	// x := "01000000000101e71708c349cb23c333bfe83f673a09eec9f1ac0c88e315f9c1eb55ad81ed7ef5000000000085d00c0001a4900000000000002200204593ced53eddb4d6695bc34d97fe1fbc9ecade6564e1bd5b2cfca7b4cb31fe3e0720bbd32040d3fa8fd784d3b784d206443b1a644b6062680ed576298aabefc329c500483045022100c71b82a058262795aeecb6d309f2278d3d437562485598558109d2070fff322202206bcdb3a17510973f9c1ce835cfce0ebb7d328819a770f7b6b9f91b5d0cf276a10147304402200af72303f8357759d6e27715c1a4ddc5da57f51708346e5fc14766e796e8aa550220386102b032f28b582af686e2eb1b37035b6e23826ebd8b16646b3302e774314501483045022100b562ce717950901dde292118ca2b5b30ded0288091d330d6cec86b60321ed2a6022017a6f0e37f20a005f67155301bb6a1ede8e87a1212fbb6f0ba77635bc2bff374014830450221009f196565edd3f976e3b47578d9132a7ba24179d3e644192f82cabf937a1d614502200cf7346e82d0091c8b3ac157346fc9d3413db3295d3e606211d93a873f343a4701fd1e010389d00cb175542103b03fe3da02ac2d43a1c2ebcfc7b0497e89cc9f62b513c0fc14f10d3d1a2cd5e62102ca505bf28698f0b6c26114a725f757b88d65537dd52a5b6455a9cac9581f10552103bb3694e798f018a157f9e6dfb51b91f70a275443504393040892b52e45b255c32103e2f80f2f5eb646df3e0642ae137bf13f5a9a6af4c05688e147c64e8fae196fe121038b38721dbb1427fd9c65654f87cb424517df717ee2fea8b0a5c376a17349416721033e72f302ba2133eddd0c7416943d4fed4e7c60db32e6b8c58895d3b26e24f92756af82012088a914dbefa70a0e35c33c66e56129552a69baf86ee9e78773642102ca505bf28698f0b6c26114a725f757b88d65537dd52a5b6455a9cac9581f1055ac640394d00cb27568688ad00c00"
 	// sweepTx, _ := utils.CreateTxFromHex(x)
@@ -63,6 +106,123 @@ func main() {
 
 }
 
+// runMigrate implements the `migrate up|down [steps]|status` subcommands and
+// returns the process exit code.
+func runMigrate(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("usage: rbf-node migrate up | down [steps] | status")
+		return 2
+	}
+
+	if backend := viper.GetString("DB_backend"); backend != "" && backend != "postgres" {
+		fmt.Printf("migrations only apply to the postgres backend, %s needs none\n", backend)
+		return 0
+	}
+
+	dbconn, err := db.OpenDB()
+	if err != nil {
+		fmt.Println("DB error : ", err)
+		return 1
+	}
+	defer dbconn.Close()
+
+	switch args[0] {
+	case "up":
+		applied, err := db.MigrateUp(dbconn)
+		if err != nil {
+			fmt.Println("Migration failed: ", err)
+			return 1
+		}
+		fmt.Printf("%d migrations applied\n", applied)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				fmt.Println("steps must be a positive number")
+				return 2
+			}
+		}
+		rolledBack, err := db.MigrateDown(dbconn, steps)
+		if err != nil {
+			fmt.Println("Rollback failed: ", err)
+			return 1
+		}
+		fmt.Printf("%d migrations rolled back\n", rolledBack)
+	case "status":
+		statuses, err := db.MigrationsStatus(dbconn)
+		if err != nil {
+			fmt.Println("Failed to get migration status: ", err)
+			return 1
+		}
+		for _, status := range statuses {
+			if status.Applied {
+				fmt.Printf("%04d_%s\tapplied %s\n", status.Version, status.Name, status.AppliedAt.Format(time.RFC3339))
+			} else {
+				fmt.Printf("%04d_%s\tpending\n", status.Version, status.Name)
+			}
+		}
+	default:
+		fmt.Println("unknown migrate command: ", args[0])
+		return 2
+	}
+	return 0
+}
+
+func runSigner(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("usage: rbf-node signer create-keystore | descriptors | serve [address]")
+		return 2
+	}
+	switch args[0] {
+	case "create-keystore", "descriptors", "serve":
+	default:
+		fmt.Println("unknown signer command: ", args[0])
+		return 2
+	}
+
+	params := utils.NetParams()
+	var keystore *signer.Keystore
+	var err error
+	if args[0] == "create-keystore" {
+		keystore, err = signer.CreateKeystore(signer.KeystorePath(), signer.Passphrase(), params)
+		if err == nil {
+			fmt.Printf("Keystore written to %s\n", signer.KeystorePath())
+		}
+	} else {
+		keystore, err = signer.LoadKeystore(params)
+	}
+	if err != nil {
+		fmt.Println("Keystore error : ", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "create-keystore", "descriptors":
+		descriptors, err := keystore.Descriptors()
+		if err != nil {
+			fmt.Println("Failed to export descriptors : ", err)
+			return 1
+		}
+		fmt.Println("Import these descriptors in a watch-only wallet of the node :")
+		for _, descriptor := range descriptors {
+			fmt.Println(descriptor)
+		}
+	case "serve":
+		address := viper.GetString("signer.remote.listen")
+		if len(args) > 1 {
+			address = args[1]
+		}
+		if address == "" {
+			address = ":8090"
+		}
+		fmt.Printf("Serving keystore %s on %s\n", keystore.Fingerprint(), address)
+		fmt.Println(http.ListenAndServe(address, signer.Handler(keystore, viper.GetString("signer.remote.token"))))
+		return 1
+	}
+	return 0
+}
+
 func handleRequest(w http.ResponseWriter, r *http.Request) {
 	// Read the request body
 	body, err := ioutil.ReadAll(r.Body)
@@ -79,6 +239,117 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	wireTransaction, err := utils.CreateTxFromHex(req.Txhex)
-	// TODO: Add your logic here
-	utils.ReplaceByFee(wireTransaction, req.Amount)
+	if err != nil {
+		http.Error(w, "Error decoding transaction", http.StatusBadRequest)
+		return
+	}
+	if req.DryRun {
+		proposal, err := utils.ProposeReplaceByFee(Store, wireTransaction, req.Amount)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(proposal)
+		return
+	}
+	err = utils.ReplaceByFee(Store, wireTransaction, req.Amount)
+	if errors.Is(err, utils.ErrApprovalRequired) {
+		http.Error(w, err.Error(), http.StatusAccepted)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlePoolHealth reports whether the fee wallet can fund the configured
+// number of sweeps, with 503 when it can not.
+func handlePoolHealth(w http.ResponseWriter, r *http.Request) {
+	health := utils.PoolHealth()
+	if health == nil {
+		http.Error(w, "UTXO pool not assessed yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !health.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+// handleApprovals lists the fee approvals on GET, only those with the given
+// status when one is passed, and approves or rejects one on POST.
+// requireToken only lets requests carrying token as a bearer token through
+// to handler, and refuses every request when token is empty.
+func requireToken(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func handleApprovals(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		statuses := []types.ApprovalStatus{}
+		if status := r.URL.Query().Get("status"); status != "" {
+			statuses = append(statuses, types.ApprovalStatus(status))
+		}
+		approvals, err := Store.ListFeeApprovals(statuses...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(approvals)
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusInternalServerError)
+			return
+		}
+		var req types.ApprovalRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "Error parsing request body", http.StatusBadRequest)
+			return
+		}
+		switch req.Action {
+		case "approve":
+			err = utils.ApproveFee(Store, req.Id)
+		case "reject":
+			err = utils.RejectFee(Store, req.Id)
+		default:
+			http.Error(w, "action must be approve or reject", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDryRun reports what the node would have broadcast in dry run mode.
+func handleDryRun(w http.ResponseWriter, r *http.Request) {
+	broadcasts, err := Store.ListSimulatedBroadcasts()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(broadcasts)
 }
@@ -0,0 +1,318 @@
+package pinning
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/spf13/viper"
+)
+
+type Kind string
+
+const (
+	// ConflictingSpend is a mempool transaction spending one of the inputs
+	// of our transaction, usually the reserve utxo.
+	ConflictingSpend Kind = "conflicting_spend"
+	// LowFeerateDescendants are large, cheap children attached to our
+	// transaction that make replacing it expensive.
+	LowFeerateDescendants Kind = "low_feerate_descendants"
+	// DescendantLimit means our transaction has reached the mempool
+	// descendant limits so no further child (CPFP) can be attached.
+	DescendantLimit Kind = "descendant_limit"
+)
+
+// Default bitcoind policy values, overridable from the config.
+const (
+	defaultIncrementalRelayFee = 1000 // sat/kvB
+	defaultMaxReplacements     = 100
+	defaultDescendantCount     = 25
+	defaultDescendantSize      = 101000 // vbytes
+	defaultLargeDescendantSize = 10000  // vbytes
+)
+
+// Finding describes one pinning pattern affecting a tracked transaction, the
+// replacement rule it trips and the fee a replacement would need.
+type Finding struct {
+	Kind    Kind
+	Txid    string
+	Culprit string
+	Rule    string
+	Detail  string
+	// CurrentFee is what our transaction pays, RequiredFee the absolute fee a
+	// replacement of the same size would need to get past Rule. RequiredFee is
+	// 0 when no fee gets past it.
+	CurrentFee  int64
+	RequiredFee int64
+}
+
+func (f Finding) String() string {
+	s := fmt.Sprintf("[%s] tx %s pinned by %s : %s (%s)", f.Kind, f.Txid, f.Culprit, f.Detail, f.Rule)
+	if f.RequiredFee > 0 {
+		s += fmt.Sprintf(", replacement needs %d sats, currently %d sats (+%d)", f.RequiredFee, f.CurrentFee, f.RequiredFee-f.CurrentFee)
+	}
+	return s
+}
+
+// MempoolEntry is the getmempoolentry result. Fees are in BTC.
+type MempoolEntry struct {
+	VSize           int64 `json:"vsize"`
+	Weight          int64 `json:"weight"`
+	DescendantCount int64 `json:"descendantcount"`
+	DescendantSize  int64 `json:"descendantsize"`
+	AncestorCount   int64 `json:"ancestorcount"`
+	AncestorSize    int64 `json:"ancestorsize"`
+	Fees            struct {
+		Base       float64 `json:"base"`
+		Modified   float64 `json:"modified"`
+		Ancestor   float64 `json:"ancestor"`
+		Descendant float64 `json:"descendant"`
+	} `json:"fees"`
+	Depends           []string `json:"depends"`
+	SpentBy           []string `json:"spentby"`
+	BIP125Replaceable bool     `json:"bip125-replaceable"`
+}
+
+func (e *MempoolEntry) fee() int64 {
+	return btcToSats(e.Fees.Base)
+}
+
+// AncestorFees is the fee of the transaction and all its unconfirmed
+// ancestors in sats.
+func (e *MempoolEntry) AncestorFees() int64 {
+	return btcToSats(e.Fees.Ancestor)
+}
+
+// DescendantFees is the fee of the transaction and all its mempool
+// descendants in sats.
+func (e *MempoolEntry) DescendantFees() int64 {
+	return btcToSats(e.Fees.Descendant)
+}
+
+type MempoolClient interface {
+	RawRequest(method string, params []json.RawMessage) (json.RawMessage, error)
+}
+
+type Analyzer struct {
+	client MempoolClient
+
+	IncrementalRelayFee int64 // sat/kvB
+	MaxReplacements     int64
+	DescendantCount     int64
+	DescendantSize      int64
+	LargeDescendantSize int64
+	// FullRBF tells the analyzer the network replaces transactions that do
+	// not signal BIP125.
+	FullRBF bool
+}
+
+func NewAnalyzer(client MempoolClient) *Analyzer {
+	a := &Analyzer{
+		client:              client,
+		IncrementalRelayFee: defaultIncrementalRelayFee,
+		MaxReplacements:     defaultMaxReplacements,
+		DescendantCount:     defaultDescendantCount,
+		DescendantSize:      defaultDescendantSize,
+		LargeDescendantSize: defaultLargeDescendantSize,
+		FullRBF:             viper.GetBool("pinning_full_rbf"),
+	}
+	if v := viper.GetInt64("incremental_relay_fee_sat_per_kvb"); v > 0 {
+		a.IncrementalRelayFee = v
+	}
+	if v := viper.GetInt64("pinning_descendant_count_limit"); v > 0 {
+		a.DescendantCount = v
+	}
+	if v := viper.GetInt64("pinning_descendant_size_limit"); v > 0 {
+		a.DescendantSize = v
+	}
+	if v := viper.GetInt64("pinning_large_descendant_vsize"); v > 0 {
+		a.LargeDescendantSize = v
+	}
+	return a
+}
+
+func (a *Analyzer) MempoolEntry(txid string) (*MempoolEntry, error) {
+	param, _ := json.Marshal(txid)
+	raw, err := a.client.RawRequest("getmempoolentry", []json.RawMessage{param})
+	if err != nil {
+		return nil, err
+	}
+	entry := &MempoolEntry{}
+	err = json.Unmarshal(raw, entry)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (a *Analyzer) mempoolDescendants(txid string) (map[string]MempoolEntry, error) {
+	param, _ := json.Marshal(txid)
+	verbose, _ := json.Marshal(true)
+	raw, err := a.client.RawRequest("getmempooldescendants", []json.RawMessage{param, verbose})
+	if err != nil {
+		return nil, err
+	}
+	descendants := make(map[string]MempoolEntry)
+	err = json.Unmarshal(raw, &descendants)
+	return descendants, err
+}
+
+// AnalyzeConflict explains what it takes to replace conflict, a mempool
+// transaction spending one of the inputs of tx, with tx paying fee.
+func (a *Analyzer) AnalyzeConflict(tx *wire.MsgTx, fee int64, conflict *chainhash.Hash) ([]Finding, error) {
+	entry, err := a.MempoolEntry(conflict.String())
+	if err != nil {
+		return nil, err
+	}
+
+	txid := tx.TxHash().String()
+	vsize := VirtualSize(tx)
+	base := Finding{Kind: ConflictingSpend, Txid: txid, Culprit: conflict.String(), CurrentFee: fee}
+	findings := []Finding{}
+
+	if !entry.BIP125Replaceable && !a.FullRBF {
+		f := base
+		f.Rule = "BIP125 rule 1"
+		f.Detail = "conflicting transaction does not signal replaceability"
+		findings = append(findings, f)
+	}
+
+	evicted := entry.DescendantCount
+	if evicted > a.MaxReplacements {
+		f := base
+		f.Rule = "BIP125 rule 5"
+		f.Detail = fmt.Sprintf("replacing it would evict %d transactions, limit is %d", evicted, a.MaxReplacements)
+		findings = append(findings, f)
+	}
+
+	// rule 3 and 4: pay for everything evicted plus our own relay
+	rule34Fee := entry.DescendantFees() + a.incrementalFee(vsize)
+	// rule 6: a higher feerate than the transaction we replace
+	rule6Fee := int64(math.Floor(float64(entry.fee())/float64(entry.VSize)*float64(vsize))) + 1
+	if fee < rule34Fee {
+		f := base
+		f.Rule = "BIP125 rule 3/4"
+		f.Detail = fmt.Sprintf("conflict and its %d descendants pay %d sats over %d vbytes", entry.DescendantCount-1, entry.DescendantFees(), entry.DescendantSize)
+		f.RequiredFee = maxInt64(rule34Fee, rule6Fee)
+		findings = append(findings, f)
+	} else if fee < rule6Fee {
+		f := base
+		f.Rule = "BIP125 rule 6"
+		f.Detail = fmt.Sprintf("conflict pays %.2f sat/vB, more than our %.2f sat/vB", float64(entry.fee())/float64(entry.VSize), float64(fee)/float64(vsize))
+		f.RequiredFee = rule6Fee
+		findings = append(findings, f)
+	}
+	return findings, nil
+}
+
+// AnalyzeDescendants checks the mempool descendants of tx, which must be in the
+// mempool, for large low feerate children and the descendant chain limits.
+func (a *Analyzer) AnalyzeDescendants(tx *wire.MsgTx) ([]Finding, error) {
+	txid := tx.TxHash().String()
+	entry, err := a.MempoolEntry(txid)
+	if err != nil {
+		return nil, err
+	}
+	if entry.DescendantCount <= 1 {
+		return nil, nil
+	}
+
+	fee := entry.fee()
+	vsize := entry.VSize
+	base := Finding{Txid: txid, CurrentFee: fee}
+	findings := []Finding{}
+
+	if entry.DescendantCount >= a.DescendantCount || entry.DescendantSize >= a.DescendantSize {
+		f := base
+		f.Kind = DescendantLimit
+		f.Culprit = culpritOf(entry.SpentBy)
+		f.Rule = "descendant limit"
+		f.Detail = fmt.Sprintf("%d descendants over %d vbytes, limits are %d and %d, no child can be attached for CPFP", entry.DescendantCount, entry.DescendantSize, a.DescendantCount, a.DescendantSize)
+		findings = append(findings, f)
+	}
+
+	childrenSize := entry.DescendantSize - vsize
+	childrenFees := entry.DescendantFees() - fee
+	ourFeerate := float64(fee) / float64(vsize)
+	if childrenSize >= a.LargeDescendantSize && float64(childrenFees)/float64(childrenSize) < ourFeerate {
+		culprit := ""
+		descendants, err := a.mempoolDescendants(txid)
+		if err == nil {
+			culprit = largestDescendant(descendants)
+		}
+		if culprit == "" {
+			culprit = culpritOf(entry.SpentBy)
+		}
+
+		f := base
+		f.Kind = LowFeerateDescendants
+		f.Culprit = culprit
+		f.Rule = "BIP125 rule 3/4"
+		f.Detail = fmt.Sprintf("%d vbytes of descendants at %.2f sat/vB, below our %.2f sat/vB", childrenSize, float64(childrenFees)/float64(childrenSize), ourFeerate)
+		f.RequiredFee = entry.DescendantFees() + a.incrementalFee(vsize)
+		findings = append(findings, f)
+	}
+
+	if entry.DescendantCount > a.MaxReplacements {
+		f := base
+		f.Kind = LowFeerateDescendants
+		f.Culprit = culpritOf(entry.SpentBy)
+		f.Rule = "BIP125 rule 5"
+		f.Detail = fmt.Sprintf("replacing it would evict %d transactions, limit is %d", entry.DescendantCount, a.MaxReplacements)
+		findings = append(findings, f)
+	}
+	return findings, nil
+}
+
+func (a *Analyzer) incrementalFee(vsize int64) int64 {
+	return (vsize*a.IncrementalRelayFee + 999) / 1000
+}
+
+func culpritOf(spentBy []string) string {
+	if len(spentBy) == 0 {
+		return ""
+	}
+	sort.Strings(spentBy)
+	return spentBy[0]
+}
+
+// largestDescendant returns the txid of the biggest descendant, the most
+// likely pin.
+func largestDescendant(descendants map[string]MempoolEntry) string {
+	largest := ""
+	var largestSize int64
+	for txid, entry := range descendants {
+		if entry.VSize > largestSize || (entry.VSize == largestSize && txid < largest) {
+			largest = txid
+			largestSize = entry.VSize
+		}
+	}
+	return largest
+}
+
+// VirtualSize returns the BIP141 virtual size of tx.
+func VirtualSize(tx *wire.MsgTx) int64 {
+	baseSize := tx.SerializeSizeStripped()
+	totalSize := tx.SerializeSize()
+	weight := (baseSize * 3) + totalSize
+	return int64((weight + 3) / 4)
+}
+
+func btcToSats(btc float64) int64 {
+	amount, err := btcutil.NewAmount(btc)
+	if err != nil {
+		return 0
+	}
+	return int64(amount)
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,72 @@
+package signer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// Bitcoind signs with the keys of the bitcoind wallet through
+// walletprocesspsbt.
+type Bitcoind struct {
+	Client *rpcclient.Client
+}
+
+type processPsbtResult struct {
+	Psbt     string `json:"psbt"`
+	Complete bool   `json:"complete"`
+}
+
+func (b *Bitcoind) Name() string {
+	return "bitcoind"
+}
+
+func (b *Bitcoind) SignPsbt(packet *psbt.Packet) (*psbt.Packet, error) {
+	encoded, err := packet.B64Encode()
+	if err != nil {
+		return nil, err
+	}
+	// without a sighash bitcoind signs with the default of each input,
+	// SIGHASH_DEFAULT for taproot
+	params := []interface{}{encoded, true}
+	if hashType, ok := sigHashType(packet); ok {
+		params = append(params, sigHashName(hashType), true)
+	}
+	rawParams := make([]json.RawMessage, len(params))
+	for i, param := range params {
+		rawParams[i], err = json.Marshal(param)
+		if err != nil {
+			return nil, err
+		}
+	}
+	raw, err := b.Client.RawRequest("walletprocesspsbt", rawParams)
+	if err != nil {
+		return nil, err
+	}
+	result := processPsbtResult{}
+	err = json.Unmarshal(raw, &result)
+	if err != nil {
+		return nil, err
+	}
+	return psbt.NewFromRawBytes(strings.NewReader(result.Psbt), true)
+}
+
+// sigHashName returns the name walletprocesspsbt takes for hashType.
+func sigHashName(hashType txscript.SigHashType) string {
+	names := map[txscript.SigHashType]string{
+		txscript.SigHashAll:                                   "ALL",
+		txscript.SigHashNone:                                  "NONE",
+		txscript.SigHashSingle:                                "SINGLE",
+		txscript.SigHashAll | txscript.SigHashAnyOneCanPay:    "ALL|ANYONECANPAY",
+		txscript.SigHashNone | txscript.SigHashAnyOneCanPay:   "NONE|ANYONECANPAY",
+		txscript.SigHashSingle | txscript.SigHashAnyOneCanPay: "SINGLE|ANYONECANPAY",
+	}
+	if name, ok := names[hashType]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", hashType)
+}
@@ -0,0 +1,88 @@
+package signer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Descriptors returns the output descriptors of the receive and change
+// addresses of the keystore accounts, with their checksums. Imported in a
+// watch-only bitcoind wallet they let the node see and select the coins of
+// the keystore.
+func (k *Keystore) Descriptors() ([]string, error) {
+	coinType := k.params.HDCoinType
+	descriptors := []string{}
+	for _, purpose := range []uint32{PurposeSegwit, PurposeTaproot} {
+		account, err := k.derive(keyPath{purpose: purpose}.path(coinType)[:3])
+		if err != nil {
+			return nil, err
+		}
+		xpub, err := account.Neuter()
+		if err != nil {
+			return nil, err
+		}
+		function := "wpkh"
+		if purpose == PurposeTaproot {
+			function = "tr"
+		}
+		for change := 0; change < 2; change++ {
+			descriptor := fmt.Sprintf("%s([%s/%dh/%dh/0h]%s/%d/*)", function, k.Fingerprint(), purpose, coinType, xpub.String(), change)
+			checksum, err := DescriptorChecksum(descriptor)
+			if err != nil {
+				return nil, err
+			}
+			descriptors = append(descriptors, descriptor+"#"+checksum)
+		}
+	}
+	return descriptors, nil
+}
+
+const (
+	descriptorInputCharset    = "0123456789()[],'/*abcdefgh@:$%{}IJKLMNOPQRSTUVWXYZ&+-.;<=>?!^_|~ijklmnopqrstuvwxyzABCDEFGH`#\"\\ "
+	descriptorChecksumCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+)
+
+func descriptorPolymod(c uint64, value uint64) uint64 {
+	c0 := c >> 35
+	c = ((c & 0x7ffffffff) << 5) ^ value
+	generators := []uint64{0xf5dee51989, 0xa9fdca3312, 0x1bab10e32d, 0x3706b1677a, 0x644d626ffd}
+	for i, generator := range generators {
+		if c0&(1<<i) != 0 {
+			c ^= generator
+		}
+	}
+	return c
+}
+
+// DescriptorChecksum computes the BIP380 checksum bitcoind expects after the
+// # of a descriptor.
+func DescriptorChecksum(descriptor string) (string, error) {
+	c := uint64(1)
+	class, classCount := uint64(0), 0
+	for _, ch := range descriptor {
+		position := strings.IndexRune(descriptorInputCharset, ch)
+		if position < 0 {
+			return "", fmt.Errorf("invalid character %q in descriptor", ch)
+		}
+		c = descriptorPolymod(c, uint64(position)&31)
+		class = class*3 + uint64(position)>>5
+		classCount++
+		if classCount == 3 {
+			c = descriptorPolymod(c, class)
+			class, classCount = 0, 0
+		}
+	}
+	if classCount > 0 {
+		c = descriptorPolymod(c, class)
+	}
+	for i := 0; i < 8; i++ {
+		c = descriptorPolymod(c, 0)
+	}
+	c ^= 1
+
+	checksum := make([]byte, 8)
+	for i := range checksum {
+		checksum[i] = descriptorChecksumCharset[(c>>(5*(7-i)))&31]
+	}
+	return string(checksum), nil
+}
@@ -0,0 +1,384 @@
+package signer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"golang.org/x/crypto/scrypt"
+)
+
+// BIP44 style purposes of the accounts the keystore signs for.
+const (
+	PurposeSegwit  = 84 // P2WPKH, BIP84
+	PurposeTaproot = 86 // P2TR key path, BIP86
+)
+
+// scrypt parameters of new keystores, the ones used are kept in the file.
+const (
+	scryptN   = 1 << 15
+	scryptR   = 8
+	scryptP   = 1
+	seedBytes = 32
+)
+
+// defaultLookahead is how many receive and change addresses of each account
+// are searched for inputs the PSBT gives no derivation path for.
+const defaultLookahead = 200
+
+var ErrWrongPassphrase = errors.New("wrong keystore passphrase")
+
+// keystoreFile is the encrypted seed as written to disk.
+type keystoreFile struct {
+	Version    int    `json:"version"`
+	Kdf        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       string `json:"salt"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// keyPath locates a key of the keystore under the master key.
+type keyPath struct {
+	purpose uint32
+	change  uint32
+	index   uint32
+}
+
+func (k keyPath) path(coinType uint32) []uint32 {
+	return []uint32{
+		k.purpose + hdkeychain.HardenedKeyStart,
+		coinType + hdkeychain.HardenedKeyStart,
+		hdkeychain.HardenedKeyStart,
+		k.change,
+		k.index,
+	}
+}
+
+// Keystore signs with keys derived from a seed kept encrypted on disk, from
+// the first BIP84 and BIP86 accounts.
+type Keystore struct {
+	master      *hdkeychain.ExtendedKey
+	params      *chaincfg.Params
+	fingerprint uint32
+	lookahead   uint32
+	// scripts maps the output scripts of the first lookahead addresses to
+	// their key, built on first use
+	scripts map[string]keyPath
+}
+
+// CreateKeystore writes a keystore holding a new random seed to path,
+// encrypted with passphrase. An existing file is not overwritten.
+func CreateKeystore(path string, passphrase string, params *chaincfg.Params) (*Keystore, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("a passphrase is required to create a keystore")
+	}
+	seed, err := hdkeychain.GenerateSeed(seedBytes)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	file := keystoreFile{Version: 1, Kdf: "scrypt", N: scryptN, R: scryptR, P: scryptP, Salt: hex.EncodeToString(salt)}
+	aead, err := keystoreCipher(file, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	file.Nonce = hex.EncodeToString(nonce)
+	file.Ciphertext = hex.EncodeToString(aead.Seal(nil, nonce, seed, nil))
+
+	data, err := json.MarshalIndent(file, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newKeystore(seed, params, 0)
+}
+
+// OpenKeystore decrypts the keystore at path. lookahead 0 uses the default.
+func OpenKeystore(path string, passphrase string, params *chaincfg.Params, lookahead uint32) (*Keystore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := keystoreFile{}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, err
+	}
+	if file.Version != 1 || file.Kdf != "scrypt" {
+		return nil, fmt.Errorf("unsupported keystore version %d with kdf %s", file.Version, file.Kdf)
+	}
+	aead, err := keystoreCipher(file, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(file.Nonce)
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid keystore nonce")
+	}
+	ciphertext, err := hex.DecodeString(file.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keystore ciphertext")
+	}
+	seed, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return newKeystore(seed, params, lookahead)
+}
+
+func keystoreCipher(file keystoreFile, passphrase string) (cipher.AEAD, error) {
+	salt, err := hex.DecodeString(file.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keystore salt")
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, file.N, file.R, file.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newKeystore(seed []byte, params *chaincfg.Params, lookahead uint32) (*Keystore, error) {
+	master, err := hdkeychain.NewMaster(seed, params)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := master.ECPubKey()
+	if err != nil {
+		return nil, err
+	}
+	if lookahead == 0 {
+		lookahead = defaultLookahead
+	}
+	// PSBTs carry the fingerprint bytes in order, read as little endian
+	fingerprint := binary.LittleEndian.Uint32(btcutil.Hash160(pubKey.SerializeCompressed())[:4])
+	return &Keystore{master: master, params: params, fingerprint: fingerprint, lookahead: lookahead}, nil
+}
+
+func (k *Keystore) Name() string {
+	return "keystore"
+}
+
+// Fingerprint returns the master key fingerprint as written in descriptors.
+func (k *Keystore) Fingerprint() string {
+	fingerprint := make([]byte, 4)
+	binary.LittleEndian.PutUint32(fingerprint, k.fingerprint)
+	return hex.EncodeToString(fingerprint)
+}
+
+func (k *Keystore) derive(path []uint32) (*hdkeychain.ExtendedKey, error) {
+	key := k.master
+	for _, index := range path {
+		var err error
+		key, err = key.Derive(index)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// outputScript returns the script paying to the key at path for purpose.
+func outputScript(purpose uint32, pubKey *btcec.PublicKey) ([]byte, error) {
+	if purpose == PurposeTaproot {
+		return txscript.PayToTaprootScript(txscript.ComputeTaprootKeyNoScript(pubKey))
+	}
+	return txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(btcutil.Hash160(pubKey.SerializeCompressed())).Script()
+}
+
+// findKey returns the private key that spends pkScript, nil when the
+// keystore does not hold it. The derivation paths of the PSBT are tried
+// first, then the first lookahead addresses of each account.
+func (k *Keystore) findKey(input *psbt.PInput, pkScript []byte) (*btcec.PrivateKey, error) {
+	paths := [][]uint32{}
+	for _, derivation := range input.Bip32Derivation {
+		if derivation.MasterKeyFingerprint == k.fingerprint {
+			paths = append(paths, derivation.Bip32Path)
+		}
+	}
+	for _, derivation := range input.TaprootBip32Derivation {
+		if derivation.MasterKeyFingerprint == k.fingerprint {
+			paths = append(paths, derivation.Bip32Path)
+		}
+	}
+	if len(paths) == 0 {
+		path, ok, err := k.lookup(pkScript)
+		if err != nil || !ok {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+
+	for _, path := range paths {
+		if len(path) == 0 {
+			continue
+		}
+		key, err := k.derive(path)
+		if err != nil {
+			return nil, err
+		}
+		pubKey, err := key.ECPubKey()
+		if err != nil {
+			return nil, err
+		}
+		script, err := outputScript(path[0]-hdkeychain.HardenedKeyStart, pubKey)
+		if err != nil {
+			return nil, err
+		}
+		// the path may be wrong or another purpose's, only sign for
+		// the script the input actually spends
+		if string(script) == string(pkScript) {
+			return key.ECPrivKey()
+		}
+	}
+	return nil, nil
+}
+
+func (k *Keystore) lookup(pkScript []byte) ([]uint32, bool, error) {
+	coinType := k.params.HDCoinType
+	if k.scripts == nil {
+		scripts := make(map[string]keyPath)
+		for _, purpose := range []uint32{PurposeSegwit, PurposeTaproot} {
+			for change := uint32(0); change < 2; change++ {
+				branch, err := k.derive(keyPath{purpose: purpose, change: change}.path(coinType)[:4])
+				if err != nil {
+					return nil, false, err
+				}
+				for index := uint32(0); index < k.lookahead; index++ {
+					key, err := branch.Derive(index)
+					if err != nil {
+						continue
+					}
+					pubKey, err := key.ECPubKey()
+					if err != nil {
+						return nil, false, err
+					}
+					script, err := outputScript(purpose, pubKey)
+					if err != nil {
+						return nil, false, err
+					}
+					scripts[string(script)] = keyPath{purpose: purpose, change: change, index: index}
+				}
+			}
+		}
+		k.scripts = scripts
+	}
+	path, ok := k.scripts[string(pkScript)]
+	if !ok {
+		return nil, false, nil
+	}
+	return path.path(coinType), true, nil
+}
+
+// SignPsbt signs the P2WPKH, P2SH-P2WPKH and P2TR key path inputs the
+// keystore holds the key of. Inputs spending other scripts are left as they
+// are.
+func (k *Keystore) SignPsbt(packet *psbt.Packet) (*psbt.Packet, error) {
+	tx := packet.UnsignedTx
+	prevOuts := make(map[wire.OutPoint]*wire.TxOut)
+	for i, txIn := range tx.TxIn {
+		prevOuts[txIn.PreviousOutPoint] = inputUtxo(packet, i)
+	}
+	sigHashes := txscript.NewTxSigHashes(tx, txscript.NewMultiPrevOutFetcher(prevOuts))
+	updater, err := psbt.NewUpdater(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range packet.Inputs {
+		input := &packet.Inputs[i]
+		if input.FinalScriptSig != nil || input.FinalScriptWitness != nil || input.WitnessUtxo == nil {
+			continue
+		}
+		utxo := input.WitnessUtxo
+		key, err := k.findKey(input, utxo.PkScript)
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			continue
+		}
+
+		if txscript.IsPayToTaproot(utxo.PkScript) {
+			sig, err := txscript.RawTxInTaprootSignature(tx, sigHashes, i, utxo.Value, utxo.PkScript, nil, input.SighashType, key)
+			if err != nil {
+				return nil, err
+			}
+			input.TaprootKeySpendSig = sig
+			continue
+		}
+
+		hashType := input.SighashType
+		if hashType == 0 {
+			hashType = txscript.SigHashAll
+		}
+		// nested segwit signs for the witness program in the redeem script
+		script := utxo.PkScript
+		if txscript.IsPayToScriptHash(script) {
+			script = input.RedeemScript
+		}
+		if !txscript.IsPayToWitnessPubKeyHash(script) {
+			continue
+		}
+		sig, err := txscript.RawTxInWitnessSignature(tx, sigHashes, i, utxo.Value, script, hashType, key)
+		if err != nil {
+			return nil, err
+		}
+		_, err = updater.Sign(i, sig, key.PubKey().SerializeCompressed(), input.RedeemScript, nil)
+		if err != nil {
+			return nil, fmt.Errorf("input %d : %w", i, err)
+		}
+	}
+	return packet, nil
+}
+
+// inputUtxo returns the output spent by input i. Unknown outputs come back
+// empty, they only matter to taproot sighashes committing to every input.
+func inputUtxo(packet *psbt.Packet, i int) *wire.TxOut {
+	input := packet.Inputs[i]
+	if input.WitnessUtxo != nil {
+		return input.WitnessUtxo
+	}
+	index := packet.UnsignedTx.TxIn[i].PreviousOutPoint.Index
+	if input.NonWitnessUtxo != nil && int(index) < len(input.NonWitnessUtxo.TxOut) {
+		return input.NonWitnessUtxo.TxOut[index]
+	}
+	return wire.NewTxOut(0, nil)
+}
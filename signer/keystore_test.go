@@ -0,0 +1,290 @@
+package signer
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// bip39Seed is the seed of the mnemonic "abandon abandon ... about" used by
+// the BIP84 and BIP86 test vectors.
+const bip39Seed = "5eb00bbddcf069084889a8ab9155568165f5c453ccb85e70811aaed6f6da5fc19a5ac40b389cd370d086206dec8aa6c43daea6690f20ad3d8d48b2d2ce9e38e4"
+
+func vectorKeystore(t *testing.T, params *chaincfg.Params) *Keystore {
+	t.Helper()
+	seed, err := hex.DecodeString(bip39Seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := newKeystore(seed, params, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// keystoreScript returns the output script of the key of k at path.
+func keystoreScript(t *testing.T, k *Keystore, path keyPath) []byte {
+	t.Helper()
+	key, err := k.derive(path.path(k.params.HDCoinType))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := key.ECPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err := outputScript(path.purpose, pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+func TestKeystoreVectors(t *testing.T) {
+	k := vectorKeystore(t, &chaincfg.MainNetParams)
+	if k.Fingerprint() != "73c5da0a" {
+		t.Fatalf("fingerprint %s, want 73c5da0a", k.Fingerprint())
+	}
+	tests := []struct {
+		name string
+		path keyPath
+		want string
+	}{
+		{"bip84 first receive address", keyPath{purpose: PurposeSegwit}, "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu"},
+		{"bip84 second receive address", keyPath{purpose: PurposeSegwit, index: 1}, "bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g"},
+		{"bip84 first change address", keyPath{purpose: PurposeSegwit, change: 1}, "bc1q8c6fshw2dlwun7ekn9qwf37cu2rn755upcp6el"},
+		{"bip86 first receive address", keyPath{purpose: PurposeTaproot}, "bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr, err := btcutil.DecodeAddress(test.want, &chaincfg.MainNetParams)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := txscript.PayToAddrScript(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := keystoreScript(t, k, test.path); string(got) != string(want) {
+				t.Fatalf("script %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestDescriptorChecksum(t *testing.T) {
+	// from BIP380
+	got, err := DescriptorChecksum("raw(deadbeef)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "89f8spxm" {
+		t.Fatalf("checksum %s, want 89f8spxm", got)
+	}
+	_, err = DescriptorChecksum("raw(deadbeef)\n")
+	if err == nil {
+		t.Fatal("expected an error for a character outside the descriptor charset")
+	}
+}
+
+func TestDescriptors(t *testing.T) {
+	k := vectorKeystore(t, &chaincfg.MainNetParams)
+	descriptors, err := k.Descriptors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const bip84Xpub = "xpub6CatWdiZiodmUeTDp8LT5or8nmbKNcuyvz7WyksVFkKB4RHwCD3XyuvPEbvqAQY3rAPshWcMLoP2fMFMKHPJ4ZeZXYVUhLv1VMrjPC7PW6V"
+	prefixes := []string{
+		"wpkh([73c5da0a/84h/0h/0h]" + bip84Xpub + "/0/*)#",
+		"wpkh([73c5da0a/84h/0h/0h]" + bip84Xpub + "/1/*)#",
+		"tr([73c5da0a/86h/0h/0h]xpub",
+		"tr([73c5da0a/86h/0h/0h]xpub",
+	}
+	if len(descriptors) != len(prefixes) {
+		t.Fatalf("%d descriptors, want %d", len(descriptors), len(prefixes))
+	}
+	for i, descriptor := range descriptors {
+		if !strings.HasPrefix(descriptor, prefixes[i]) {
+			t.Fatalf("descriptor %s, want it to start with %s", descriptor, prefixes[i])
+		}
+		body, checksum, ok := strings.Cut(descriptor, "#")
+		if !ok {
+			t.Fatalf("descriptor %s has no checksum", descriptor)
+		}
+		want, err := DescriptorChecksum(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checksum != want {
+			t.Fatalf("checksum %s of %s, want %s", checksum, body, want)
+		}
+	}
+}
+
+func TestCreateOpenKeystore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	params := &chaincfg.RegressionNetParams
+
+	_, err := CreateKeystore(path, "", params)
+	if err == nil {
+		t.Fatal("expected an error without a passphrase")
+	}
+	created, err := CreateKeystore(path, "correct horse", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateKeystore(path, "correct horse", params)
+	if err == nil {
+		t.Fatal("an existing keystore was overwritten")
+	}
+
+	_, err = OpenKeystore(path, "wrong", params, 0)
+	if !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("got %v, want %v", err, ErrWrongPassphrase)
+	}
+	opened, err := OpenKeystore(path, "correct horse", params, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.Fingerprint() != created.Fingerprint() {
+		t.Fatalf("fingerprint %s, created %s", opened.Fingerprint(), created.Fingerprint())
+	}
+	if opened.lookahead != defaultLookahead {
+		t.Fatalf("lookahead %d, want %d", opened.lookahead, defaultLookahead)
+	}
+	want, err := created.Descriptors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := opened.Descriptors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("descriptors %v, created %v", got, want)
+	}
+}
+
+// testPacket returns a PSBT spending, in order:
+// a keystore P2WPKH output the PSBT gives no derivation path for, a keystore
+// P2TR output with its derivation path, and a P2WPKH output of another key.
+func testPacket(t *testing.T, k *Keystore) *psbt.Packet {
+	t.Helper()
+	wpkhPath := keyPath{purpose: PurposeSegwit, index: 3}
+	trPath := keyPath{purpose: PurposeTaproot, change: 1, index: 2}
+	foreign := vectorKeystore(t, k.params)
+	if foreign.fingerprint == k.fingerprint {
+		t.Fatal("the test keystores share a seed")
+	}
+	pkScripts := [][]byte{
+		keystoreScript(t, k, wpkhPath),
+		keystoreScript(t, k, trPath),
+		keystoreScript(t, foreign, keyPath{purpose: PurposeSegwit}),
+	}
+
+	tx := wire.NewMsgTx(2)
+	for i := range pkScripts {
+		tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: chainhash.Hash{byte(i + 1)}, Index: uint32(i)}, nil, nil))
+	}
+	tx.AddTxOut(wire.NewTxOut(250000, pkScripts[0]))
+	packet, err := psbt.NewFromUnsignedTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, pkScript := range pkScripts {
+		packet.Inputs[i].WitnessUtxo = wire.NewTxOut(100000, pkScript)
+	}
+
+	trKey, err := k.derive(trPath.path(k.params.HDCoinType))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trPubKey, err := trKey.ECPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet.Inputs[1].TaprootBip32Derivation = []*psbt.TaprootBip32Derivation{{
+		XOnlyPubKey:          trPubKey.SerializeCompressed()[1:],
+		MasterKeyFingerprint: k.fingerprint,
+		Bip32Path:            trPath.path(k.params.HDCoinType),
+	}}
+	return packet
+}
+
+// checkSigned finalizes the inputs signed by the keystore and runs them
+// through the script interpreter, then checks the foreign input is left
+// unsigned.
+func checkSigned(t *testing.T, packet *psbt.Packet) {
+	t.Helper()
+	for i := 0; i < 2; i++ {
+		err := psbt.Finalize(packet, i)
+		if err != nil {
+			t.Fatalf("input %d : %v", i, err)
+		}
+	}
+	foreign := packet.Inputs[2]
+	if len(foreign.PartialSigs) > 0 || foreign.TaprootKeySpendSig != nil || foreign.FinalScriptWitness != nil {
+		t.Fatal("the input of another key was signed")
+	}
+
+	tx := packet.UnsignedTx.Copy()
+	fetcher := txscript.NewMultiPrevOutFetcher(nil)
+	for i, txIn := range tx.TxIn {
+		fetcher.AddPrevOut(txIn.PreviousOutPoint, packet.Inputs[i].WitnessUtxo)
+	}
+	sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+	for i := 0; i < 2; i++ {
+		tx.TxIn[i].Witness = readWitness(t, packet.Inputs[i].FinalScriptWitness)
+		utxo := packet.Inputs[i].WitnessUtxo
+		vm, err := txscript.NewEngine(utxo.PkScript, tx, i, txscript.StandardVerifyFlags, nil, sigHashes, utxo.Value, fetcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = vm.Execute()
+		if err != nil {
+			t.Fatalf("input %d : %v", i, err)
+		}
+	}
+}
+
+// readWitness decodes a witness serialized as in a PSBT.
+func readWitness(t *testing.T, serialized []byte) wire.TxWitness {
+	t.Helper()
+	r := bytes.NewReader(serialized)
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	witness := make(wire.TxWitness, count)
+	for i := range witness {
+		witness[i], err = wire.ReadVarBytes(r, 0, wire.MaxMessagePayload, "witness item")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return witness
+}
+
+func TestKeystoreSignPsbt(t *testing.T) {
+	params := &chaincfg.RegressionNetParams
+	k, err := CreateKeystore(filepath.Join(t.TempDir(), "keystore.json"), "correct horse", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := k.SignPsbt(testPacket(t, k))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSigned(t, signed)
+}
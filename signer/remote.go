@@ -0,0 +1,126 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil/psbt"
+)
+
+// maxPsbtBytes bounds the requests the remote signer reads.
+const maxPsbtBytes = 4 << 20
+
+// signRequest is the body exchanged with a remote signer in both
+// directions: the PSBT to sign, then the PSBT signed.
+type signRequest struct {
+	Psbt string `json:"psbt"`
+}
+
+// Remote hands PSBTs to a signer on another host over HTTP, e.g. the node
+// started with `signer serve` next to its keystore. It POSTs
+// {"psbt": "<base64>"} to URL/signpsbt and reads the signed PSBT back in the
+// same form.
+type Remote struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+func NewRemote(url string, token string, timeout time.Duration) *Remote {
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return &Remote{URL: strings.TrimRight(url, "/"), Token: token, Client: &http.Client{Timeout: timeout}}
+}
+
+func (r *Remote) Name() string {
+	return "remote"
+}
+
+func (r *Remote) SignPsbt(packet *psbt.Packet) (*psbt.Packet, error) {
+	encoded, err := packet.B64Encode()
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(signRequest{Psbt: encoded})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.URL+"/signpsbt", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxPsbtBytes))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("signpsbt returned %s : %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	signed := signRequest{}
+	err = json.Unmarshal(respBody, &signed)
+	if err != nil {
+		return nil, err
+	}
+	return psbt.NewFromRawBytes(strings.NewReader(signed.Psbt), true)
+}
+
+// Handler serves the remote signer protocol with s. Requests must carry
+// token as a bearer token when it is set.
+func Handler(s Signer, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/signpsbt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if token != "" {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		req := signRequest{}
+		err := json.NewDecoder(io.LimitReader(r.Body, maxPsbtBytes)).Decode(&req)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		packet, err := psbt.NewFromRawBytes(strings.NewReader(req.Psbt), true)
+		if err != nil {
+			http.Error(w, "Invalid psbt : "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		signed, err := s.SignPsbt(packet)
+		if err != nil {
+			fmt.Println("Failed to sign psbt : ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		encoded, err := signed.B64Encode()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(signRequest{Psbt: encoded})
+	})
+	return mux
+}
@@ -0,0 +1,74 @@
+package signer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+func TestRemoteRoundTrip(t *testing.T) {
+	k, err := CreateKeystore(filepath.Join(t.TempDir(), "keystore.json"), "correct horse", &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(Handler(k, "secret"))
+	t.Cleanup(server.Close)
+
+	signed, err := NewRemote(server.URL+"/", "secret", time.Second).SignPsbt(testPacket(t, k))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSigned(t, signed)
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"wrong token", "guess", "401"},
+		{"no token", "", "401"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewRemote(server.URL, test.token, time.Second).SignPsbt(testPacket(t, k))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("got %v, want an error with %s", err, test.want)
+			}
+		})
+	}
+}
+
+func TestHandlerRejects(t *testing.T) {
+	k, err := CreateKeystore(filepath.Join(t.TempDir(), "keystore.json"), "correct horse", &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(Handler(k, ""))
+	t.Cleanup(server.Close)
+
+	resp, err := http.Get(server.URL + "/signpsbt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("GET returned %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	bodies := []string{`not json`, `{"psbt": "bm90IGEgcHNidA=="}`}
+	for _, body := range bodies {
+		resp, err := http.Post(server.URL+"/signpsbt", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s returned %d, want %d", body, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
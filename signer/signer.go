@@ -0,0 +1,123 @@
+package signer
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/spf13/viper"
+)
+
+// Signer adds signatures to the inputs of a PSBT it holds the keys of,
+// leaving the inputs that are already final untouched. It may finalize the
+// inputs it signed, the node finalizes the rest.
+type Signer interface {
+	Name() string
+	SignPsbt(packet *psbt.Packet) (*psbt.Packet, error)
+}
+
+// PassphraseEnv is the environment variable the keystore passphrase is read
+// from, before signer.keystore.passphrase in the config.
+const PassphraseEnv = "RBF_KEYSTORE_PASSPHRASE"
+
+var (
+	keystoreMu sync.Mutex
+	keystore   *Keystore
+)
+
+// New returns the signer configured by signer.backend. client is used by the
+// bitcoind backend. The keystore is decrypted once and kept in memory.
+func New(client *rpcclient.Client, params *chaincfg.Params) (Signer, error) {
+	switch backend := viper.GetString("signer.backend"); backend {
+	case "bitcoind", "":
+		return &Bitcoind{Client: client}, nil
+	case "keystore":
+		return LoadKeystore(params)
+	case "remote":
+		url := viper.GetString("signer.remote.url")
+		if url == "" {
+			return nil, fmt.Errorf("signer.remote.url is not set")
+		}
+		timeout := time.Duration(viper.GetInt64("signer.remote.timeout_seconds")) * time.Second
+		return NewRemote(url, viper.GetString("signer.remote.token"), timeout), nil
+	default:
+		return nil, fmt.Errorf("unknown signer.backend %s", backend)
+	}
+}
+
+// LoadKeystore opens the keystore at signer.keystore.path.
+func LoadKeystore(params *chaincfg.Params) (*Keystore, error) {
+	keystoreMu.Lock()
+	defer keystoreMu.Unlock()
+	if keystore != nil {
+		return keystore, nil
+	}
+	path := KeystorePath()
+	k, err := OpenKeystore(path, Passphrase(), params, uint32(viper.GetInt64("signer.keystore.lookahead")))
+	if err != nil {
+		return nil, fmt.Errorf("keystore %s : %w", path, err)
+	}
+	keystore = k
+	return keystore, nil
+}
+
+func KeystorePath() string {
+	if path := viper.GetString("signer.keystore.path"); path != "" {
+		return path
+	}
+	return "keystore.json"
+}
+
+func Passphrase() string {
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return passphrase
+	}
+	return viper.GetString("signer.keystore.passphrase")
+}
+
+// ParsePath parses a BIP32 path like m/84'/0'/0'/0/1. Hardened steps are
+// marked with ' or h.
+func ParsePath(path string) ([]uint32, error) {
+	steps := strings.Split(strings.TrimSpace(path), "/")
+	if len(steps) == 0 || steps[0] != "m" {
+		return nil, fmt.Errorf("bip32 path %q does not start with m", path)
+	}
+	indexes := make([]uint32, 0, len(steps)-1)
+	for _, step := range steps[1:] {
+		hardened := strings.HasSuffix(step, "'") || strings.HasSuffix(step, "h")
+		if hardened {
+			step = step[:len(step)-1]
+		}
+		index, err := strconv.ParseUint(step, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid step %q in bip32 path %q", step, path)
+		}
+		if hardened {
+			index += hdkeychain.HardenedKeyStart
+		}
+		indexes = append(indexes, uint32(index))
+	}
+	return indexes, nil
+}
+
+// sigHashType returns the sighash the inputs left to sign ask for, false
+// when none is set and each input uses its default.
+func sigHashType(packet *psbt.Packet) (txscript.SigHashType, bool) {
+	for _, input := range packet.Inputs {
+		if input.FinalScriptSig != nil || input.FinalScriptWitness != nil {
+			continue
+		}
+		if input.SighashType != txscript.SigHashDefault {
+			return input.SighashType, true
+		}
+	}
+	return txscript.SigHashDefault, false
+}
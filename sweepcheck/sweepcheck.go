@@ -0,0 +1,212 @@
+package sweepcheck
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ErrIntegrity is wrapped by the errors of Check, the modified transaction
+// would invalidate signatures of the original one.
+var ErrIntegrity = errors.New("sweep integrity violated")
+
+// sigHashMask selects the base type, ALL, NONE or SINGLE, of a sighash.
+const sigHashMask = 0x1f
+
+// Violation is an input of the original transaction whose signatures the
+// modification breaks. Input is -1 for changes to the whole transaction.
+type Violation struct {
+	Input  int
+	Reason string
+}
+
+func (v Violation) String() string {
+	if v.Input < 0 {
+		return v.Reason
+	}
+	return fmt.Sprintf("input %d : %s", v.Input, v.Reason)
+}
+
+// Report lists what the modification does to the original transaction and
+// the signatures it breaks.
+type Report struct {
+	AddedInputs  int
+	AddedOutputs int
+	// SigHashTypes holds the sighash of each signature found in the witness
+	// of every original input.
+	SigHashTypes [][]txscript.SigHashType
+	Violations   []Violation
+}
+
+// Err returns nil when every original signature stays valid, an error
+// wrapping ErrIntegrity otherwise.
+func (r *Report) Err() error {
+	if len(r.Violations) == 0 {
+		return nil
+	}
+	reasons := make([]string, len(r.Violations))
+	for i, violation := range r.Violations {
+		reasons[i] = violation.String()
+	}
+	return fmt.Errorf("%w : %s", ErrIntegrity, strings.Join(reasons, ", "))
+}
+
+// SigHashTypes returns the sighash of every signature in the witness of an
+// input spending pkScript: DER encoded ECDSA signatures followed by their
+// sighash byte, or the Schnorr signature of a taproot key path spend.
+func SigHashTypes(witness wire.TxWitness, pkScript []byte) []txscript.SigHashType {
+	hashTypes := []txscript.SigHashType{}
+	if txscript.IsPayToTaproot(pkScript) {
+		// a key path spend has a single element, an annex aside
+		elements := witness
+		if len(elements) > 1 && len(elements[len(elements)-1]) > 0 && elements[len(elements)-1][0] == txscript.TaprootAnnexTag {
+			elements = elements[:len(elements)-1]
+		}
+		if len(elements) == 1 {
+			sig := elements[0]
+			if len(sig) == schnorr.SignatureSize {
+				return append(hashTypes, txscript.SigHashDefault)
+			}
+			if len(sig) == schnorr.SignatureSize+1 {
+				return append(hashTypes, txscript.SigHashType(sig[schnorr.SignatureSize]))
+			}
+		}
+		return hashTypes
+	}
+	for _, element := range witness {
+		if len(element) < 9 || element[0] != 0x30 {
+			continue
+		}
+		if _, err := ecdsa.ParseDERSignature(element[:len(element)-1]); err != nil {
+			continue
+		}
+		hashTypes = append(hashTypes, txscript.SigHashType(element[len(element)-1]))
+	}
+	return hashTypes
+}
+
+// Check verifies that modified, built from original by appending inputs and
+// outputs, keeps every signature of original valid. The sighash of each
+// original signature must allow the modification, and every original input
+// must still pass the script engine. fetcher returns the outputs spent by
+// every input of modified.
+func Check(original *wire.MsgTx, modified *wire.MsgTx, fetcher txscript.PrevOutputFetcher) *Report {
+	report := &Report{
+		AddedInputs:  len(modified.TxIn) - len(original.TxIn),
+		AddedOutputs: len(modified.TxOut) - len(original.TxOut),
+		SigHashTypes: make([][]txscript.SigHashType, len(original.TxIn)),
+	}
+	violate := func(input int, format string, args ...interface{}) {
+		report.Violations = append(report.Violations, Violation{Input: input, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	// every sighash commits to the version and locktime, and the node only
+	// ever appends inputs and outputs
+	if modified.Version != original.Version || modified.LockTime != original.LockTime {
+		violate(-1, "version or locktime changed")
+	}
+	if report.AddedInputs < 0 || report.AddedOutputs < 0 {
+		violate(-1, "inputs or outputs removed")
+		return report
+	}
+	for i, txIn := range original.TxIn {
+		modifiedIn := modified.TxIn[i]
+		if modifiedIn.PreviousOutPoint != txIn.PreviousOutPoint || modifiedIn.Sequence != txIn.Sequence ||
+			!bytes.Equal(modifiedIn.SignatureScript, txIn.SignatureScript) || !witnessEqual(modifiedIn.Witness, txIn.Witness) {
+			violate(i, "input changed")
+		}
+	}
+	for i, txOut := range original.TxOut {
+		if modified.TxOut[i].Value != txOut.Value || !bytes.Equal(modified.TxOut[i].PkScript, txOut.PkScript) {
+			violate(-1, "output %d changed", i)
+		}
+	}
+	if len(report.Violations) > 0 {
+		return report
+	}
+
+	// sighashes need the output spent by every input
+	for i, txIn := range modified.TxIn {
+		if fetcher.FetchPrevOutput(txIn.PreviousOutPoint) == nil {
+			violate(i, "spent output %s unknown", txIn.PreviousOutPoint)
+		}
+	}
+	if len(report.Violations) > 0 {
+		return report
+	}
+
+	for i, txIn := range original.TxIn {
+		prevOut := fetcher.FetchPrevOutput(txIn.PreviousOutPoint)
+		hashTypes := SigHashTypes(txIn.Witness, prevOut.PkScript)
+		report.SigHashTypes[i] = hashTypes
+		for _, hashType := range hashTypes {
+			if reason := disallowed(hashType, i, report.AddedInputs, report.AddedOutputs, len(original.TxOut)); reason != "" {
+				violate(i, "signature with sighash 0x%02x %s", uint32(hashType), reason)
+			}
+		}
+	}
+
+	modifiedHashes := txscript.NewTxSigHashes(modified, fetcher)
+	originalHashes := txscript.NewTxSigHashes(original, fetcher)
+	verify := func(tx *wire.MsgTx, sigHashes *txscript.TxSigHashes, i int) error {
+		prevOut := fetcher.FetchPrevOutput(tx.TxIn[i].PreviousOutPoint)
+		engine, err := txscript.NewEngine(prevOut.PkScript, tx, i, txscript.StandardVerifyFlags, nil, sigHashes, prevOut.Value, fetcher)
+		if err != nil {
+			return err
+		}
+		return engine.Execute()
+	}
+	for i := range original.TxIn {
+		err := verify(modified, modifiedHashes, i)
+		if err == nil {
+			continue
+		}
+		if verify(original, originalHashes, i) != nil {
+			violate(i, "script fails, already before the modification : %v", err)
+		} else {
+			violate(i, "script fails after the modification : %v", err)
+		}
+	}
+	return report
+}
+
+// disallowed returns why a signature with hashType on input i does not
+// survive adding inputs and outputs, or "" when it does.
+func disallowed(hashType txscript.SigHashType, i int, addedInputs int, addedOutputs int, outputs int) string {
+	if addedInputs > 0 && hashType&txscript.SigHashAnyOneCanPay == 0 {
+		return "commits to every input, adding fee inputs invalidates it"
+	}
+	switch hashType & sigHashMask {
+	case txscript.SigHashNone:
+		return ""
+	case txscript.SigHashSingle:
+		if i >= outputs {
+			return "has no output at its index"
+		}
+		return ""
+	default:
+		// SIGHASH_ALL, and SIGHASH_DEFAULT for taproot
+		if addedOutputs > 0 {
+			return "commits to every output, adding a change output invalidates it"
+		}
+		return ""
+	}
+}
+
+func witnessEqual(a wire.TxWitness, b wire.TxWitness) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
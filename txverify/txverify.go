@@ -0,0 +1,115 @@
+package txverify
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/twilight-project/rbf-node/types"
+)
+
+// lockTimeThreshold separates locktimes given as a block height from the
+// ones given as a unix time.
+const lockTimeThreshold = 500000000
+
+// Scripts runs every input of tx through btcd's script interpreter with the
+// standard verification flags, against the output it spends as returned by
+// fetcher. It returns a rejection for each input that fails or whose output
+// is unknown.
+func Scripts(tx *wire.MsgTx, fetcher *txscript.MultiPrevOutFetcher) []types.Rejection {
+	rejections := []types.Rejection{}
+	for i, txIn := range tx.TxIn {
+		prevOut := fetcher.FetchPrevOutput(txIn.PreviousOutPoint)
+		if prevOut == nil {
+			rejections = append(rejections, types.Rejection{
+				Kind:   types.RejectConflict,
+				Input:  i,
+				Reason: fmt.Sprintf("output %s is spent or unknown", txIn.PreviousOutPoint),
+			})
+		}
+	}
+	if len(rejections) > 0 {
+		// the sighashes need every spent output
+		return rejections
+	}
+
+	sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+	for i, txIn := range tx.TxIn {
+		prevOut := fetcher.FetchPrevOutput(txIn.PreviousOutPoint)
+		vm, err := txscript.NewEngine(prevOut.PkScript, tx, i, txscript.StandardVerifyFlags, nil, sigHashes, prevOut.Value, fetcher)
+		if err == nil {
+			err = vm.Execute()
+		}
+		if err != nil {
+			rejections = append(rejections, types.Rejection{Kind: types.RejectScript, Input: i, Reason: err.Error()})
+		}
+	}
+	return rejections
+}
+
+// Final checks the locktime of tx against the next block, at height with the
+// median time past medianTime of the current tip. Sequence locks are left to
+// the node.
+func Final(tx *wire.MsgTx, height int64, medianTime int64) *types.Rejection {
+	if tx.LockTime == 0 {
+		return nil
+	}
+	limit := height
+	unit := "height"
+	if tx.LockTime >= lockTimeThreshold {
+		limit = medianTime
+		unit = "median time"
+	}
+	if int64(tx.LockTime) < limit {
+		return nil
+	}
+	for _, txIn := range tx.TxIn {
+		if txIn.Sequence != wire.MaxTxInSequenceNum {
+			return &types.Rejection{
+				Kind:   types.RejectNonFinal,
+				Input:  -1,
+				Reason: fmt.Sprintf("locktime %d not reached at %s %d", tx.LockTime, unit, limit),
+			}
+		}
+	}
+	return nil
+}
+
+// Classify maps a reject reason of bitcoind, from testmempoolaccept or an
+// error of sendrawtransaction, to the kind of rejection.
+func Classify(reason string) types.RejectKind {
+	switch {
+	case strings.Contains(reason, "non-final"),
+		strings.Contains(reason, "non-BIP68-final"):
+		return types.RejectNonFinal
+	case strings.Contains(reason, "min relay fee not met"),
+		strings.Contains(reason, "mempool min fee not met"),
+		strings.Contains(reason, "insufficient fee"):
+		return types.RejectInsufficientFee
+	case strings.Contains(reason, "too-long-mempool-chain"):
+		return types.RejectMempoolChain
+	case strings.Contains(reason, "txn-mempool-conflict"),
+		strings.Contains(reason, "bad-txns-inputs-missingorspent"),
+		strings.Contains(reason, "missing-inputs"):
+		return types.RejectConflict
+	case strings.Contains(reason, "script-verify-flag"):
+		return types.RejectScript
+	default:
+		return types.RejectPolicy
+	}
+}
+
+// Retryable tells whether every rejection may go away without the
+// transaction changing: a locktime being reached, fees dropping or
+// ancestors confirming.
+func Retryable(rejections []types.Rejection) bool {
+	for _, rejection := range rejections {
+		switch rejection.Kind {
+		case types.RejectNonFinal, types.RejectInsufficientFee, types.RejectMempoolChain:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -1,6 +1,10 @@
 package types
 
-import "sync"
+import (
+	"fmt"
+	"sync"
+	"time"
+)
 
 /////////////////////Types//////////////////////////
 
@@ -104,6 +108,7 @@ type BroadcastRefundMsg struct {
 
 type BroadcastRefundMsgResp struct {
 	BroadcastRefundMsg []BroadcastRefundMsg
+	Pagination         Pagination
 }
 
 type BroadcastTxSweepMsg struct {
@@ -115,9 +120,232 @@ type BroadcastTxSweepMsg struct {
 
 type BroadcastSweepMsgResp struct {
 	BroadcastTxSweepMsg []BroadcastTxSweepMsg
+	Pagination          Pagination
 }
 
+type Pagination struct {
+	NextKey string `json:"next_key"`
+	Total   string `json:"total"`
+}
+
+const (
+	TxTypeSweep  = "sweep"
+	TxTypeRefund = "refund"
+)
+
+// RBFRequest asks for a replacement of the tracked transaction Txhex paying
+// Amount sats more. With DryRun the replacement is built and checked but
+// not broadcast.
 type RBFRequest struct {
 	Txhex  string
 	Amount int32
+	DryRun bool `json:"dry_run"`
+}
+
+// RBFProposal is the replacement an RBF request would broadcast and how its
+// fee breaks down, returned for dry runs.
+type RBFProposal struct {
+	Txid string `json:"txid"`
+	Hex  string `json:"hex"`
+	// OriginalFee is what the transaction pays, ReplacedFees adds its CPFP
+	// child and mempool descendants, all evicted by the replacement.
+	OriginalFee  int64 `json:"original_fee"`
+	ReplacedFees int64 `json:"replaced_fees"`
+	RequestedFee int64 `json:"requested_fee"`
+	// MinFee is the lowest fee BIP125 accepts for the replacement.
+	MinFee  int64 `json:"min_fee"`
+	Fee     int64 `json:"fee"`
+	VSize   int64 `json:"vsize"`
+	FeeRate int64 `json:"fee_rate"`
+	// AddedInputs are the wallet coins added on top of the fee inputs the
+	// transaction already spends.
+	AddedInputs    []string `json:"added_inputs"`
+	BudgetExceeded []string `json:"budget_exceeded,omitempty"`
+	Allowed        bool     `json:"allowed"`
+	RejectReason   string   `json:"reject_reason,omitempty"`
+}
+
+// ApprovalRequest approves or rejects the queued fee approval Id, Action is
+// "approve" or "reject".
+type ApprovalRequest struct {
+	Id     int64
+	Action string
+}
+
+type TxState string
+
+const (
+	TxStateReceived         TxState = "received"
+	TxStateFunded           TxState = "funded"
+	TxStateAwaitingApproval TxState = "awaiting_approval"
+	TxStateSigned           TxState = "signed"
+	TxStateWaitingForHeight TxState = "waiting_for_height"
+	TxStateBroadcast        TxState = "broadcast"
+	TxStateInMempool        TxState = "in_mempool"
+	TxStateConfirmed        TxState = "confirmed"
+	TxStateFinal            TxState = "final"
+	TxStateReplaced         TxState = "replaced"
+	TxStateConflicted       TxState = "conflicted"
+	TxStateFailed           TxState = "failed"
+)
+
+// FailureCause records why a transaction moved to failed.
+type FailureCause string
+
+const (
+	// FailureFunding is funding, fee estimation or signing failing. The
+	// transaction is funded again when nyks publishes it again.
+	FailureFunding FailureCause = "funding"
+	// FailureBroadcast is the transaction refused for good before or at
+	// broadcast.
+	FailureBroadcast FailureCause = "broadcast"
+	// FailureApprovalRejected is an operator rejecting its funding.
+	FailureApprovalRejected FailureCause = "approval_rejected"
+)
+
+// Retryable tells whether a transaction that failed for c is funded again.
+// Rows that failed before causes were recorded have none and are retried.
+func (c FailureCause) Retryable() bool {
+	return c == "" || c == FailureFunding
+}
+
+// TrackedTx is a row of the signed_tx table. NyksTx holds the transaction as
+// published on nyks while Tx holds the fee bumped version we broadcast.
+type TrackedTx struct {
+	Id           int64
+	Txid         string
+	Tx           []byte
+	NyksTx       []byte
+	NyksTxid     string
+	UnlockHeight int64
+	// DeadlineHeight is the height by which the transaction has to confirm,
+	// 0 when it only has the deadline of the fee bump policy.
+	DeadlineHeight int64
+	ReserveId      string
+	RoundId        string
+	TxType         string
+	State          TxState
+	Confirmations  int64
+	Fee            int64
+	ReplacedBy     int64
+	BlockHash      string
+	BlockHeight    int64
+	// BroadcastHeight is the block height at which this version of the
+	// transaction was broadcast or last paid for by a CPFP child, BumpCount
+	// the number of fee bumps before it.
+	BroadcastHeight int64
+	BumpCount       int64
+	// ChildTx is the CPFP child paying for the transaction, if any.
+	ChildTx   []byte
+	ChildTxid string
+	ChildFee  int64
+	// Rejections holds why the last attempt to broadcast the transaction,
+	// or a replacement or child paying for it, was refused.
+	Rejections []Rejection
+	// Failure is why the transaction is failed, empty in any other state.
+	Failure   FailureCause
+	UpdatedAt time.Time
+}
+
+// RejectKind classifies why a transaction was refused before or at
+// broadcast.
+type RejectKind string
+
+const (
+	// RejectScript is an input failing the script interpreter.
+	RejectScript RejectKind = "script_failure"
+	// RejectNonFinal is a locktime or sequence lock not reached yet.
+	RejectNonFinal RejectKind = "non_final"
+	// RejectInsufficientFee is a fee below the relay or mempool minimum.
+	RejectInsufficientFee RejectKind = "insufficient_fee"
+	// RejectMempoolChain is an unconfirmed ancestor or descendant chain
+	// over the mempool limits.
+	RejectMempoolChain RejectKind = "too_long_mempool_chain"
+	// RejectConflict is an input already spent or unknown.
+	RejectConflict RejectKind = "conflict"
+	// RejectPolicy is any other standardness or policy rule.
+	RejectPolicy RejectKind = "policy"
+)
+
+// Rejection is a reason a transaction cannot be broadcast. Input is the
+// index of the failing input, -1 when the whole transaction is rejected.
+type Rejection struct {
+	Kind   RejectKind `json:"kind"`
+	Input  int        `json:"input"`
+	Reason string     `json:"reason"`
+}
+
+func (r Rejection) String() string {
+	if r.Input < 0 {
+		return fmt.Sprintf("%s : %s", r.Kind, r.Reason)
+	}
+	return fmt.Sprintf("%s on input %d : %s", r.Kind, r.Input, r.Reason)
+}
+
+// UtxoLease reserves a wallet coin, identified by its "txid:vout" outpoint,
+// for the fee inputs of a tracked transaction. A released lease is kept until
+// the coin is unlocked in the wallet again.
+type UtxoLease struct {
+	OutPoint    string
+	TrackedTxId int64
+	Released    bool
+	CreatedAt   time.Time
+}
+
+// ApprovalKind is the fee spending an approval holds back.
+type ApprovalKind string
+
+const (
+	// ApprovalFund is the funding of a transaction received from nyks.
+	ApprovalFund ApprovalKind = "fund"
+	// ApprovalRBF is a replacement of a broadcast transaction.
+	ApprovalRBF ApprovalKind = "rbf"
+	// ApprovalCPFP is a child paying for a broadcast transaction.
+	ApprovalCPFP ApprovalKind = "cpfp"
+	// ApprovalPackage is a child submitted as a package with a transaction
+	// below the mempool minimum.
+	ApprovalPackage ApprovalKind = "package"
+)
+
+type ApprovalStatus string
+
+const (
+	ApprovalPending  ApprovalStatus = "pending"
+	ApprovalApproved ApprovalStatus = "approved"
+	ApprovalExecuted ApprovalStatus = "executed"
+	ApprovalRejected ApprovalStatus = "rejected"
+	ApprovalFailed   ApprovalStatus = "failed"
+)
+
+// FeeApproval is a fee spending over the budget limits, queued with the
+// signed transaction until an operator approves or rejects it. Spend is what
+// the wallet would pay on top of what the tracked transaction already pays.
+type FeeApproval struct {
+	Id          int64          `json:"id"`
+	TrackedTxId int64          `json:"tracked_tx_id"`
+	Kind        ApprovalKind   `json:"kind"`
+	Tx          []byte         `json:"-"`
+	Txid        string         `json:"txid"`
+	Fee         int64          `json:"fee"`
+	FeeRate     int64          `json:"fee_rate"`
+	Spend       int64          `json:"spend"`
+	Reason      string         `json:"reason"`
+	Status      ApprovalStatus `json:"status"`
+	CreatedAt   time.Time      `json:"created_at"`
+	DecidedAt   time.Time      `json:"decided_at"`
+}
+
+// SimulatedBroadcast is a transaction the node would have broadcast in dry
+// run mode, with the testmempoolaccept verdict on it. Package is set for the
+// transactions of a package submitted together.
+type SimulatedBroadcast struct {
+	Id           int64     `json:"id"`
+	Txid         string    `json:"txid"`
+	Tx           []byte    `json:"-"`
+	Package      bool      `json:"package"`
+	Allowed      bool      `json:"allowed"`
+	RejectReason string    `json:"reject_reason,omitempty"`
+	VSize        int64     `json:"vsize"`
+	Fee          int64     `json:"fee"`
+	CreatedAt    time.Time `json:"created_at"`
 }
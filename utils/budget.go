@@ -0,0 +1,284 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/twilight-project/rbf-node/alert"
+	"github.com/twilight-project/rbf-node/db"
+	"github.com/twilight-project/rbf-node/feebudget"
+	"github.com/twilight-project/rbf-node/pinning"
+	"github.com/twilight-project/rbf-node/types"
+)
+
+// ErrApprovalRequired is returned when a fee is over the budget limits and
+// was queued for approval instead of being paid.
+var ErrApprovalRequired = errors.New("fee over budget, queued for approval")
+
+// authorizeFee checks spend against the budget limits. Over them the signed
+// tx, paying txFee, is queued for approval and an error wrapping
+// ErrApprovalRequired is returned. The wallet coins of tx stay leased to the
+// tracked transaction until the approval is decided.
+func authorizeFee(store db.Store, tracked types.TrackedTx, kind types.ApprovalKind, tx *wire.MsgTx, txFee int64, spend feebudget.Spend) error {
+	spent, err := store.FeeSpentSince(time.Now().UTC().Add(-feebudget.Window))
+	if err != nil {
+		return err
+	}
+	spend.Spent = spent
+	exceeded := feebudget.NewLimits().Check(spend)
+	if len(exceeded) == 0 {
+		return nil
+	}
+
+	raw, err := serializeTx(tx)
+	if err != nil {
+		return err
+	}
+	reason := feebudget.Reason(exceeded)
+	id, err := store.InsertFeeApproval(types.FeeApproval{
+		TrackedTxId: tracked.Id,
+		Kind:        kind,
+		Tx:          raw,
+		Txid:        tx.TxHash().String(),
+		Fee:         txFee,
+		FeeRate:     spend.FeeRate(),
+		Spend:       spend.Added,
+		Reason:      reason,
+	})
+	if err != nil {
+		return err
+	}
+	alert.Notify(alert.Event{
+		Type:      alert.FeeApprovalRequired,
+		Severity:  alert.Warning,
+		Txid:      tracked.Txid,
+		ReserveId: tracked.ReserveId,
+		RoundId:   tracked.RoundId,
+		Reason:    string(kind),
+		Message:   fmt.Sprintf("%s of %s transaction paying %d sats queued as approval %d : %s", kind, tracked.TxType, spend.Fee, id, reason),
+		Details:   map[string]interface{}{"approval": id, "kind": kind, "fee": spend.Fee, "fee_rate": spend.FeeRate(), "spend": spend.Added},
+	})
+	return fmt.Errorf("%w : approval %d, %s", ErrApprovalRequired, id, reason)
+}
+
+// recordFeeSpend adds amount to the ledger the daily cap is checked against.
+func recordFeeSpend(store db.Store, id int64, amount int64) {
+	if amount <= 0 {
+		return
+	}
+	err := store.RecordFeeSpend(id, amount)
+	if err != nil {
+		fmt.Println("Failed to record fee spend : ", err)
+	}
+}
+
+// sweepValue is the value moved by the nyks transaction, which the fee
+// percentage limit applies to.
+func sweepValue(nyksTx []byte) int64 {
+	tx, err := deserializeTx(nyksTx)
+	if err != nil {
+		return 0
+	}
+	return outputValue(tx)
+}
+
+func outputValue(tx *wire.MsgTx) int64 {
+	value := int64(0)
+	for _, txOut := range tx.TxOut {
+		value += txOut.Value
+	}
+	return value
+}
+
+// AuthorizeFunding checks the fee inputs added to a transaction received
+// from nyks against the budget. Over it the signed transaction is queued for
+// approval and an error wrapping ErrApprovalRequired is returned, otherwise
+// the fee is recorded as spent.
+func AuthorizeFunding(store db.Store, id int64, reserveId string, roundId string, txType string, nyksTx *wire.MsgTx, signed *wire.MsgTx, fee int64) error {
+	tracked := types.TrackedTx{Id: id, Txid: signed.TxHash().String(), ReserveId: reserveId, RoundId: roundId, TxType: txType}
+	spend := feebudget.Spend{Fee: fee, VSize: pinning.VirtualSize(signed), Value: outputValue(nyksTx), Added: fee}
+	err := authorizeFee(store, tracked, types.ApprovalFund, signed, fee, spend)
+	if err != nil {
+		return err
+	}
+	recordFeeSpend(store, id, fee)
+	return nil
+}
+
+// pendingApprovals returns the tracked transactions with an approval
+// pending.
+func pendingApprovals(store db.Store) map[int64]bool {
+	pending := make(map[int64]bool)
+	approvals, err := store.ListFeeApprovals(types.ApprovalPending)
+	if err != nil {
+		fmt.Println("Failed to list fee approvals : ", err)
+		return pending
+	}
+	for _, approval := range approvals {
+		pending[approval.TrackedTxId] = true
+	}
+	return pending
+}
+
+// latestApproval returns the most recent approval of kind for the tracked
+// transaction, or nil.
+func latestApproval(store db.Store, id int64, kind types.ApprovalKind) (*types.FeeApproval, error) {
+	approvals, err := store.ListFeeApprovals()
+	if err != nil {
+		return nil, err
+	}
+	var latest *types.FeeApproval
+	for i := range approvals {
+		if approvals[i].TrackedTxId == id && approvals[i].Kind == kind {
+			latest = &approvals[i]
+		}
+	}
+	return latest, nil
+}
+
+// checkNoPendingApproval fails when the tracked transaction already waits for
+// an approval, so no other fee spending is queued or paid behind it.
+func checkNoPendingApproval(store db.Store, id int64) error {
+	if pendingApprovals(store)[id] {
+		return fmt.Errorf("%w : an approval is already pending for tracked tx %d", ErrApprovalRequired, id)
+	}
+	return nil
+}
+
+// ApproveFee pays the fee held by a pending approval. Funding lets the
+// transaction be broadcast, replacements and children are broadcast right
+// away. A package child is submitted with its parent by the broadcaster.
+func ApproveFee(store db.Store, id int64) error {
+	approval, tracked, tx, err := loadApproval(store, id)
+	if err != nil {
+		return err
+	}
+	err = store.UpdateFeeApprovalStatus(id, types.ApprovalPending, types.ApprovalApproved)
+	if err != nil {
+		return err
+	}
+	if approval.Kind == types.ApprovalPackage {
+		return nil
+	}
+
+	client := getBitcoinRpcClient()
+	defer client.Shutdown()
+	err = executeApproval(client, store, approval, tracked, tx)
+	status := types.ApprovalExecuted
+	if err != nil {
+		status = types.ApprovalFailed
+	}
+	statusErr := store.UpdateFeeApprovalStatus(id, types.ApprovalApproved, status)
+	if err != nil {
+		return err
+	}
+	return statusErr
+}
+
+// RejectFee drops a pending approval and releases the wallet coins of its
+// transaction. A transaction waiting for its funding to be approved fails.
+func RejectFee(store db.Store, id int64) error {
+	approval, tracked, tx, err := loadApproval(store, id)
+	if err != nil {
+		return err
+	}
+	err = store.UpdateFeeApprovalStatus(id, types.ApprovalPending, types.ApprovalRejected)
+	if err != nil {
+		return err
+	}
+
+	client := getBitcoinRpcClient()
+	defer client.Shutdown()
+	discardApproval(client, store, approval, tracked, tx)
+	return nil
+}
+
+func loadApproval(store db.Store, id int64) (*types.FeeApproval, *types.TrackedTx, *wire.MsgTx, error) {
+	approval, err := store.GetFeeApproval(id)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if approval == nil {
+		return nil, nil, nil, fmt.Errorf("fee approval %d not found", id)
+	}
+	if approval.Status != types.ApprovalPending {
+		return nil, nil, nil, fmt.Errorf("fee approval %d is %s", id, approval.Status)
+	}
+	tracked, err := getTrackedTx(store, approval.TrackedTxId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	tx, err := deserializeTx(approval.Tx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return approval, tracked, tx, nil
+}
+
+func getTrackedTx(store db.Store, id int64) (*types.TrackedTx, error) {
+	txs, err := store.ListTrackedTx()
+	if err != nil {
+		return nil, err
+	}
+	for i := range txs {
+		if txs[i].Id == id {
+			return &txs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("tracked tx %d not found", id)
+}
+
+func executeApproval(client *rpcclient.Client, store db.Store, approval *types.FeeApproval, tracked *types.TrackedTx, tx *wire.MsgTx) error {
+	if approval.Kind == types.ApprovalFund {
+		err := store.TransitionTx(tracked.Id, types.TxStateSigned, 0)
+		if err != nil {
+			return err
+		}
+		recordFeeSpend(store, tracked.Id, approval.Spend)
+		return nil
+	}
+
+	if tracked.State != types.TxStateBroadcast && tracked.State != types.TxStateInMempool {
+		discardApproval(client, store, approval, tracked, tx)
+		return fmt.Errorf("tracked tx %d is %s, the %s is no longer needed", tracked.Id, tracked.State, approval.Kind)
+	}
+	current, err := deserializeTx(tracked.Tx)
+	if err != nil {
+		return err
+	}
+	height, err := client.GetBlockCount()
+	if err != nil {
+		discardApproval(client, store, approval, tracked, tx)
+		return err
+	}
+	switch approval.Kind {
+	case types.ApprovalRBF:
+		_, err = broadcastReplacement(client, store, *tracked, current, tx, approval.Fee, height)
+	case types.ApprovalCPFP:
+		err = broadcastChild(client, store, *tracked, current, tx, approval.Fee, height)
+	default:
+		err = fmt.Errorf("unknown approval kind %s", approval.Kind)
+	}
+	return err
+}
+
+// discardApproval gives back what an approval held.
+func discardApproval(client *rpcclient.Client, store db.Store, approval *types.FeeApproval, tracked *types.TrackedTx, tx *wire.MsgTx) {
+	if approval.Kind == types.ApprovalFund {
+		if tracked.State == types.TxStateAwaitingApproval {
+			// not funded again when nyks publishes it again
+			_ = store.FailTx(tracked.Id, types.FailureApprovalRejected)
+		}
+		return
+	}
+	// the replacement reuses the fee inputs of the current version, only
+	// the coins added for it are given back
+	base, err := deserializeTx(tracked.Tx)
+	if err != nil {
+		return
+	}
+	releaseCoins(client, store, addedInputs(tx, base))
+}
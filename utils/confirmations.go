@@ -0,0 +1,313 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/spf13/viper"
+	"github.com/twilight-project/rbf-node/alert"
+	"github.com/twilight-project/rbf-node/chainnotify"
+	"github.com/twilight-project/rbf-node/db"
+	"github.com/twilight-project/rbf-node/types"
+)
+
+func finalConfirmations() int64 {
+	depth := viper.GetInt64("final_confirmations")
+	if depth <= 0 {
+		depth = 6
+	}
+	return depth
+}
+
+// ConfirmTx follows every broadcast transaction into a block and on to the
+// configured final depth. The block each transaction was mined in is
+// recorded so a reorg that removes it from the best chain can be detected,
+// in which case the transaction is pushed back to the mempool state or to the
+// broadcaster. It runs on every block event and every
+// confirm_interval_seconds.
+func ConfirmTx(store db.Store, events <-chan chainnotify.Event) {
+	client := getBitcoinRpcClient()
+	defer client.Shutdown()
+	idle := configuredInterval("confirm_interval_seconds", 30*time.Second)
+	warnWithoutTxIndex(client)
+
+	for {
+		confirmTrackedTxs(client, store)
+		chainnotify.Wait(events, idle, func(e chainnotify.Event) bool {
+			return e.Type == chainnotify.BlockConnected || e.Type == chainnotify.BlockDisconnected
+		})
+	}
+}
+
+func confirmTrackedTxs(client *rpcclient.Client, store db.Store) {
+	txs, err := store.QueryTrackedTxByState(types.TxStateBroadcast, types.TxStateInMempool, types.TxStateConfirmed, types.TxStateReplaced)
+	if err != nil {
+		return
+	}
+
+	for _, tx := range txs {
+		err := trackConfirmations(client, store, tx)
+		if err != nil {
+			fmt.Printf("Failed to track confirmations of %s : %v\n", tx.Txid, err)
+		}
+	}
+}
+
+func trackConfirmations(client *rpcclient.Client, store db.Store, tx types.TrackedTx) error {
+	if tx.State == types.TxStateConfirmed && tx.BlockHash != "" {
+		reorged, err := handleReorg(client, store, tx)
+		if err != nil || reorged {
+			return err
+		}
+	}
+
+	minedIn, err := locateTx(client, tx)
+	if err != nil && tx.State == types.TxStateReplaced {
+		// its replacement is the one expected to confirm
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if minedIn == "" {
+		if tx.State == types.TxStateBroadcast {
+			return store.TransitionTx(tx.Id, types.TxStateInMempool, 0)
+		}
+		return nil
+	}
+
+	blockHash, err := chainhash.NewHashFromStr(minedIn)
+	if err != nil {
+		return err
+	}
+	header, err := client.GetBlockHeaderVerbose(blockHash)
+	if err != nil {
+		return err
+	}
+	if header.Confirmations < 1 {
+		// the block is no longer part of the best chain, wait for the node to
+		// return the transaction to its mempool or mine it again
+		return nil
+	}
+
+	if tx.BlockHash != minedIn {
+		fmt.Printf("Transaction %s mined in block %s at height %d\n", tx.Txid, minedIn, header.Height)
+		err = store.SetTrackedTxBlock(tx.Id, minedIn, int64(header.Height))
+		if err != nil {
+			return err
+		}
+	}
+
+	if tx.ReplacedBy != 0 {
+		err = dropReplacements(store, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	confirmations := header.Confirmations
+	if confirmations >= finalConfirmations() {
+		if tx.State != types.TxStateConfirmed {
+			err = store.TransitionTx(tx.Id, types.TxStateConfirmed, confirmations)
+			if err != nil {
+				return err
+			}
+		}
+		return store.TransitionTx(tx.Id, types.TxStateFinal, confirmations)
+	}
+	if tx.Confirmations != confirmations || tx.State != types.TxStateConfirmed {
+		fmt.Printf("Transaction %s confirmed with %d confirmations\n", tx.Txid, confirmations)
+		return store.TransitionTx(tx.Id, types.TxStateConfirmed, confirmations)
+	}
+	return nil
+}
+
+// dropReplacements moves the replacements of tx, which got mined instead,
+// to conflicted so they are no longer bumped and their leases are released.
+func dropReplacements(store db.Store, tx types.TrackedTx) error {
+	for id := tx.ReplacedBy; id != 0; {
+		replacement, err := store.GetTrackedTx(id)
+		if err != nil || replacement == nil {
+			return err
+		}
+		if replacement.State == types.TxStateBroadcast || replacement.State == types.TxStateInMempool {
+			fmt.Printf("Transaction %s was mined instead of its replacement %s\n", tx.Txid, replacement.Txid)
+			err = store.TransitionTx(replacement.Id, types.TxStateConflicted, 0)
+			if err != nil {
+				return err
+			}
+			alert.Notify(alert.Event{
+				Type:      alert.TxConflicted,
+				Severity:  alert.Warning,
+				Txid:      replacement.Txid,
+				ReserveId: replacement.ReserveId,
+				RoundId:   replacement.RoundId,
+				Reason:    tx.Txid,
+				Message:   fmt.Sprintf("replaced %s transaction %s was mined instead", tx.TxType, tx.Txid),
+			})
+		}
+		id = replacement.ReplacedBy
+	}
+	return nil
+}
+
+// handleReorg checks that the block a confirmed transaction was mined in is
+// still part of the best chain. If it is not, the recorded block is cleared
+// and the transaction goes back to in_mempool when the node still has it or
+// to signed so the broadcaster sends it again.
+func handleReorg(client *rpcclient.Client, store db.Store, tx types.TrackedTx) (bool, error) {
+	blockHash, err := chainhash.NewHashFromStr(tx.BlockHash)
+	if err != nil {
+		return false, err
+	}
+	header, err := client.GetBlockHeaderVerbose(blockHash)
+	if err == nil && header.Confirmations >= 1 {
+		return false, nil
+	}
+
+	fmt.Printf("Block %s of transaction %s left the best chain\n", tx.BlockHash, tx.Txid)
+	alert.Notify(alert.Event{
+		Type:      alert.ReorgDetected,
+		Severity:  alert.Warning,
+		Txid:      tx.Txid,
+		ReserveId: tx.ReserveId,
+		RoundId:   tx.RoundId,
+		Message:   fmt.Sprintf("block %s at height %d left the best chain", tx.BlockHash, tx.BlockHeight),
+	})
+	err = store.SetTrackedTxBlock(tx.Id, "", 0)
+	if err != nil {
+		return true, err
+	}
+
+	_, err = client.GetMempoolEntry(tx.Txid)
+	if err == nil {
+		return true, store.TransitionTx(tx.Id, types.TxStateInMempool, 0)
+	}
+
+	reorged := tx
+	reorged.BlockHash = ""
+	minedIn, err := locateTx(client, reorged)
+	if err == nil && minedIn != "" && minedIn != tx.BlockHash {
+		// mined again in a block of the new best chain, picked up next round
+		return true, nil
+	}
+
+	fmt.Printf("Transaction %s dropped out after reorg, handing it back to the broadcaster\n", tx.Txid)
+	return true, store.TransitionTx(tx.Id, types.TxStateSigned, 0)
+}
+
+// locateTx returns the hash of the block tx was mined in, empty while it is
+// in the mempool. Without -txindex bitcoind only finds confirmed
+// transactions in a known block or in the wallet, so the block is otherwise
+// worked out from an unspent output of tx.
+func locateTx(client *rpcclient.Client, tx types.TrackedTx) (string, error) {
+	_, err := client.GetMempoolEntry(tx.Txid)
+	if err == nil {
+		return "", nil
+	}
+	txHash, err := chainhash.NewHashFromStr(tx.Txid)
+	if err != nil {
+		return "", err
+	}
+
+	if tx.BlockHash != "" {
+		// hex strings need no escaping
+		params := []json.RawMessage{json.RawMessage(`"` + tx.Txid + `"`), json.RawMessage("true"), json.RawMessage(`"` + tx.BlockHash + `"`)}
+		raw, err := client.RawRequest("getrawtransaction", params)
+		if err == nil {
+			result := struct {
+				BlockHash string `json:"blockhash"`
+			}{}
+			if json.Unmarshal(raw, &result) == nil && result.BlockHash != "" {
+				return result.BlockHash, nil
+			}
+		}
+	}
+
+	walletTx, err := client.GetTransaction(txHash)
+	if err == nil && walletTx.BlockHash != "" {
+		return walletTx.BlockHash, nil
+	}
+
+	wireTx, err := deserializeTx(tx.Tx)
+	if err == nil {
+		blockHash, err := utxoBlockHash(client, txHash, len(wireTx.TxOut))
+		if err != nil {
+			return "", err
+		}
+		if blockHash != "" {
+			return blockHash, nil
+		}
+	}
+
+	verbose, err := client.GetRawTransactionVerbose(txHash)
+	if err != nil {
+		return "", fmt.Errorf("not in the mempool, the wallet or the utxo set and not found without txindex : %v", err)
+	}
+	return verbose.BlockHash, nil
+}
+
+// utxoBlockHash finds the block tx was mined in from the confirmations of
+// one of its outputs in the utxo set, empty when they are all spent.
+func utxoBlockHash(client *rpcclient.Client, txHash *chainhash.Hash, outputs int) (string, error) {
+	for i := 0; i < outputs; i++ {
+		height, err := outputHeight(client, *wire.NewOutPoint(txHash, uint32(i)))
+		if err != nil {
+			return "", err
+		}
+		if height == 0 {
+			continue
+		}
+		blockHash, err := client.GetBlockHash(height)
+		if err != nil {
+			return "", err
+		}
+		return blockHash.String(), nil
+	}
+	return "", nil
+}
+
+// outputHeight returns the height of the block that confirmed the unspent
+// output at outPoint, 0 when it is unconfirmed, spent or unknown.
+func outputHeight(client *rpcclient.Client, outPoint wire.OutPoint) (int64, error) {
+	utxo, err := client.GetTxOut(&outPoint.Hash, outPoint.Index, false)
+	if err != nil {
+		return 0, err
+	}
+	if utxo == nil || utxo.Confirmations < 1 {
+		return 0, nil
+	}
+	bestBlock, err := chainhash.NewHashFromStr(utxo.BestBlock)
+	if err != nil {
+		return 0, err
+	}
+	best, err := client.GetBlockHeaderVerbose(bestBlock)
+	if err != nil {
+		return 0, err
+	}
+	return int64(best.Height) - utxo.Confirmations + 1, nil
+}
+
+// warnWithoutTxIndex tells the operator when bitcoind runs without
+// -txindex, confirmed transactions whose outputs are all spent and that the
+// wallet does not know can then no longer be found.
+func warnWithoutTxIndex(client *rpcclient.Client) {
+	raw, err := client.RawRequest("getindexinfo", nil)
+	if err != nil {
+		fmt.Println("Failed to get index info : ", err)
+		return
+	}
+	indexes := make(map[string]json.RawMessage)
+	err = json.Unmarshal(raw, &indexes)
+	if err != nil {
+		fmt.Println("Failed to get index info : ", err)
+		return
+	}
+	if _, ok := indexes["txindex"]; !ok {
+		fmt.Println("Warning : bitcoind runs without -txindex, confirmations are followed through the wallet and the utxo set")
+	}
+}
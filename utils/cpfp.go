@@ -0,0 +1,309 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/twilight-project/rbf-node/alert"
+	"github.com/twilight-project/rbf-node/coinselect"
+	"github.com/twilight-project/rbf-node/db"
+	"github.com/twilight-project/rbf-node/feebudget"
+	"github.com/twilight-project/rbf-node/feebump"
+	"github.com/twilight-project/rbf-node/feemath"
+	"github.com/twilight-project/rbf-node/pinning"
+	"github.com/twilight-project/rbf-node/types"
+)
+
+// estimatedChildVSize is the size of a child spending the parent output
+// paying to pkScript to a change output, used to price CPFP before the child
+// is built.
+func estimatedChildVSize(pkScript []byte) int64 {
+	weight := coinselect.TxOverheadWeight + coinselect.InputWeightSigHash(coinselect.ScriptTypeOf(pkScript), txscript.SigHashDefault) + coinselect.OutputWeight(coinselect.ChangeType())
+	return feemath.VSize(weight)
+}
+
+// trucChildMaxVSize is the BIP431 size limit of a child of a v3 transaction.
+const trucChildMaxVSize = 1000
+
+// cpfpOption prices a child paying for the transaction and returns the
+// wallet output it would spend. It is blocked when no output of the
+// transaction belongs to the wallet, the descendant limits leave no room for
+// a child or the cap does not cover it.
+func cpfpOption(client *rpcclient.Client, policy *feebump.Policy, tracked types.TrackedTx, parent *wire.MsgTx, state feebump.State, feeRate int64, findings []pinning.Finding) (feebump.Option, uint32) {
+	option := feebump.Option{Mode: feebump.CPFP}
+	for _, finding := range findings {
+		if finding.Kind == pinning.DescendantLimit {
+			option.Blocked = finding.Detail
+			return option, 0
+		}
+	}
+	vout, ok := cpfpOutput(client, tracked, parent)
+	if !ok {
+		option.Blocked = "no output pays to the wallet"
+		return option, 0
+	}
+
+	childVSize := state.ChildVSize
+	if childVSize == 0 {
+		childVSize = estimatedChildVSize(parent.TxOut[vout].PkScript)
+	}
+	fee, ok := policy.ChildFee(state, childVSize, feeRate)
+	if !ok {
+		option.Blocked = fmt.Sprintf("child needs %d sats, cap is %d sats", state.Fee+fee, policy.MaxFee)
+		return option, vout
+	}
+	option.Fee = fee
+	option.Total = state.Fee + fee
+	return option, vout
+}
+
+// cpfpOutput finds the output of parent owned by the wallet, the sweep
+// output itself or the change of the fee inputs. An output already spent by
+// our previous child is reused so the new child replaces it.
+func cpfpOutput(client *rpcclient.Client, tracked types.TrackedTx, parent *wire.MsgTx) (uint32, bool) {
+	parentHash := parent.TxHash()
+	if len(tracked.ChildTx) > 0 {
+		child, err := deserializeTx(tracked.ChildTx)
+		if err == nil {
+			for _, txIn := range child.TxIn {
+				if txIn.PreviousOutPoint.Hash == parentHash {
+					return txIn.PreviousOutPoint.Index, true
+				}
+			}
+		}
+	}
+
+	utxos, err := client.ListUnspentMinMax(0, 0)
+	if err != nil {
+		fmt.Println("Failed to get unspent UTXOs: ", err)
+		return 0, false
+	}
+	for _, utxo := range utxos {
+		if utxo.TxID == parentHash.String() && utxo.Spendable && int(utxo.Vout) < len(parent.TxOut) {
+			return utxo.Vout, true
+		}
+	}
+	return 0, false
+}
+
+// PayForTrackedTx broadcasts a child spending output vout of the tracked
+// transaction which brings the package to feeRate, replacing the previous
+// child if there is one. A child over the fee budget is queued for approval
+// instead.
+func PayForTrackedTx(client *rpcclient.Client, store db.Store, policy *feebump.Policy, tracked types.TrackedTx, state feebump.State, vout uint32, feeRate int64, height int64) error {
+	err := checkNoPendingApproval(store, tracked.Id)
+	if err != nil {
+		return err
+	}
+	parent, err := deserializeTx(tracked.Tx)
+	if err != nil {
+		return err
+	}
+
+	child, fee, err := buildChildAtFeeRate(client, store, tracked.Id, policy, state, parent, vout, feeRate)
+	if err != nil {
+		return err
+	}
+
+	spend := feebudget.Spend{
+		Fee:   tracked.Fee + fee,
+		VSize: pinning.VirtualSize(parent) + pinning.VirtualSize(child),
+		Value: sweepValue(tracked.NyksTx),
+		Added: fee - tracked.ChildFee,
+	}
+	err = authorizeFee(store, tracked, types.ApprovalCPFP, child, fee, spend)
+	if err != nil {
+		if !errors.Is(err, ErrApprovalRequired) {
+			releaseCoins(client, store, addedInputs(child, parent))
+		}
+		return err
+	}
+	return broadcastChild(client, store, tracked, parent, child, fee, height)
+}
+
+// broadcastChild broadcasts the signed child paying fee for the tracked
+// transaction and tracks it.
+func broadcastChild(client *rpcclient.Client, store db.Store, tracked types.TrackedTx, parent *wire.MsgTx, child *wire.MsgTx, fee int64, height int64) error {
+	_, err := BroadcastBtcTransaction(store, child)
+	if err != nil {
+		releaseCoins(client, store, addedInputs(child, parent))
+		recordRejections(store, tracked, err)
+		return fmt.Errorf("child could not be broadcast : %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = child.Serialize(&buf)
+	if err != nil {
+		return err
+	}
+	err = store.SetTrackedTxChild(tracked.Id, buf.Bytes(), child.TxHash().String(), fee)
+	if err != nil {
+		fmt.Println("Failed to track CPFP transaction: ", err)
+		return err
+	}
+	recordFeeSpend(store, tracked.Id, fee-tracked.ChildFee)
+	err = store.SetTrackedTxBroadcastHeight(tracked.Id, height)
+	if err != nil {
+		return err
+	}
+
+	feeRate := (tracked.Fee + fee) * 1000 / (pinning.VirtualSize(parent) + pinning.VirtualSize(child))
+	fmt.Printf("Broadcasted CPFP transaction with txid %s\n", child.TxHash().String())
+	alert.Notify(alert.Event{
+		Type:      alert.FeeBumped,
+		Severity:  alert.Info,
+		Txid:      tracked.Txid,
+		ReserveId: tracked.ReserveId,
+		RoundId:   tracked.RoundId,
+		Reason:    child.TxHash().String(),
+		Message:   fmt.Sprintf("child %s pays %d sats for %s", child.TxHash().String(), fee, tracked.Txid),
+		Details:   map[string]interface{}{"mode": feebump.CPFP, "child": child.TxHash().String(), "replaced_child": tracked.ChildTxid, "child_fee": fee, "package_feerate": feeRate},
+	})
+	return nil
+}
+
+// buildChildAtFeeRate builds a child bringing the package to feeRate,
+// rebuilding it once if the signed child is larger than estimated.
+func buildChildAtFeeRate(client *rpcclient.Client, store db.Store, id int64, policy *feebump.Policy, state feebump.State, parent *wire.MsgTx, vout uint32, feeRate int64) (*wire.MsgTx, int64, error) {
+	// the size of the previous child may include wallet inputs, the ones
+	// selected now pay for themselves
+	childVSize := estimatedChildVSize(parent.TxOut[vout].PkScript)
+	for attempt := 0; attempt < 2; attempt++ {
+		fee, ok := policy.ChildFee(state, childVSize, feeRate)
+		if !ok {
+			return nil, 0, fmt.Errorf("child needs %d sats, cap is %d sats", state.Fee+fee, policy.MaxFee)
+		}
+		child, paid, addedWeight, err := buildChild(client, store, id, parent, vout, fee, feeRate)
+		if err != nil {
+			return nil, 0, err
+		}
+		estimated := childVSize + feemath.VSize(addedWeight)
+		measured := pinning.VirtualSize(child)
+		if parent.Version == 3 && measured > trucChildMaxVSize {
+			releaseCoins(client, store, addedInputs(child, parent))
+			return nil, 0, fmt.Errorf("child of %d vbytes exceeds the %d vbytes allowed for a v3 child", measured, trucChildMaxVSize)
+		}
+		if state.Fee+paid > policy.MaxFee {
+			releaseCoins(client, store, addedInputs(child, parent))
+			return nil, 0, fmt.Errorf("child needs %d sats, cap is %d sats", state.Fee+paid, policy.MaxFee)
+		}
+		if measured <= estimated {
+			return child, paid, nil
+		}
+		releaseCoins(client, store, addedInputs(child, parent))
+		childVSize += measured - estimated
+	}
+	return nil, 0, fmt.Errorf("could not build a child paying enough fee")
+}
+
+// buildChild spends output vout of parent back to the wallet paying fee.
+// When the output does not cover it, confirmed wallet inputs leased to the
+// tracked transaction id are picked with coinselect, each paying for its own
+// weight at feeRate. It returns the child, the fee it pays and the weight of
+// the inputs it added.
+func buildChild(client *rpcclient.Client, store db.Store, id int64, parent *wire.MsgTx, vout uint32, fee int64, feeRate int64) (*wire.MsgTx, int64, int64, error) {
+	if int(vout) >= len(parent.TxOut) {
+		return nil, 0, 0, fmt.Errorf("parent has no output %d", vout)
+	}
+	parentHash := parent.TxHash()
+	// a v3 (TRUC) parent can only have a v3 child
+	version := int32(2)
+	if parent.Version == 3 {
+		version = 3
+	}
+	tx := wire.NewMsgTx(version)
+	txIn := wire.NewTxIn(wire.NewOutPoint(&parentHash, vout), nil, nil)
+	txIn.Sequence = wire.MaxTxInSequenceNum - 2
+	tx.AddTxIn(txIn)
+	total := parent.TxOut[vout].Value
+	addedWeight := int64(0)
+
+	if total-fee < changeDustLimit {
+		// the output of the child is already priced in fee, the selected
+		// coins only have to bring it above dust
+		missing := fee + changeDustLimit - total
+		var selection *coinselect.Selection
+		listUtxos := func() ([]btcjson.ListUnspentResult, error) {
+			return client.ListUnspent()
+		}
+		_, err := reserveCoins(client, store, id, listUtxos, func(utxos []btcjson.ListUnspentResult) ([]wire.OutPoint, error) {
+			coins := []coinselect.Coin{}
+			for _, utxo := range utxos {
+				if utxo.TxID == parentHash.String() {
+					continue
+				}
+				hash, err := chainhash.NewHashFromStr(utxo.TxID)
+				if err != nil {
+					return nil, err
+				}
+				pkScript, err := hex.DecodeString(utxo.ScriptPubKey)
+				if err != nil {
+					return nil, err
+				}
+				coins = append(coins, coinselect.NewCoin(*wire.NewOutPoint(hash, utxo.Vout), BtcToSats(utxo.Amount), pkScript))
+			}
+
+			algorithm, longTermFeeRate := coinSelectionParams()
+			params := coinselect.Params{
+				Target:          missing,
+				FeeRate:         feeRate,
+				LongTermFeeRate: longTermFeeRate,
+				ChangeType:      coinselect.ChangeType(),
+			}
+			var err error
+			selection, err = coinselect.SelectWith(algorithm, coins, params)
+			if err != nil {
+				return nil, fmt.Errorf("%v, missing %d sats", err, missing)
+			}
+			outPoints := make([]wire.OutPoint, len(selection.Coins))
+			for i, coin := range selection.Coins {
+				outPoints[i] = coin.OutPoint
+			}
+			return outPoints, nil
+		})
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		fmt.Printf("Selected %d child inputs with %s\n", len(selection.Coins), selection.Algorithm)
+
+		// any change of the selection goes to the single output of the
+		// child instead of a second one
+		for _, coin := range selection.Coins {
+			outPoint := coin.OutPoint
+			txIn := wire.NewTxIn(&outPoint, nil, nil)
+			txIn.Sequence = wire.MaxTxInSequenceNum - 2
+			tx.AddTxIn(txIn)
+			weight := coinselect.InputWeight(coin.Type)
+			addedWeight += weight
+			fee += coinselect.Fee(weight, feeRate)
+			total += coin.Value
+		}
+	}
+
+	script, err := newWalletScript(client, "", coinselect.ChangeType())
+	if err != nil {
+		releaseCoins(client, store, addedInputs(tx, parent))
+		return nil, 0, 0, err
+	}
+	tx.AddTxOut(wire.NewTxOut(total-fee, script))
+
+	// pass the parent output along, the node does not know the parent yet
+	// when both are submitted as a package
+	prevOuts := map[wire.OutPoint]*wire.TxOut{
+		*wire.NewOutPoint(&parentHash, vout): parent.TxOut[vout],
+	}
+	signed, err := signTx(client, tx, prevOuts, txscript.SigHashDefault)
+	if err != nil {
+		fmt.Println("Failed to sign transaction: ", err)
+		releaseCoins(client, store, addedInputs(tx, parent))
+		return nil, 0, 0, err
+	}
+	return signed, fee, addedWeight, nil
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/twilight-project/rbf-node/db"
+	"github.com/twilight-project/rbf-node/types"
+)
+
+// dryRunStore records the simulated broadcasts, nil when not in dry run
+// mode. It is set once at startup.
+var dryRunStore db.Store
+
+// EnableDryRun switches every broadcast to a testmempoolaccept check recorded
+// in store. Wallet coins are leased but not locked so a node running for real
+// on the same wallet is not disturbed.
+func EnableDryRun(store db.Store) {
+	dryRunStore = store
+}
+
+func DryRun() bool {
+	return dryRunStore != nil
+}
+
+type mempoolAcceptResult struct {
+	Txid         string `json:"txid"`
+	Allowed      bool   `json:"allowed"`
+	VSize        int64  `json:"vsize"`
+	RejectReason string `json:"reject-reason"`
+	Fees         struct {
+		Base float64 `json:"base"`
+	} `json:"fees"`
+}
+
+// testMempoolAccept asks the node whether it would accept txs, parents
+// first, without relaying them. More than one transaction is tested as a
+// package.
+func testMempoolAccept(client *rpcclient.Client, txs ...*wire.MsgTx) ([]mempoolAcceptResult, error) {
+	hexes := make([]string, len(txs))
+	for i, tx := range txs {
+		txHex, err := txToHex(tx)
+		if err != nil {
+			return nil, err
+		}
+		hexes[i] = txHex
+	}
+	param, err := json.Marshal(hexes)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := client.RawRequest("testmempoolaccept", []json.RawMessage{param})
+	if err != nil {
+		return nil, err
+	}
+	results := []mempoolAcceptResult{}
+	err = json.Unmarshal(raw, &results)
+	return results, err
+}
+
+// simulateBroadcast checks txs with testmempoolaccept and records what would
+// have been broadcast. Rejections are returned as errors worded like the
+// ones of sendrawtransaction.
+func simulateBroadcast(client *rpcclient.Client, txs ...*wire.MsgTx) error {
+	results, err := testMempoolAccept(client, txs...)
+	if err != nil {
+		return err
+	}
+	byTxid := make(map[string]mempoolAcceptResult)
+	for _, result := range results {
+		byTxid[result.Txid] = result
+	}
+
+	rejected := []string{}
+	for _, tx := range txs {
+		txid := tx.TxHash().String()
+		result := byTxid[txid]
+		raw, err := serializeTx(tx)
+		if err != nil {
+			return err
+		}
+		broadcast := types.SimulatedBroadcast{
+			Txid:         txid,
+			Tx:           raw,
+			Package:      len(txs) > 1,
+			Allowed:      result.Allowed,
+			RejectReason: result.RejectReason,
+			VSize:        result.VSize,
+			Fee:          BtcToSats(result.Fees.Base),
+		}
+		err = dryRunStore.InsertSimulatedBroadcast(broadcast)
+		if err != nil {
+			fmt.Println("Failed to record dry run broadcast : ", err)
+		}
+		if result.Allowed {
+			fmt.Printf("Dry run : would broadcast %s, %d vbytes paying %d sats\n", txid, broadcast.VSize, broadcast.Fee)
+			continue
+		}
+		fmt.Printf("Dry run : %s would be rejected : %s\n", txid, result.RejectReason)
+		rejected = append(rejected, txid+" : "+result.RejectReason)
+	}
+	if len(rejected) > 0 {
+		return fmt.Errorf("testmempoolaccept rejected %s", strings.Join(rejected, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,467 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/twilight-project/rbf-node/alert"
+	"github.com/twilight-project/rbf-node/chainnotify"
+	"github.com/twilight-project/rbf-node/db"
+	"github.com/twilight-project/rbf-node/feebudget"
+	"github.com/twilight-project/rbf-node/feebump"
+	"github.com/twilight-project/rbf-node/feeestimate"
+	"github.com/twilight-project/rbf-node/pinning"
+	"github.com/twilight-project/rbf-node/types"
+)
+
+// confTarget returns the confirmation target for the tracked transaction at
+// height, from the blocks left before its deadline.
+func confTarget(policy *feebump.Policy, tracked types.TrackedTx, height int64) int64 {
+	return policy.ConfTarget(feebump.State{
+		Height:          height,
+		BroadcastHeight: tracked.BroadcastHeight,
+		UnlockHeight:    tracked.UnlockHeight,
+		DeadlineHeight:  tracked.DeadlineHeight,
+	})
+}
+
+// BumpFees watches every broadcast but unconfirmed transaction and replaces
+// it with a higher fee version when it falls behind the fee estimate or
+// misses its deadline, following the configured fee bump schedule. It runs on
+// every block and every fee_bump_interval_seconds.
+func BumpFees(store db.Store, events <-chan chainnotify.Event) {
+	client := getBitcoinRpcClient()
+	defer client.Shutdown()
+	policy := feebump.NewPolicy()
+	idle := configuredInterval("fee_bump_interval_seconds", time.Minute)
+	fmt.Printf("Started fee bumper, %s schedule, cap %d sats\n", policy.Schedule, policy.MaxFee)
+	atRisk := make(map[string]deadlineRisk)
+
+	for {
+		bumpStuckTxs(client, store, policy, atRisk)
+		chainnotify.Wait(events, idle, func(e chainnotify.Event) bool {
+			return e.Type == chainnotify.BlockConnected
+		})
+	}
+}
+
+// bumpStuckTxs runs one round of the fee bumper. atRisk holds the deadline
+// risk last alerted for each transaction between rounds, replacements
+// included.
+func bumpStuckTxs(client *rpcclient.Client, store db.Store, policy *feebump.Policy, atRisk map[string]deadlineRisk) {
+	txs, err := store.QueryTrackedTxByState(types.TxStateBroadcast, types.TxStateInMempool)
+	if err != nil {
+		return
+	}
+	watched := make(map[string]bool, len(txs))
+	for _, tx := range txs {
+		watched[riskKey(tx)] = true
+	}
+	for key := range atRisk {
+		if !watched[key] {
+			delete(atRisk, key)
+		}
+	}
+	if len(txs) == 0 {
+		return
+	}
+	height, err := client.GetBlockCount()
+	if err != nil {
+		fmt.Println("Error getting block count: ", err)
+		return
+	}
+	// estimates by confirmation target, fetched once per round
+	estimates := make(map[int64]int64)
+	estimate := func(target int64) int64 {
+		feeRate, ok := estimates[target]
+		if !ok {
+			var err error
+			feeRate, err = estimateFeeRate(client, target)
+			if err != nil {
+				fmt.Println("Failed to get fee from btc node : ", err)
+			}
+			estimates[target] = feeRate
+		}
+		return feeRate
+	}
+	analyzer := pinning.NewAnalyzer(client)
+	pending := pendingApprovals(store)
+
+	for _, tx := range txs {
+		if pending[tx.Id] {
+			continue
+		}
+		current, err := deserializeTx(tx.Tx)
+		if err != nil {
+			fmt.Println("error decodeing signed transaction fee bumper : ", err)
+			continue
+		}
+		if tx.BroadcastHeight == 0 {
+			// broadcast before bump tracking, count from now
+			_ = store.SetTrackedTxBroadcastHeight(tx.Id, height)
+			continue
+		}
+
+		target := confTarget(policy, tx, height)
+		state := feeBumpState(analyzer, tx, current, estimate(target), height)
+		decision := policy.Next(state)
+		if !decision.AtRisk {
+			delete(atRisk, riskKey(tx))
+		} else if risk := riskOf(policy, state); risk > atRisk[riskKey(tx)] {
+			atRisk[riskKey(tx)] = risk
+			notifyDeadlineAtRisk(policy, tx, state, target, risk)
+		}
+		if !decision.Bump {
+			continue
+		}
+
+		findings, err := analyzer.AnalyzeDescendants(current)
+		if err != nil {
+			findings = nil
+		}
+		rbf := rbfOption(policy, state, decision.FeeRate, findings)
+		if len(tx.NyksTx) == 0 {
+			rbf.Blocked = errNotReplaceable.Error()
+		}
+		cpfp, vout := cpfpOption(client, policy, tx, current, state, decision.FeeRate, findings)
+		option, ok := feebump.Choose(policy.Mode, rbf, cpfp)
+		if !ok {
+			alert.Notify(alert.Event{
+				Type:      alert.FeeCapReached,
+				Severity:  alert.Warning,
+				Txid:      tx.Txid,
+				ReserveId: tx.ReserveId,
+				RoundId:   tx.RoundId,
+				Message:   fmt.Sprintf("%s but no bump is possible, rbf : %s, cpfp : %s", decision.Reason, rbf.Blocked, cpfp.Blocked),
+			})
+			continue
+		}
+
+		fmt.Printf("Bumping %s transaction %s with %s to %d sats in total : %s\n", tx.TxType, tx.Txid, option.Mode, option.Total, decision.Reason)
+		switch option.Mode {
+		case feebump.RBF:
+			_, err = BumpTrackedTx(client, store, policy, tx, option.Fee, height)
+		case feebump.CPFP:
+			err = PayForTrackedTx(client, store, policy, tx, state, vout, decision.FeeRate, height)
+		}
+		if errors.Is(err, ErrApprovalRequired) {
+			fmt.Printf("Fee bump of %s waits for approval : %v\n", tx.Txid, err)
+		} else if err != nil {
+			fmt.Printf("Failed to bump fee of %s : %v\n", tx.Txid, err)
+			notifyFeeBumpFailure(tx, option.Mode, err.Error())
+		}
+	}
+}
+
+// deadlineRisk is how close a transaction the fee cap keeps below the
+// estimate is to its deadline. The alert escalates each time it gets closer.
+type deadlineRisk int
+
+const (
+	riskOverCap deadlineRisk = iota + 1
+	riskUrgent
+	riskMissed
+)
+
+func (r deadlineRisk) String() string {
+	switch r {
+	case riskUrgent:
+		return "urgent"
+	case riskMissed:
+		return "missed"
+	default:
+		return "over_cap"
+	}
+}
+
+// riskKey is the same for a transaction and its replacements.
+func riskKey(tx types.TrackedTx) string {
+	if tx.NyksTxid == "" {
+		return tx.Txid
+	}
+	return tx.ReserveId + "|" + tx.RoundId + "|" + tx.NyksTxid
+}
+
+func riskOf(policy *feebump.Policy, state feebump.State) deadlineRisk {
+	remaining := policy.Deadline(state) - state.Height
+	switch {
+	case remaining <= 0:
+		return riskMissed
+	case remaining <= policy.UrgentBlocks:
+		return riskUrgent
+	default:
+		return riskOverCap
+	}
+}
+
+// notifyDeadlineAtRisk raises a critical alert when paying the estimate for
+// the confirmation target would take more than the fee cap, once when it
+// happens, within fee_bump_urgent_blocks of the deadline and once missed.
+func notifyDeadlineAtRisk(policy *feebump.Policy, tx types.TrackedTx, state feebump.State, target int64, risk deadlineRisk) {
+	deadline := policy.Deadline(state)
+	message := fmt.Sprintf("fee cap of %d sats does not cover the fee estimate, %s transaction may miss deadline height %d", policy.MaxFee, tx.TxType, deadline)
+	switch risk {
+	case riskUrgent:
+		message = fmt.Sprintf("fee cap of %d sats does not cover the fee estimate, %s transaction is close to deadline height %d", policy.MaxFee, tx.TxType, deadline)
+	case riskMissed:
+		message = fmt.Sprintf("fee cap of %d sats does not cover the fee estimate, %s transaction missed deadline height %d", policy.MaxFee, tx.TxType, deadline)
+	}
+	alert.Notify(alert.Event{
+		Type:      alert.DeadlineAtRisk,
+		Severity:  alert.Critical,
+		Txid:      tx.Txid,
+		ReserveId: tx.ReserveId,
+		RoundId:   tx.RoundId,
+		Reason:    risk.String(),
+		Message:   message,
+		Details:   map[string]interface{}{"deadline_height": deadline, "blocks_left": deadline - state.Height, "conf_target": target, "estimate": state.EstimatedFeeRate, "max_fee": policy.MaxFee},
+	})
+}
+
+// rbfOption prices a replacement of the transaction. It is blocked when the
+// cap does not cover the BIP125 minimum or the replacement would evict too
+// many descendants.
+func rbfOption(policy *feebump.Policy, state feebump.State, feeRate int64, findings []pinning.Finding) feebump.Option {
+	option := feebump.Option{Mode: feebump.RBF}
+	for _, finding := range findings {
+		if finding.Rule == "BIP125 rule 5" {
+			option.Blocked = finding.Detail
+			return option
+		}
+	}
+	fee, ok := policy.ReplacementFee(state, state.VSize, feeRate)
+	if !ok {
+		option.Blocked = fmt.Sprintf("replacement needs %d sats, cap is %d sats", fee, policy.MaxFee)
+		return option
+	}
+	option.Fee = fee
+	option.Total = fee
+	return option
+}
+
+func feeBumpState(analyzer *pinning.Analyzer, tx types.TrackedTx, current *wire.MsgTx, estimate int64, height int64) feebump.State {
+	state := feebump.State{
+		Fee:              tx.Fee,
+		VSize:            pinning.VirtualSize(current),
+		EstimatedFeeRate: estimate,
+		Height:           height,
+		BroadcastHeight:  tx.BroadcastHeight,
+		UnlockHeight:     tx.UnlockHeight,
+		DeadlineHeight:   tx.DeadlineHeight,
+	}
+	if len(tx.ChildTx) > 0 {
+		child, err := deserializeTx(tx.ChildTx)
+		if err == nil {
+			state.ChildFee = tx.ChildFee
+			state.ChildVSize = pinning.VirtualSize(child)
+		}
+	}
+	state.ReplacedFees = state.Fee + state.ChildFee
+	entry, err := analyzer.MempoolEntry(tx.Txid)
+	if err == nil {
+		state.ReplacedFees = entry.DescendantFees()
+		state.AncestorFees = entry.AncestorFees()
+		state.AncestorVSize = entry.AncestorSize
+	}
+	return state
+}
+
+// BumpTrackedTx rebuilds the tracked transaction from the nyks transaction
+// with fee inputs paying fee, broadcasts it and tracks it as the replacement.
+// The fee is raised to what BIP125 requires for the size of the signed
+// replacement if needed. A replacement over the fee budget is queued for
+// approval instead. It returns the id of the replacement.
+func BumpTrackedTx(client *rpcclient.Client, store db.Store, policy *feebump.Policy, tracked types.TrackedTx, fee int64, height int64) (int64, error) {
+	err := checkNoPendingApproval(store, tracked.Id)
+	if err != nil {
+		return 0, err
+	}
+	current, err := deserializeTx(tracked.Tx)
+	if err != nil {
+		return 0, err
+	}
+	state := feeBumpState(pinning.NewAnalyzer(client), tracked, current, 0, height)
+	replacement, fee, err := proposeReplacement(client, store, policy, tracked, current, state, fee)
+	if err != nil {
+		return 0, err
+	}
+
+	spend := feebudget.Spend{
+		Fee:   fee,
+		VSize: pinning.VirtualSize(replacement),
+		Value: sweepValue(tracked.NyksTx),
+		Added: fee - tracked.Fee - tracked.ChildFee,
+	}
+	err = authorizeFee(store, tracked, types.ApprovalRBF, replacement, fee, spend)
+	if err != nil {
+		if !errors.Is(err, ErrApprovalRequired) {
+			releaseCoins(client, store, addedInputs(replacement, current))
+		}
+		return 0, err
+	}
+	return broadcastReplacement(client, store, tracked, current, replacement, fee, height)
+}
+
+// proposeReplacement builds and signs a replacement of the tracked
+// transaction paying fee, raised to the BIP125 minimum for its signed size.
+// It returns the replacement and the fee it pays, its added inputs are
+// leased to the tracked transaction.
+func proposeReplacement(client *rpcclient.Client, store db.Store, policy *feebump.Policy, tracked types.TrackedTx, current *wire.MsgTx, state feebump.State, fee int64) (*wire.MsgTx, int64, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		replacement, paid, err := buildReplacement(client, store, tracked, current, fee)
+		if err != nil {
+			return nil, 0, err
+		}
+		minFee := policy.MinReplacementFee(state, pinning.VirtualSize(replacement))
+		if paid >= minFee {
+			return replacement, paid, nil
+		}
+		releaseCoins(client, store, addedInputs(replacement, current))
+		if minFee > policy.MaxFee {
+			return nil, 0, fmt.Errorf("replacement needs %d sats, cap is %d sats", minFee, policy.MaxFee)
+		}
+		fee = minFee
+	}
+	return nil, 0, fmt.Errorf("could not build a replacement paying enough fee")
+}
+
+// broadcastReplacement tracks the signed replacement of the tracked
+// transaction paying fee and broadcasts it. The replacement is stored first
+// so the mempool watcher knows it as ours once the node relays it, and is
+// reverted when the broadcast fails.
+func broadcastReplacement(client *rpcclient.Client, store db.Store, tracked types.TrackedTx, current *wire.MsgTx, replacement *wire.MsgTx, fee int64, height int64) (int64, error) {
+	var buf bytes.Buffer
+	err := replacement.Serialize(&buf)
+	if err != nil {
+		releaseCoins(client, store, addedInputs(replacement, current))
+		return 0, err
+	}
+	newId, err := store.ReplaceTrackedTx(tracked.Id, buf.Bytes(), replacement.TxHash().String(), fee)
+	if err != nil {
+		fmt.Println("Failed to track RBF transaction: ", err)
+		releaseCoins(client, store, addedInputs(replacement, current))
+		return 0, err
+	}
+
+	_, err = BroadcastBtcTransaction(store, replacement)
+	if err != nil {
+		releaseCoins(client, store, addedInputs(replacement, current))
+		revertErr := store.RevertReplacement(tracked.Id, newId, tracked.State)
+		if revertErr != nil {
+			fmt.Println("Failed to revert RBF transaction : ", revertErr)
+		}
+		recordRejections(store, tracked, err)
+		return 0, fmt.Errorf("replacement could not be broadcast : %v", err)
+	}
+	recordFeeSpend(store, newId, fee-tracked.Fee-tracked.ChildFee)
+	err = store.SetTrackedTxBroadcastHeight(newId, height)
+	if err != nil {
+		return newId, err
+	}
+
+	fmt.Printf("Broadcasted RBF transaction with txid %s\n", replacement.TxHash().String())
+	alert.Notify(alert.Event{
+		Type:      alert.FeeBumped,
+		Severity:  alert.Info,
+		Txid:      replacement.TxHash().String(),
+		ReserveId: tracked.ReserveId,
+		RoundId:   tracked.RoundId,
+		Message:   fmt.Sprintf("replaced %s paying %d sats with a fee of %d sats", tracked.Txid, tracked.Fee, fee),
+		Details:   map[string]interface{}{"mode": feebump.RBF, "replaced": tracked.Txid, "old_fee": tracked.Fee, "new_fee": fee, "bump": tracked.BumpCount + 1},
+	})
+	return newId, nil
+}
+
+// errNotReplaceable is returned for rows stored before the nyks transaction
+// was kept, a replacement can not tell their fee inputs apart.
+var errNotReplaceable = errors.New("the nyks transaction is not known, only cpfp can bump it")
+
+// buildReplacement starts again from the nyks transaction, reuses the fee
+// inputs of the current version and adds more wallet inputs if needed, leased
+// to the tracked transaction. It returns the signed replacement and the fee it
+// pays.
+func buildReplacement(client *rpcclient.Client, store db.Store, tracked types.TrackedTx, current *wire.MsgTx, fee int64) (*wire.MsgTx, int64, error) {
+	if len(tracked.NyksTx) == 0 {
+		return nil, 0, errNotReplaceable
+	}
+	tx, err := deserializeTx(tracked.NyksTx)
+	if err != nil {
+		return nil, 0, err
+	}
+	nyksTx := tx.Copy()
+
+	nyksInputs := make(map[wire.OutPoint]bool)
+	for _, txIn := range tx.TxIn {
+		nyksInputs[txIn.PreviousOutPoint] = true
+	}
+	walletInputs := int64(0)
+	for _, txIn := range current.TxIn {
+		if nyksInputs[txIn.PreviousOutPoint] {
+			continue
+		}
+		outPoint := txIn.PreviousOutPoint
+		feeInput := wire.NewTxIn(&outPoint, nil, nil)
+		feeInput.Sequence = wire.MaxTxInSequenceNum - 2
+		tx.AddTxIn(feeInput)
+		walletInputs++
+	}
+
+	tx, _, paid, err := addFeeInputs(store, tracked.Id, tx, "", fee, walletInputs)
+	if err != nil {
+		return nil, 0, err
+	}
+	signed, err := SignNewFeeInputs(tx)
+	if err != nil {
+		releaseCoins(client, store, addedInputs(tx, current))
+		return nil, 0, err
+	}
+	err = checkSweepIntegrity(client, nyksTx, signed)
+	if err != nil {
+		if isIntegrityError(err) {
+			notifySweepIntegrity(tracked, signed.TxHash().String(), err)
+		}
+		releaseCoins(client, store, addedInputs(signed, current))
+		return nil, 0, err
+	}
+	return signed, paid, nil
+}
+
+// estimateFeeRate returns the fee estimate for target blocks in sat/kvB from
+// the sources configured under fee_estimation.
+func estimateFeeRate(client *rpcclient.Client, target int64) (int64, error) {
+	return feeestimate.New(client).EstimateFeeRate(target)
+}
+
+func deserializeTx(raw []byte) (*wire.MsgTx, error) {
+	tx := wire.NewMsgTx(wire.TxVersion)
+	err := tx.Deserialize(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to deserialize transaction: %v", err)
+	}
+	return tx, nil
+}
+
+func serializeTx(tx *wire.MsgTx) ([]byte, error) {
+	var buf bytes.Buffer
+	err := tx.Serialize(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func notifyFeeBumpFailure(tx types.TrackedTx, mode feebump.Mode, msg string) {
+	alert.Notify(alert.Event{
+		Type:      alert.FeeBumpFailed,
+		Severity:  alert.Critical,
+		Txid:      tx.Txid,
+		ReserveId: tx.ReserveId,
+		RoundId:   tx.RoundId,
+		Reason:    string(mode),
+		Message:   msg,
+	})
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/twilight-project/rbf-node/alert"
+	"github.com/twilight-project/rbf-node/sweepcheck"
+	"github.com/twilight-project/rbf-node/types"
+)
+
+// checkSweepIntegrity verifies that tx, built from the transaction signed on
+// nyks, keeps every signature of the reserve signers valid. An output spent
+// by tx that cannot be looked up is returned as an error not wrapping
+// sweepcheck.ErrIntegrity.
+func checkSweepIntegrity(client *rpcclient.Client, nyksTx *wire.MsgTx, tx *wire.MsgTx) error {
+	fetcher := txscript.NewMultiPrevOutFetcher(nil)
+	for _, txIn := range tx.TxIn {
+		value, pkScript, err := prevOut(client, txIn.PreviousOutPoint)
+		if err != nil {
+			return err
+		}
+		fetcher.AddPrevOut(txIn.PreviousOutPoint, wire.NewTxOut(value, pkScript))
+	}
+	return sweepcheck.Check(nyksTx, tx, fetcher).Err()
+}
+
+func notifySweepIntegrity(tracked types.TrackedTx, txid string, err error) {
+	alert.Notify(alert.Event{
+		Type:      alert.SweepIntegrity,
+		Severity:  alert.Critical,
+		Txid:      tracked.Txid,
+		ReserveId: tracked.ReserveId,
+		RoundId:   tracked.RoundId,
+		Message:   fmt.Sprintf("%s would invalidate the nyks signatures of %s and is not broadcast : %v", txid, tracked.Txid, err),
+	})
+}
+
+// isIntegrityError tells whether err means the nyks signatures would break,
+// as opposed to the check not being able to run.
+func isIntegrityError(err error) bool {
+	return errors.Is(err, sweepcheck.ErrIntegrity)
+}
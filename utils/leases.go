@@ -0,0 +1,205 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/twilight-project/rbf-node/chainnotify"
+	"github.com/twilight-project/rbf-node/db"
+)
+
+// leaseMu serialises picking wallet coins, sweeps are funded from a goroutine
+// per nyks event while fee bumps and /rbf requests run alongside.
+var leaseMu sync.Mutex
+
+// ManageUtxoLeases locks the leased wallet coins in bitcoind again after a
+// restart of either side, and unlocks the coins of released leases. It runs
+// on startup, on every block and every utxo_lease_interval_seconds.
+func ManageUtxoLeases(store db.Store, events <-chan chainnotify.Event) {
+	client := getBitcoinRpcClient()
+	defer client.Shutdown()
+	idle := configuredInterval("utxo_lease_interval_seconds", time.Minute)
+
+	for {
+		leaseMu.Lock()
+		err := syncUtxoLocks(client, store)
+		leaseMu.Unlock()
+		if err != nil {
+			fmt.Println("Failed to sync utxo leases : ", err)
+		}
+		chainnotify.Wait(events, idle, func(e chainnotify.Event) bool {
+			return e.Type == chainnotify.BlockConnected
+		})
+	}
+}
+
+// syncUtxoLocks makes the wallet locks match the leases. leaseMu has to be
+// held.
+func syncUtxoLocks(client *rpcclient.Client, store db.Store) error {
+	leases, err := store.ListUtxoLeases()
+	if err != nil {
+		return err
+	}
+	if DryRun() {
+		released := []string{}
+		for _, lease := range leases {
+			if lease.Released {
+				released = append(released, lease.OutPoint)
+			}
+		}
+		return store.DeleteUtxoLeases(released)
+	}
+	locked, err := client.ListLockUnspent()
+	if err != nil {
+		return err
+	}
+	isLocked := make(map[wire.OutPoint]bool)
+	for _, outPoint := range locked {
+		isLocked[*outPoint] = true
+	}
+
+	toUnlock := []*wire.OutPoint{}
+	released := []string{}
+	for _, lease := range leases {
+		outPoint, err := parseOutPoint(lease.OutPoint)
+		if err != nil {
+			return err
+		}
+		if lease.Released {
+			if isLocked[*outPoint] {
+				toUnlock = append(toUnlock, outPoint)
+			}
+			released = append(released, lease.OutPoint)
+			continue
+		}
+		if !isLocked[*outPoint] {
+			// coins already spent by the transaction can not be locked
+			_ = client.LockUnspent(false, []*wire.OutPoint{outPoint})
+		}
+	}
+
+	if len(toUnlock) > 0 {
+		err = client.LockUnspent(true, toUnlock)
+		if err != nil {
+			return err
+		}
+	}
+	return store.DeleteUtxoLeases(released)
+}
+
+// reserveCoins leases the wallet coins chosen by pick to the tracked
+// transaction id and locks them in the wallet. pick is given the spendable
+// coins listed by utxos that are not leased to any transaction.
+func reserveCoins(client *rpcclient.Client, store db.Store, id int64, utxos func() ([]btcjson.ListUnspentResult, error), pick func([]btcjson.ListUnspentResult) ([]wire.OutPoint, error)) ([]wire.OutPoint, error) {
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+
+	err := syncUtxoLocks(client, store)
+	if err != nil {
+		fmt.Println("Failed to sync utxo leases : ", err)
+	}
+	leases, err := store.ListUtxoLeases()
+	if err != nil {
+		return nil, err
+	}
+	leased := make(map[string]bool)
+	for _, lease := range leases {
+		if !lease.Released {
+			leased[lease.OutPoint] = true
+		}
+	}
+
+	available, err := utxos()
+	if err != nil {
+		return nil, err
+	}
+	free := []btcjson.ListUnspentResult{}
+	for _, utxo := range available {
+		if utxo.Spendable && !leased[fmt.Sprintf("%s:%d", utxo.TxID, utxo.Vout)] {
+			free = append(free, utxo)
+		}
+	}
+
+	outPoints, err := pick(free)
+	if err != nil || len(outPoints) == 0 {
+		return nil, err
+	}
+	keys := make([]string, len(outPoints))
+	toLock := make([]*wire.OutPoint, len(outPoints))
+	for i := range outPoints {
+		keys[i] = outPoints[i].String()
+		toLock[i] = &outPoints[i]
+	}
+	err = store.LeaseUtxos(id, keys)
+	if err != nil || DryRun() {
+		return outPoints, err
+	}
+	err = client.LockUnspent(false, toLock)
+	if err != nil {
+		fmt.Println("Failed to lock unspent : ", err)
+	}
+	return outPoints, nil
+}
+
+// releaseCoins releases the leases on outPoints and unlocks them, used when
+// a transaction they were reserved for is never broadcast.
+func releaseCoins(client *rpcclient.Client, store db.Store, outPoints []wire.OutPoint) {
+	if len(outPoints) == 0 {
+		return
+	}
+	keys := make([]string, len(outPoints))
+	for i, outPoint := range outPoints {
+		keys[i] = outPoint.String()
+	}
+
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+	err := store.ReleaseUtxos(keys)
+	if err == nil {
+		err = syncUtxoLocks(client, store)
+	}
+	if err != nil {
+		fmt.Println("Failed to release utxo leases : ", err)
+	}
+}
+
+// addedInputs returns the inputs of tx that base does not spend.
+func addedInputs(tx *wire.MsgTx, base *wire.MsgTx) []wire.OutPoint {
+	spent := make(map[wire.OutPoint]bool)
+	if base != nil {
+		for _, txIn := range base.TxIn {
+			spent[txIn.PreviousOutPoint] = true
+		}
+	}
+	added := []wire.OutPoint{}
+	for _, txIn := range tx.TxIn {
+		if !spent[txIn.PreviousOutPoint] {
+			added = append(added, txIn.PreviousOutPoint)
+		}
+	}
+	return added
+}
+
+// parseOutPoint parses the "txid:vout" form of an outpoint.
+func parseOutPoint(s string) (*wire.OutPoint, error) {
+	sep := strings.LastIndex(s, ":")
+	if sep < 0 {
+		return nil, fmt.Errorf("invalid outpoint %q", s)
+	}
+	hash, err := chainhash.NewHashFromStr(s[:sep])
+	if err != nil {
+		return nil, err
+	}
+	vout, err := strconv.ParseUint(s[sep+1:], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return wire.NewOutPoint(hash, uint32(vout)), nil
+}
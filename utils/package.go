@@ -0,0 +1,348 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/spf13/viper"
+	"github.com/twilight-project/rbf-node/alert"
+	"github.com/twilight-project/rbf-node/db"
+	"github.com/twilight-project/rbf-node/feebudget"
+	"github.com/twilight-project/rbf-node/feebump"
+	"github.com/twilight-project/rbf-node/pinning"
+	"github.com/twilight-project/rbf-node/types"
+)
+
+var ErrPackageRelayUnsupported = errors.New("bitcoin node does not support submitpackage")
+
+// NetParams returns the parameters of the network set by btc_network,
+// mainnet by default.
+func NetParams() *chaincfg.Params {
+	switch viper.GetString("btc_network") {
+	case "testnet", "testnet3":
+		return &chaincfg.TestNet3Params
+	case "signet":
+		return &chaincfg.SigNetParams
+	case "regtest":
+		return &chaincfg.RegressionNetParams
+	default:
+		return &chaincfg.MainNetParams
+	}
+}
+
+func packageRelayEnabled() bool {
+	if !viper.IsSet("package_relay") {
+		return true
+	}
+	return viper.GetBool("package_relay")
+}
+
+// PackageFunding tells whether fee_funding_mode is "package", in which case
+// nyks transactions are broadcast without fee inputs and paid for by a child
+// when needed. The default "inputs" adds fee inputs to them.
+func PackageFunding() bool {
+	return viper.GetString("fee_funding_mode") == "package"
+}
+
+// TxFee returns the fee tx pays in sats.
+func TxFee(tx *wire.MsgTx) (int64, error) {
+	client := getBitcoinRpcClient()
+	defer client.Shutdown()
+
+	fee := int64(0)
+	for _, txIn := range tx.TxIn {
+		value, err := prevOutValue(client, txIn.PreviousOutPoint)
+		if err != nil {
+			return 0, err
+		}
+		fee += value
+	}
+	for _, txOut := range tx.TxOut {
+		fee -= txOut.Value
+	}
+	return fee, nil
+}
+
+type submitPackageResult struct {
+	PackageMsg string `json:"package_msg"`
+	TxResults  map[string]struct {
+		Txid  string `json:"txid"`
+		Error string `json:"error"`
+	} `json:"tx-results"`
+}
+
+// SubmitPackage submits txs, parents first, with submitpackage once every
+// input passes the script interpreter and every locktime is reached, a
+// *RejectedError says why not. store may be nil, it provides the outputs of
+// tracked transactions not broadcast yet. The error wraps
+// ErrPackageRelayUnsupported when the node does not offer submitpackage. In
+// dry run mode the package is only checked with testmempoolaccept.
+func SubmitPackage(client *rpcclient.Client, store db.Store, txs ...*wire.MsgTx) error {
+	rejections, err := verifyPackage(client, store, txs...)
+	if err != nil {
+		// the node reports what it refuses when submitting
+		fmt.Println("Failed to verify package before submitting : ", err)
+	}
+	if len(rejections) > 0 {
+		err = &RejectedError{Rejections: rejections}
+		fmt.Println("Refusing to submit package : ", err)
+		return err
+	}
+
+	if DryRun() {
+		return simulateBroadcast(client, txs...)
+	}
+	hexes := make([]string, len(txs))
+	for i, tx := range txs {
+		txHex, err := txToHex(tx)
+		if err != nil {
+			return err
+		}
+		hexes[i] = txHex
+	}
+	param, err := json.Marshal(hexes)
+	if err != nil {
+		return err
+	}
+
+	raw, err := client.RawRequest("submitpackage", []json.RawMessage{param})
+	if err != nil {
+		if packageRelayUnsupported(err) {
+			return fmt.Errorf("%w : %v", ErrPackageRelayUnsupported, err)
+		}
+		return err
+	}
+
+	result := submitPackageResult{}
+	err = json.Unmarshal(raw, &result)
+	if err != nil {
+		return err
+	}
+	// package_msg was added in bitcoind 28, earlier versions fail the call
+	if result.PackageMsg != "" && result.PackageMsg != "success" {
+		reasons := []string{}
+		for _, txResult := range result.TxResults {
+			if txResult.Error != "" {
+				reasons = append(reasons, txResult.Txid+" : "+txResult.Error)
+			}
+		}
+		sort.Strings(reasons)
+		return fmt.Errorf("package rejected : %s (%s)", result.PackageMsg, strings.Join(reasons, ", "))
+	}
+	return nil
+}
+
+// packageRelayUnsupported recognises a node without submitpackage, or one
+// that only allows it on regtest (bitcoind 26 and 27).
+func packageRelayUnsupported(err error) bool {
+	var rpcErr *btcjson.RPCError
+	if errors.As(err, &rpcErr) && rpcErr.Code == btcjson.ErrRPCMethodNotFound.Code {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "Method not found") || strings.Contains(msg, "only for regtest")
+}
+
+// mempoolMinFeeRate returns the feerate in sat/kvB a transaction needs to
+// enter the node's mempool on its own.
+func mempoolMinFeeRate(client *rpcclient.Client) (int64, error) {
+	raw, err := client.RawRequest("getmempoolinfo", nil)
+	if err != nil {
+		return 0, err
+	}
+	info := struct {
+		MempoolMinFee float64 `json:"mempoolminfee"`
+		MinRelayTxFee float64 `json:"minrelaytxfee"`
+	}{}
+	err = json.Unmarshal(raw, &info)
+	if err != nil {
+		return 0, err
+	}
+	minFee := BtcToSats(info.MempoolMinFee)
+	if relay := BtcToSats(info.MinRelayTxFee); relay > minFee {
+		minFee = relay
+	}
+	return minFee, nil
+}
+
+// isFeeTooLow tells whether sendrawtransaction rejected a transaction for
+// paying less than the mempool minimum.
+func isFeeTooLow(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "min relay fee not met") ||
+		strings.Contains(msg, "mempool min fee not met")
+}
+
+// walletOutput returns an output of tx paying to the wallet, which does not
+// have to know tx yet.
+func walletOutput(client *rpcclient.Client, tx *wire.MsgTx) (uint32, bool) {
+	for i, txOut := range tx.TxOut {
+		_, addrs, _, err := txscript.ExtractPkScriptAddrs(txOut.PkScript, NetParams())
+		if err != nil || len(addrs) != 1 {
+			continue
+		}
+		info, err := client.GetAddressInfo(addrs[0].EncodeAddress())
+		if err == nil && info.IsMine && txOut.Value >= changeDustLimit {
+			return uint32(i), true
+		}
+	}
+	return 0, false
+}
+
+// HasWalletOutput tells whether tx has an output paying to the wallet that
+// a child can spend in package mode.
+func HasWalletOutput(tx *wire.MsgTx) bool {
+	client := getBitcoinRpcClient()
+	defer client.Shutdown()
+
+	_, ok := walletOutput(client, tx)
+	return ok
+}
+
+// broadcastTrackedTx sends a transaction whose unlock height is reached. One
+// paying less than the mempool minimum is submitted as a package with a child
+// paying for it when package relay is enabled. If the node does not support
+// packages it falls back to sendrawtransaction and raises an alert.
+func broadcastTrackedTx(client *rpcclient.Client, store db.Store, tracked types.TrackedTx, tx *wire.MsgTx) error {
+	vsize := pinning.VirtualSize(tx)
+	minFeeRate, err := mempoolMinFeeRate(client)
+	if err != nil {
+		fmt.Println("Failed to get mempool info : ", err)
+	}
+	feeRate := tracked.Fee * 1000 / vsize
+
+	var sendErr error
+	sent := false
+	if !packageRelayEnabled() || feeRate >= minFeeRate {
+		_, sendErr = BroadcastBtcTransaction(store, tx)
+		if !packageRelayEnabled() || !isFeeTooLow(sendErr) {
+			return sendErr
+		}
+		sent = true
+	}
+
+	err = broadcastPackage(client, store, tracked, tx, minFeeRate)
+	if err == nil || errors.Is(err, ErrApprovalRequired) {
+		return err
+	}
+	if errors.Is(err, ErrPackageRelayUnsupported) {
+		fmt.Println("Package relay unavailable, falling back to sendrawtransaction : ", err)
+		alert.Notify(alert.Event{
+			Type:      alert.PackageRelayUnsupported,
+			Severity:  alert.Warning,
+			Txid:      tracked.Txid,
+			ReserveId: tracked.ReserveId,
+			RoundId:   tracked.RoundId,
+			Message: fmt.Sprintf("%s transaction pays %d sat/kvB, below the mempool minimum of %d sat/kvB, and the bitcoin node does not support submitpackage, it can only be relayed once the minimum drops or with bitcoind 28 or later",
+				tracked.TxType, feeRate, minFeeRate),
+		})
+	} else {
+		fmt.Println("Failed to submit package, falling back to sendrawtransaction : ", err)
+	}
+	if sent {
+		return sendErr
+	}
+	_, err = BroadcastBtcTransaction(store, tx)
+	return err
+}
+
+// broadcastPackage submits tx together with a child spending its wallet
+// output that brings the package to the fee estimate, at least to the
+// mempool minimum. A child over the fee budget is queued for approval and
+// submitted once approved.
+func broadcastPackage(client *rpcclient.Client, store db.Store, tracked types.TrackedTx, tx *wire.MsgTx, minFeeRate int64) error {
+	approval, err := latestApproval(store, tracked.Id, types.ApprovalPackage)
+	if err != nil {
+		return err
+	}
+	if approval != nil {
+		switch approval.Status {
+		case types.ApprovalPending:
+			return fmt.Errorf("%w : approval %d is pending", ErrApprovalRequired, approval.Id)
+		case types.ApprovalApproved:
+			return submitApprovedPackage(client, store, tracked, tx, approval)
+		case types.ApprovalRejected:
+			return fmt.Errorf("child paying for %s transaction was rejected in approval %d", tracked.TxType, approval.Id)
+		}
+	}
+
+	vout, ok := walletOutput(client, tx)
+	if !ok {
+		return fmt.Errorf("%s transaction pays below the mempool minimum and has no output paying to the wallet for a child", tracked.TxType)
+	}
+
+	policy := feebump.NewPolicy()
+	height, err := client.GetBlockCount()
+	if err != nil {
+		return err
+	}
+	feeRate, err := estimateFeeRate(client, confTarget(policy, tracked, height))
+	if err != nil || feeRate < minFeeRate {
+		feeRate = minFeeRate
+	}
+	state := feebump.State{Fee: tracked.Fee, VSize: pinning.VirtualSize(tx)}
+	child, fee, err := buildChildAtFeeRate(client, store, tracked.Id, policy, state, tx, vout, feeRate)
+	if err != nil {
+		return err
+	}
+
+	spend := feebudget.Spend{
+		Fee:   tracked.Fee + fee,
+		VSize: state.VSize + pinning.VirtualSize(child),
+		Value: sweepValue(tracked.NyksTx),
+		Added: fee,
+	}
+	err = authorizeFee(store, tracked, types.ApprovalPackage, child, fee, spend)
+	if err != nil {
+		if !errors.Is(err, ErrApprovalRequired) {
+			releaseCoins(client, store, addedInputs(child, tx))
+		}
+		return err
+	}
+	return submitChildPackage(client, store, tracked, tx, child, fee)
+}
+
+// submitApprovedPackage submits tx with the child held by an approved
+// approval.
+func submitApprovedPackage(client *rpcclient.Client, store db.Store, tracked types.TrackedTx, tx *wire.MsgTx, approval *types.FeeApproval) error {
+	child, err := deserializeTx(approval.Tx)
+	if err == nil {
+		err = submitChildPackage(client, store, tracked, tx, child, approval.Fee)
+	}
+	status := types.ApprovalExecuted
+	if err != nil {
+		status = types.ApprovalFailed
+	}
+	statusErr := store.UpdateFeeApprovalStatus(approval.Id, types.ApprovalApproved, status)
+	if err != nil {
+		return err
+	}
+	return statusErr
+}
+
+func submitChildPackage(client *rpcclient.Client, store db.Store, tracked types.TrackedTx, tx *wire.MsgTx, child *wire.MsgTx, fee int64) error {
+	err := SubmitPackage(client, store, tx, child)
+	if err != nil {
+		releaseCoins(client, store, addedInputs(child, tx))
+		return err
+	}
+	fmt.Printf("Submitted package of %s and child %s\n", tx.TxHash().String(), child.TxHash().String())
+	recordFeeSpend(store, tracked.Id, fee)
+
+	childBytes, err := serializeTx(child)
+	if err != nil {
+		return err
+	}
+	return store.SetTrackedTxChild(tracked.Id, childBytes, child.TxHash().String(), fee)
+}
@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/spf13/viper"
+	"github.com/twilight-project/rbf-node/alert"
+	"github.com/twilight-project/rbf-node/chainnotify"
+	"github.com/twilight-project/rbf-node/coinselect"
+	"github.com/twilight-project/rbf-node/db"
+	"github.com/twilight-project/rbf-node/utxopool"
+)
+
+var poolHealth struct {
+	sync.Mutex
+	health *utxopool.Health
+}
+
+// PoolHealth returns the last assessment of the fee wallet, nil until the
+// pool manager ran once.
+func PoolHealth() *utxopool.Health {
+	poolHealth.Lock()
+	defer poolHealth.Unlock()
+	return poolHealth.health
+}
+
+func poolConfTarget() int64 {
+	target := viper.GetInt64("utxo_pool.conf_target")
+	if target <= 0 {
+		target = 6
+	}
+	return target
+}
+
+// ManageUtxoPool assesses the fee wallet on every block and every
+// utxo_pool.interval_seconds, warning when it can not fund enough sweeps.
+// With utxo_pool.enabled it also splits large coins into the configured
+// bands and consolidates dust while fees are low.
+func ManageUtxoPool(store db.Store, events <-chan chainnotify.Event) {
+	client := getBitcoinRpcClient()
+	defer client.Shutdown()
+	policy := utxopool.NewPolicy()
+	idle := configuredInterval("utxo_pool.interval_seconds", 10*time.Minute)
+
+	for {
+		managePool(client, store, policy)
+		chainnotify.Wait(events, idle, func(e chainnotify.Event) bool {
+			return e.Type == chainnotify.BlockConnected
+		})
+	}
+}
+
+func managePool(client *rpcclient.Client, store db.Store, policy *utxopool.Policy) {
+	feeRate, err := estimateFeeRate(client, poolConfTarget())
+	if err != nil {
+		fmt.Println("Failed to get fee from btc node : ", err)
+		feeRate, err = mempoolMinFeeRate(client)
+		if err != nil {
+			return
+		}
+	}
+	coins, err := poolCoins(client, store)
+	if err != nil {
+		fmt.Println("Failed to list pool coins : ", err)
+		return
+	}
+
+	health := policy.Assess(coins, feeRate)
+	leases, err := store.ListUtxoLeases()
+	if err == nil {
+		for _, lease := range leases {
+			if !lease.Released {
+				health.Leased++
+			}
+		}
+	}
+	poolHealth.Lock()
+	poolHealth.health = &health
+	poolHealth.Unlock()
+
+	if !health.Healthy {
+		alert.Notify(alert.Event{
+			Type:     alert.PoolUnderfunded,
+			Severity: alert.Warning,
+			Message:  fmt.Sprintf("fee wallet can fund %d of %d sweeps : %s", health.FundableSweeps, health.SweepsToFund, strings.Join(health.Warnings, ", ")),
+			Details:  map[string]interface{}{"fundable_sweeps": health.FundableSweeps, "sweeps_to_fund": health.SweepsToFund, "feerate": feeRate, "value": health.Value},
+		})
+	}
+	if !viper.GetBool("utxo_pool.enabled") {
+		return
+	}
+
+	// hold the lease lock so no sweep is funded from the coins being spent
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+	coins, err = poolCoins(client, store)
+	if err != nil {
+		return
+	}
+	if split, ok := policy.PlanSplit(coins, feeRate); ok {
+		err = sendPoolTx(client, []coinselect.Coin{split.Coin.Coin}, split.Outputs, feeRate)
+		if err != nil {
+			fmt.Println("Failed to split pool coin : ", err)
+		}
+		return
+	}
+	if dust, ok := policy.PlanConsolidation(coins, feeRate); ok {
+		inputs := make([]coinselect.Coin, len(dust))
+		for i, coin := range dust {
+			inputs[i] = coin.Coin
+		}
+		err = sendPoolTx(client, inputs, nil, feeRate)
+		if err != nil {
+			fmt.Println("Failed to consolidate pool coins : ", err)
+		}
+	}
+}
+
+// poolCoins lists the spendable wallet coins not leased to any transaction.
+func poolCoins(client *rpcclient.Client, store db.Store) ([]utxopool.Coin, error) {
+	utxos, err := client.ListUnspentMinMax(0, 9999999)
+	if err != nil {
+		return nil, err
+	}
+	leases, err := store.ListUtxoLeases()
+	if err != nil {
+		return nil, err
+	}
+	leased := make(map[string]bool)
+	for _, lease := range leases {
+		if !lease.Released {
+			leased[lease.OutPoint] = true
+		}
+	}
+
+	coins := []utxopool.Coin{}
+	for _, utxo := range utxos {
+		if !utxo.Spendable || leased[fmt.Sprintf("%s:%d", utxo.TxID, utxo.Vout)] {
+			continue
+		}
+		hash, err := chainhash.NewHashFromStr(utxo.TxID)
+		if err != nil {
+			return nil, err
+		}
+		pkScript, err := hex.DecodeString(utxo.ScriptPubKey)
+		if err != nil {
+			return nil, err
+		}
+		coins = append(coins, utxopool.Coin{
+			Coin:          coinselect.NewCoin(*wire.NewOutPoint(hash, utxo.Vout), BtcToSats(utxo.Amount), pkScript),
+			Confirmations: utxo.Confirmations,
+		})
+	}
+	return coins, nil
+}
+
+// sendPoolTx spends inputs to outputs paying back to the wallet and sends the
+// rest after the fee at feeRate to a change output when it is not dust.
+func sendPoolTx(client *rpcclient.Client, inputs []coinselect.Coin, outputs []int64, feeRate int64) error {
+	tx := wire.NewMsgTx(wire.TxVersion)
+	total := int64(0)
+	weight := int64(coinselect.TxOverheadWeight)
+	for _, coin := range inputs {
+		outPoint := coin.OutPoint
+		txIn := wire.NewTxIn(&outPoint, nil, nil)
+		txIn.Sequence = wire.MaxTxInSequenceNum - 2
+		tx.AddTxIn(txIn)
+		total += coin.Value
+		weight += coinselect.InputWeightSigHash(coin.Type, txscript.SigHashDefault)
+	}
+
+	for _, value := range append(outputs, 0) {
+		script, err := newWalletScript(client, "", coinselect.ChangeType())
+		if err != nil {
+			return err
+		}
+		tx.AddTxOut(wire.NewTxOut(value, script))
+		total -= value
+		weight += int64(tx.TxOut[len(tx.TxOut)-1].SerializeSize()) * 4
+	}
+
+	// the last output takes the change
+	change := total - coinselect.Fee(weight, feeRate)
+	if change < changeDustLimit {
+		if len(outputs) == 0 {
+			return fmt.Errorf("inputs do not cover the fee")
+		}
+		tx.TxOut = tx.TxOut[:len(tx.TxOut)-1]
+	} else {
+		tx.TxOut[len(tx.TxOut)-1].Value = change
+	}
+
+	signed, err := signTx(client, tx, nil, txscript.SigHashDefault)
+	if err != nil {
+		fmt.Println("Failed to sign transaction: ", err)
+		return err
+	}
+	hash, err := BroadcastBtcTransaction(nil, signed)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Broadcasted pool transaction with txid %s spending %d coins into %d\n", hash.String(), len(inputs), len(signed.TxOut))
+	return nil
+}
@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/twilight-project/rbf-node/signer"
+)
+
+// signTx signs the inputs of tx that are not signed yet through a PSBT handed
+// to the configured signer, then finalizes it and extracts the transaction.
+// Inputs already signed, like those of the sweep, are carried as final.
+// hashType is the sighash of the new signatures, txscript.SigHashDefault when
+// they commit to the whole transaction. prevOuts gives the outputs spent that the node cannot look up, e.g. a
+// parent not broadcast yet.
+func signTx(client *rpcclient.Client, tx *wire.MsgTx, prevOuts map[wire.OutPoint]*wire.TxOut, hashType txscript.SigHashType) (*wire.MsgTx, error) {
+	packet, err := buildPsbt(client, tx, prevOuts, hashType)
+	if err != nil {
+		return nil, err
+	}
+	s, err := signer.New(client, NetParams())
+	if err != nil {
+		return nil, err
+	}
+	signed, err := s.SignPsbt(packet)
+	if err != nil {
+		return nil, fmt.Errorf("%s signer : %w", s.Name(), err)
+	}
+	if signed.UnsignedTx.TxHash() != packet.UnsignedTx.TxHash() {
+		return nil, fmt.Errorf("%s signer returned a different transaction", s.Name())
+	}
+	for i := range signed.Inputs {
+		_, err = psbt.MaybeFinalize(signed, i)
+		if err != nil {
+			return nil, fmt.Errorf("%s signer left input %d unsigned : %w", s.Name(), i, err)
+		}
+	}
+	return psbt.Extract(signed)
+}
+
+// buildPsbt creates the PSBT of tx. Signed inputs are copied as final, the
+// others are annotated with the output they spend, the sighash to use and
+// the wallet's derivation path of their key.
+func buildPsbt(client *rpcclient.Client, tx *wire.MsgTx, prevOuts map[wire.OutPoint]*wire.TxOut, hashType txscript.SigHashType) (*psbt.Packet, error) {
+	unsigned := tx.Copy()
+	for _, txIn := range unsigned.TxIn {
+		txIn.SignatureScript = nil
+		txIn.Witness = nil
+	}
+	packet, err := psbt.NewFromUnsignedTx(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	updater, err := psbt.NewUpdater(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, txIn := range tx.TxIn {
+		if len(txIn.Witness) > 0 || len(txIn.SignatureScript) > 0 {
+			err = setFinal(packet, i, txIn)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		txOut, ok := prevOuts[txIn.PreviousOutPoint]
+		if !ok {
+			value, pkScript, err := prevOut(client, txIn.PreviousOutPoint)
+			if err != nil {
+				return nil, err
+			}
+			txOut = wire.NewTxOut(value, pkScript)
+		}
+		info := walletAddressInfo(client, txOut.PkScript)
+		if isWitnessInput(txOut.PkScript, info) {
+			err = updater.AddInWitnessUtxo(txOut, i)
+		} else {
+			// legacy inputs need the whole previous transaction
+			var prevTx *wire.MsgTx
+			prevTx, err = getRawTx(client, txIn.PreviousOutPoint)
+			if err == nil {
+				err = updater.AddInNonWitnessUtxo(prevTx, i)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		// SIGHASH_DEFAULT is left unset: SIGHASH_ALL for segwit v0 inputs,
+		// a 64 byte signature for taproot ones
+		if hashType != txscript.SigHashDefault {
+			err = updater.AddInSighashType(hashType, i)
+			if err != nil {
+				return nil, err
+			}
+		}
+		addKeyInfo(updater, txOut.PkScript, info, i)
+	}
+	return packet, nil
+}
+
+// setFinal carries the signature of an input signed elsewhere.
+func setFinal(packet *psbt.Packet, i int, txIn *wire.TxIn) error {
+	if len(txIn.SignatureScript) > 0 {
+		packet.Inputs[i].FinalScriptSig = txIn.SignatureScript
+	}
+	if len(txIn.Witness) > 0 {
+		var buf bytes.Buffer
+		err := psbt.WriteTxWitness(&buf, txIn.Witness)
+		if err != nil {
+			return err
+		}
+		packet.Inputs[i].FinalScriptWitness = buf.Bytes()
+	}
+	return nil
+}
+
+// walletAddressInfo returns what the wallet knows of the address paying to
+// pkScript, nil when it is not one of its own.
+func walletAddressInfo(client *rpcclient.Client, pkScript []byte) *btcjson.GetAddressInfoResult {
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(pkScript, NetParams())
+	if err != nil || len(addrs) != 1 {
+		return nil
+	}
+	info, err := client.GetAddressInfo(addrs[0].EncodeAddress())
+	if err != nil || !info.IsMine {
+		return nil
+	}
+	return info
+}
+
+// isWitnessInput tells whether an output paying to pkScript is spent with a
+// witness. P2SH is only known to wrap a witness program from the wallet.
+func isWitnessInput(pkScript []byte, info *btcjson.GetAddressInfoResult) bool {
+	if txscript.IsWitnessProgram(pkScript) {
+		return true
+	}
+	return txscript.IsPayToScriptHash(pkScript) && info != nil && info.Embedded != nil && info.Embedded.IsWitness
+}
+
+func getRawTx(client *rpcclient.Client, outPoint wire.OutPoint) (*wire.MsgTx, error) {
+	tx, err := client.GetRawTransaction(&outPoint.Hash)
+	if err != nil {
+		return nil, err
+	}
+	return tx.MsgTx(), nil
+}
+
+// addKeyInfo adds the redeem script and the derivation path of the key the
+// wallet uses for an input, so a signer holding the keys but not the wallet
+// can sign it. Missing or malformed details are left out.
+func addKeyInfo(updater *psbt.Updater, pkScript []byte, info *btcjson.GetAddressInfoResult, i int) {
+	if info == nil {
+		return
+	}
+	if info.IsScript && info.Hex != nil {
+		redeemScript, err := hex.DecodeString(*info.Hex)
+		if err == nil {
+			_ = updater.AddInRedeemScript(redeemScript, i)
+		}
+	}
+	if info.PubKey == nil || info.HDKeyPath == nil || info.HDMasterFingerprint == nil {
+		return
+	}
+	pubKey, err := hex.DecodeString(*info.PubKey)
+	if err != nil {
+		return
+	}
+	fingerprint, err := hex.DecodeString(*info.HDMasterFingerprint)
+	if err != nil || len(fingerprint) != 4 {
+		return
+	}
+	path, err := signer.ParsePath(*info.HDKeyPath)
+	if err != nil {
+		return
+	}
+	// PSBTs carry the fingerprint bytes in order, read as little endian
+	masterKey := binary.LittleEndian.Uint32(fingerprint)
+
+	if !txscript.IsPayToTaproot(pkScript) {
+		_ = updater.AddInBip32Derivation(masterKey, path, pubKey, i)
+		return
+	}
+	// the wallet gives the internal key of a key path only output, x-only
+	// or compressed
+	if len(pubKey) == 33 {
+		pubKey = pubKey[1:]
+	}
+	if len(pubKey) != 32 {
+		return
+	}
+	input := &updater.Upsbt.Inputs[i]
+	input.TaprootInternalKey = pubKey
+	input.TaprootBip32Derivation = append(input.TaprootBip32Derivation, &psbt.TaprootBip32Derivation{
+		XOnlyPubKey:          pubKey,
+		MasterKeyFingerprint: masterKey,
+		Bip32Path:            path,
+	})
+}
@@ -2,23 +2,32 @@ package utils
 
 import (
 	"bytes"
-	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/spf13/viper"
+	"github.com/twilight-project/rbf-node/alert"
+	"github.com/twilight-project/rbf-node/chainnotify"
+	"github.com/twilight-project/rbf-node/coinselect"
 	"github.com/twilight-project/rbf-node/db"
+	"github.com/twilight-project/rbf-node/feebudget"
+	"github.com/twilight-project/rbf-node/feebump"
+	"github.com/twilight-project/rbf-node/feemath"
+	"github.com/twilight-project/rbf-node/pinning"
 	"github.com/twilight-project/rbf-node/types"
 )
 
@@ -26,25 +35,6 @@ func BtcToSats(btc float64) int64 {
 	return int64(btc * 1e8)
 }
 
-func GetFeeFromBtcNode(tx *wire.MsgTx) (int64, error) {
-	client := getBitcoinRpcClient()
-	result, err := client.EstimateSmartFee(2, &btcjson.EstimateModeConservative)
-	if err != nil {
-		fmt.Println("Failed to get fee from btc node : ", err)
-		log.Fatal(err)
-	}
-	fmt.Printf("Estimated fee per kilobyte for a transaction to be confirmed within 2 blocks: %f BTC\n", *result.FeeRate)
-	feeRate := BtcToSats(*result.FeeRate)
-	fmt.Printf("Estimated fee per kilobyte for a transaction to be confirmed within 2 blocks: %d Sats\n", feeRate)
-	baseSize := tx.SerializeSizeStripped()
-	totalSize := tx.SerializeSize()
-	weight := (baseSize * 3) + totalSize
-	vsize := (weight + 3) / 4
-	fmt.Println("tx size in bytes : ", vsize)
-	fee := float64(vsize) * float64(feeRate/1024)
-	return int64(fee), nil
-}
-
 func getBitcoinRpcClient() *rpcclient.Client {
 	host := viper.GetString("btc_node_ip_and_port")
 	walletName := viper.GetString("btc_core_wallet_name")
@@ -66,15 +56,87 @@ func getBitcoinRpcClient() *rpcclient.Client {
 	return client
 }
 
-func BroadcastBtcTransaction(tx *wire.MsgTx) {
+// NewBitcoinRpcClient returns a client for the configured bitcoind wallet.
+func NewBitcoinRpcClient() *rpcclient.Client {
+	return getBitcoinRpcClient()
+}
+
+// BroadcastBtcTransaction verifies tx with verifyBroadcast and sends it with
+// sendrawtransaction, or only checks it with testmempoolaccept in dry run
+// mode. store looks up the outputs of tracked transactions not broadcast
+// yet, it may be nil. A transaction refused by the checks or by the node is
+// returned as a *RejectedError.
+func BroadcastBtcTransaction(store db.Store, tx *wire.MsgTx) (*chainhash.Hash, error) {
 	client := getBitcoinRpcClient()
+	defer client.Shutdown()
+
+	rejections, err := verifyBroadcast(client, store, tx)
+	if err != nil {
+		// the node reports what it refuses when broadcasting
+		fmt.Println("Failed to verify transaction before broadcast : ", err)
+	}
+	if len(rejections) > 0 {
+		err = &RejectedError{Rejections: rejections}
+		fmt.Println("Refusing to broadcast : ", err)
+		return nil, err
+	}
+
+	if DryRun() {
+		err := simulateBroadcast(client, tx)
+		if err != nil {
+			return nil, err
+		}
+		txHash := tx.TxHash()
+		return &txHash, nil
+	}
+
 	txHash, err := client.SendRawTransaction(tx, true)
 	if err != nil {
 		fmt.Println("Failed to broadcast transaction : ", err)
+		var rpcErr *btcjson.RPCError
+		if errors.As(err, &rpcErr) {
+			return nil, &RejectedError{Rejections: errorRejections(err), Err: err}
+		}
+		return nil, err
 	}
 
-	defer client.Shutdown()
 	fmt.Println("broadcasted btc transaction, txhash : ", txHash)
+	return txHash, nil
+}
+
+// broadcastResultState maps the outcome of sendrawtransaction to the state the
+// tracked transaction should move to. An empty state means the transaction
+// should stay where it is and be retried.
+func broadcastResultState(err error) types.TxState {
+	if err == nil {
+		return types.TxStateBroadcast
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "already in block chain"),
+		strings.Contains(msg, "txn-already-known"),
+		strings.Contains(msg, "txn-already-in-mempool"):
+		return types.TxStateBroadcast
+	case errors.Is(err, ErrApprovalRequired):
+		return ""
+	}
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		return rejectionState(rejected.Rejections)
+	}
+	switch {
+	case strings.Contains(msg, "non-final"),
+		strings.Contains(msg, "non-BIP68-final"),
+		strings.Contains(msg, "too-long-mempool-chain"),
+		isFeeTooLow(err):
+		return ""
+	case strings.Contains(msg, "txn-mempool-conflict"),
+		strings.Contains(msg, "bad-txns-inputs-missingorspent"),
+		strings.Contains(msg, "missing-inputs"):
+		return types.TxStateConflicted
+	default:
+		return types.TxStateFailed
+	}
 }
 
 func CreateTxFromHex(txHex string) (*wire.MsgTx, error) {
@@ -166,19 +228,123 @@ func GetUnspentUTXOs(walletName string) ([]btcjson.ListUnspentResult, error) {
 	return utxos, nil
 }
 
-func AddInputsToCoverFee(tx *wire.MsgTx, walletName string, fee int64) (*wire.MsgTx, int64, error) {
+// changeDustLimit is the smallest change output created, anything below is
+// left to the fee.
+const changeDustLimit = 546
+
+// AddInputsToCoverFee adds wallet inputs to tx so that it pays fee plus the
+// cost of the inputs and change added, and returns the number of inputs added
+// and the fee actually paid. The inputs are leased to the tracked transaction
+// id.
+func AddInputsToCoverFee(store db.Store, id int64, tx *wire.MsgTx, walletName string, fee int64) (*wire.MsgTx, int64, int64, error) {
+	return addFeeInputs(store, id, tx, walletName, fee, 0)
+}
+
+// fundAttempts bounds how often FundTx selects inputs again when the signed
+// transaction came out larger than estimated.
+const fundAttempts = 3
+
+// FundTx adds fee inputs to tx, leased to the tracked transaction id, so that
+// once signed it pays the fee estimate on its final size, inputs and change
+// included. The confirmation target comes from the blocks between the unlock
+// height and the deadline, see feebump.Policy.ConfTarget. Inputs are selected
+// again for the measured size when the signatures came out larger than
+// estimated. It returns the funded and the signed transaction and the fee
+// paid.
+func FundTx(store db.Store, id int64, tx *wire.MsgTx, unlockHeight int64, deadlineHeight int64) (*wire.MsgTx, *wire.MsgTx, int64, error) {
+	client := getBitcoinRpcClient()
+	defer client.Shutdown()
+
+	height, err := client.GetBlockCount()
+	if err != nil {
+		fmt.Println("Error getting block count: ", err)
+		return nil, nil, 0, err
+	}
+	target := feebump.NewPolicy().ConfTarget(feebump.State{Height: height, UnlockHeight: unlockHeight, DeadlineHeight: deadlineHeight})
+	feeRate, err := estimateFeeRate(client, target)
+	if err != nil {
+		fmt.Println("Failed to get fee from btc node : ", err)
+		return nil, nil, 0, err
+	}
+	prevOuts := make([]feemath.PrevOut, len(tx.TxIn))
+	for i, txIn := range tx.TxIn {
+		_, pkScript, err := prevOut(client, txIn.PreviousOutPoint)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		prevOuts[i] = feemath.PrevOut{PkScript: pkScript}
+	}
+	fee := coinselect.Fee(feemath.EstimateWeight(tx, prevOuts), feeRate)
+	fmt.Printf("Estimated feerate %d sat/kvB for %d blocks, fee before inputs %d sats\n", feeRate, target, fee)
+
+	var funded *wire.MsgTx
+	signed, fee, err := feemath.Converge(fee, feeRate, fundAttempts, func(fee int64) (*wire.MsgTx, int64, error) {
+		var paid int64
+		var err error
+		funded, _, paid, err = addFeeInputs(store, id, tx.Copy(), "", fee, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		signed, err := SignNewFeeInputs(funded)
+		if err != nil {
+			releaseCoins(client, store, addedInputs(funded, tx))
+			return nil, 0, err
+		}
+		return signed, paid, nil
+	}, func(signed *wire.MsgTx) {
+		releaseCoins(client, store, addedInputs(signed, tx))
+	})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	err = checkSweepIntegrity(client, tx, signed)
+	if err != nil {
+		if isIntegrityError(err) {
+			notifySweepIntegrity(types.TrackedTx{Id: id, Txid: tx.TxHash().String()}, signed.TxHash().String(), err)
+		}
+		releaseCoins(client, store, addedInputs(signed, tx))
+		return nil, nil, 0, err
+	}
+	return funded, signed, fee, nil
+}
+
+// coinSelectionParams returns the coin selection settings, coin_selection
+// picks the algorithm and coin_selection_long_term_feerate the feerate in
+// sat/kvB coins are expected to be spent at otherwise.
+func coinSelectionParams() (string, int64) {
+	longTermFeeRate := viper.GetInt64("coin_selection_long_term_feerate")
+	if longTermFeeRate <= 0 {
+		longTermFeeRate = 10000
+	}
+	return viper.GetString("coin_selection"), longTermFeeRate
+}
+
+// addFeeInputs selects wallet inputs so that tx pays fee at least, plus what
+// the selected inputs and change cost at the same feerate, and returns the
+// number of inputs added and the fee paid. The selected coins are leased to
+// the tracked transaction id. walletInputs is the number of wallet inputs
+// already at the end of tx, change is only paid back when the transaction has
+// some.
+func addFeeInputs(store db.Store, id int64, tx *wire.MsgTx, walletName string, fee int64, walletInputs int64) (*wire.MsgTx, int64, int64, error) {
 	client := getBitcoinRpcClient()
 	defer client.Shutdown()
 
 	// Get the total value of the existing inputs
 	totalInputValue := int64(0)
-	for _, txIn := range tx.TxIn {
-		utxo, err := client.GetTxOut(&txIn.PreviousOutPoint.Hash, txIn.PreviousOutPoint.Index, true)
+	spent := make(map[wire.OutPoint]bool)
+	prevOuts := make([]feemath.PrevOut, len(tx.TxIn))
+	for i, txIn := range tx.TxIn {
+		value, pkScript, err := prevOut(client, txIn.PreviousOutPoint)
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, 0, err
 		}
-		totalInputValue += int64(utxo.Value)
+		totalInputValue += value
+		spent[txIn.PreviousOutPoint] = true
+		prevOuts[i] = feemath.PrevOut{PkScript: pkScript}
 	}
+	// the feerate fee pays for tx once its inputs are signed, the selected
+	// inputs and change pay for themselves at the same feerate
+	feeRate := feemath.FeeRate(fee, feemath.EstimateWeight(tx, prevOuts))
 
 	totalOutputValue := int64(0)
 	for _, txOut := range tx.TxOut {
@@ -186,71 +352,154 @@ func AddInputsToCoverFee(tx *wire.MsgTx, walletName string, fee int64) (*wire.Ms
 	}
 
 	feeInputs := int64(0)
+	change := totalInputValue - totalOutputValue - fee
 	// If the total input value is less than the estimated fee, add new inputs to the transaction
-	if totalInputValue-totalOutputValue < fee {
-		utxos, err := GetUnspentUTXOs(walletName)
-		if err != nil {
-			return nil, 0, err
+	if change < 0 {
+		var selection *coinselect.Selection
+		listUtxos := func() ([]btcjson.ListUnspentResult, error) {
+			return GetUnspentUTXOs(walletName)
 		}
-
-		for _, utxo := range utxos {
-			if totalInputValue-totalOutputValue >= fee {
-				if totalInputValue-totalOutputValue > fee {
-					addr, err := client.GetNewAddress(walletName)
-					if err != nil {
-						fmt.Println("Error getting new address: ", err)
-						return nil, 0, err
-					}
-
-					// Generate the pay-to-address script.
-					destinationAddrByte, err := txscript.PayToAddrScript(addr)
-					if err != nil {
-						fmt.Println("Error generating pay-to-address script:", err)
-						return nil, 0, err
-					}
-					amount := totalInputValue - totalOutputValue - fee
-					txOut := wire.NewTxOut(amount, destinationAddrByte)
-					tx.AddTxOut(txOut)
+		_, err := reserveCoins(client, store, id, listUtxos, func(utxos []btcjson.ListUnspentResult) ([]wire.OutPoint, error) {
+			coins := []coinselect.Coin{}
+			for _, utxo := range utxos {
+				hash, err := chainhash.NewHashFromStr(utxo.TxID)
+				if err != nil {
+					return nil, err
+				}
+				outPoint := wire.NewOutPoint(hash, utxo.Vout)
+				if spent[*outPoint] {
+					continue
+				}
+				pkScript, err := hex.DecodeString(utxo.ScriptPubKey)
+				if err != nil {
+					return nil, err
 				}
-				break
+				coins = append(coins, coinselect.NewCoin(*outPoint, BtcToSats(utxo.Amount), pkScript))
 			}
 
-			hash, err := chainhash.NewHashFromStr(utxo.TxID)
+			algorithm, longTermFeeRate := coinSelectionParams()
+			params := coinselect.Params{
+				Target:          -change,
+				FeeRate:         feeRate,
+				LongTermFeeRate: longTermFeeRate,
+				ChangeType:      coinselect.ChangeType(),
+			}
+			var err error
+			selection, err = coinselect.SelectWith(algorithm, coins, params)
 			if err != nil {
-				return nil, 0, err
+				return nil, fmt.Errorf("%v, missing %d sats", err, -change)
 			}
-			outPoint := wire.NewOutPoint(hash, utxo.Vout)
-			txIn := wire.NewTxIn(outPoint, nil, nil)
-			tx.AddTxIn(txIn)
+			outPoints := make([]wire.OutPoint, len(selection.Coins))
+			for i, coin := range selection.Coins {
+				outPoints[i] = coin.OutPoint
+			}
+			return outPoints, nil
+		})
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		fmt.Printf("Selected %d fee inputs with %s\n", len(selection.Coins), selection.Algorithm)
 
-			totalInputValue += int64(utxo.Amount)
+		for _, coin := range selection.Coins {
+			outPoint := coin.OutPoint
+			txIn := wire.NewTxIn(&outPoint, nil, nil)
+			// signal replaceability so the fee can be bumped later
+			txIn.Sequence = wire.MaxTxInSequenceNum - 2
+			tx.AddTxIn(txIn)
 			feeInputs += 1
 		}
+		fee += selection.Fee
+		change = selection.Change
 	}
-	return tx, feeInputs, nil
-}
 
-func SignNewFeeInputs(tx *wire.MsgTx, n int64) (*wire.MsgTx, error) {
-	client := getBitcoinRpcClient()
+	if walletInputs+feeInputs > 0 && change >= changeDustLimit {
+		destinationAddrByte, err := newWalletScript(client, walletName, coinselect.ChangeType())
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		tx.AddTxOut(wire.NewTxOut(change, destinationAddrByte))
+	} else {
+		fee += change
+	}
+	return tx, feeInputs, fee, nil
+}
 
-	inputs := tx.TxIn[int64(len(tx.TxIn))-n:]
-	witnessInputs := make([]btcjson.RawTxWitnessInput, len(inputs))
-	for i, input := range inputs {
-		witnessInputs[i] = btcjson.RawTxWitnessInput{
-			Txid: input.PreviousOutPoint.Hash.String(),
-			Vout: input.PreviousOutPoint.Index,
+// newWalletScript returns the script of a new wallet address of type t,
+// labelled label.
+func newWalletScript(client *rpcclient.Client, label string, t coinselect.ScriptType) ([]byte, error) {
+	// decoded here for btc_network, the client assumes mainnet
+	params := []json.RawMessage{}
+	for _, param := range []string{label, coinselect.AddressType(t)} {
+		raw, err := json.Marshal(param)
+		if err != nil {
+			return nil, err
 		}
+		params = append(params, raw)
+	}
+	raw, err := client.RawRequest("getnewaddress", params)
+	var encoded string
+	if err == nil {
+		err = json.Unmarshal(raw, &encoded)
+	}
+	var addr btcutil.Address
+	if err == nil {
+		addr, err = btcutil.DecodeAddress(encoded, NetParams())
+	}
+	if err != nil {
+		fmt.Println("Error getting new address: ", err)
+		return nil, err
+	}
+	script, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		fmt.Println("Error generating pay-to-address script:", err)
+		return nil, err
 	}
+	return script, nil
+}
+
+// ErrSpentOrUnknown is returned by prevOut for an output in neither the
+// mempool nor the utxo set.
+var ErrSpentOrUnknown = errors.New("is spent or unknown")
 
-	// Sign the new transaction
+// prevOutValue returns the value of an unspent output in sats.
+func prevOutValue(client *rpcclient.Client, outPoint wire.OutPoint) (int64, error) {
+	value, _, err := prevOut(client, outPoint)
+	return value, err
+}
 
-	signedTx, _, err := client.SignRawTransactionWithWallet3(tx, witnessInputs, rpcclient.SigHashType(txscript.SigHashAll|txscript.SigHashAnyOneCanPay))
+// prevOut returns the value in sats and the script of an unspent output.
+// Outputs already spent in the mempool, e.g. by a transaction being replaced,
+// are looked up in the utxo set of the chain.
+func prevOut(client *rpcclient.Client, outPoint wire.OutPoint) (int64, []byte, error) {
+	utxo, err := client.GetTxOut(&outPoint.Hash, outPoint.Index, true)
+	if err == nil && utxo == nil {
+		utxo, err = client.GetTxOut(&outPoint.Hash, outPoint.Index, false)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if utxo == nil {
+		return 0, nil, fmt.Errorf("input %s %w", outPoint, ErrSpentOrUnknown)
+	}
+	pkScript, err := hex.DecodeString(utxo.ScriptPubKey.Hex)
+	if err != nil {
+		return 0, nil, err
+	}
+	return BtcToSats(utxo.Value), pkScript, nil
+}
+
+// SignNewFeeInputs signs the fee inputs added to tx with SIGHASH_ALL|ANYONECANPAY
+// through the configured signer. The inputs of the sweep keep their
+// signatures.
+func SignNewFeeInputs(tx *wire.MsgTx) (*wire.MsgTx, error) {
+	client := getBitcoinRpcClient()
+
+	signedTx, err := signTx(client, tx, nil, txscript.SigHashAll|txscript.SigHashAnyOneCanPay)
 	if err != nil {
 		fmt.Println("Failed to sign transaction: ", err)
 		return nil, err
 	}
 	return signedTx, nil
-
 }
 
 func txToHex(tx *wire.MsgTx) (string, error) {
@@ -262,69 +511,193 @@ func txToHex(tx *wire.MsgTx) (string, error) {
 	return hex.EncodeToString(buf.Bytes()), nil
 }
 
-func GetBroadCastedRefundTx() types.BroadcastRefundMsg {
+// GetBroadCastedRefundTxs returns every pending refund published by the bridge,
+// following the Nyks REST pagination until the last page.
+func GetBroadCastedRefundTxs() ([]types.BroadcastRefundMsg, error) {
 	nyksd_url := fmt.Sprintf("%v", viper.Get("nyksd_url"))
-	path := fmt.Sprintf("/twilight-project/nyks/bridge/broadcast_tx_refund_all")
-	resp, err := http.Get(nyksd_url + path)
-	if err != nil {
-		fmt.Println("error getting broadcasted refund : ", err)
-	}
-	//We Read the response body on the line below.
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("error getting broadcasted refund body : ", err)
-	}
+	path := "/twilight-project/nyks/bridge/broadcast_tx_refund_all"
 
-	a := types.BroadcastRefundMsgResp{}
-	err = json.Unmarshal(body, &a)
-	if err != nil {
-		fmt.Println("error unmarshalling broadcasted refund : ", err)
+	refunds := []types.BroadcastRefundMsg{}
+	nextKey := ""
+	for {
+		body, err := getNyksPage(nyksd_url+path, nextKey)
+		if err != nil {
+			fmt.Println("error getting broadcasted refund : ", err)
+			return nil, err
+		}
+
+		a := types.BroadcastRefundMsgResp{}
+		err = json.Unmarshal(body, &a)
+		if err != nil {
+			fmt.Println("error unmarshalling broadcasted refund : ", err)
+			return nil, err
+		}
+		refunds = append(refunds, a.BroadcastRefundMsg...)
+
+		if a.Pagination.NextKey == "" || a.Pagination.NextKey == nextKey {
+			break
+		}
+		nextKey = a.Pagination.NextKey
 	}
-	return a.BroadcastRefundMsg[0]
+	return refunds, nil
 }
 
-func GetBroadCastedSweepTx() (types.BroadcastTxSweepMsg, error) {
+// GetBroadCastedSweepTxs returns every pending sweep published by the bridge,
+// following the Nyks REST pagination until the last page.
+func GetBroadCastedSweepTxs() ([]types.BroadcastTxSweepMsg, error) {
 	nyksd_url := fmt.Sprintf("%v", viper.Get("nyksd_url"))
-	path := fmt.Sprintf("/twilight-project/nyks/bridge/broadcast_tx_sweep_all")
-	resp, err := http.Get(nyksd_url + path)
-	if err != nil {
-		fmt.Println("error getting broadcasted sweep : ", err)
-	}
-	//We Read the response body on the line below.
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("error getting broadcasted sweep body : ", err)
+	path := "/twilight-project/nyks/bridge/broadcast_tx_sweep_all"
+
+	sweeps := []types.BroadcastTxSweepMsg{}
+	nextKey := ""
+	for {
+		body, err := getNyksPage(nyksd_url+path, nextKey)
+		if err != nil {
+			fmt.Println("error getting broadcasted sweep : ", err)
+			return nil, err
+		}
+
+		a := types.BroadcastSweepMsgResp{}
+		err = json.Unmarshal(body, &a)
+		if err != nil {
+			fmt.Println("error unmarshalling broadcasted sweep : ", err)
+			return nil, err
+		}
+		sweeps = append(sweeps, a.BroadcastTxSweepMsg...)
+
+		if a.Pagination.NextKey == "" || a.Pagination.NextKey == nextKey {
+			break
+		}
+		nextKey = a.Pagination.NextKey
 	}
+	return sweeps, nil
+}
 
-	a := types.BroadcastSweepMsgResp{}
-	err = json.Unmarshal(body, &a)
+func getNyksPage(endpoint string, pageKey string) ([]byte, error) {
+	if pageKey != "" {
+		endpoint = endpoint + "?pagination.key=" + url.QueryEscape(pageKey)
+	}
+	resp, err := http.Get(endpoint)
 	if err != nil {
-		fmt.Println("error unmarshalling broadcasted sweep : ", err)
+		return nil, err
 	}
-	if len(a.BroadcastTxSweepMsg) > 0 {
-		return a.BroadcastTxSweepMsg[0], nil
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from nyks : %s", resp.Status)
 	}
-	return types.BroadcastTxSweepMsg{}, fmt.Errorf("No sweep transaction found")
+	//We Read the response body on the line below.
+	return io.ReadAll(resp.Body)
 }
 
-func BroadcastOnBtc(dbconn *sql.DB) {
+// BroadcastOnBtc broadcasts signed transactions once their unlock height is
+// reached. It runs whenever a block is connected and every
+// broadcast_interval_seconds to pick up newly stored transactions.
+func BroadcastOnBtc(store db.Store, events <-chan chainnotify.Event) {
 	fmt.Println("Started Btc Broadcaster")
 	client := getBitcoinRpcClient()
+	idle := configuredInterval("broadcast_interval_seconds", 10*time.Second)
 	for {
-		blockHeight, err := client.GetBlockCount()
+		broadcastReadyTxs(client, store)
+		chainnotify.Wait(events, idle, func(e chainnotify.Event) bool {
+			return e.Type == chainnotify.BlockConnected
+		})
+	}
+}
+
+func broadcastReadyTxs(client *rpcclient.Client, store db.Store) {
+	blockHeight, err := client.GetBlockCount()
+	if err != nil {
+		fmt.Println("Error getting block count: ", err)
+		return
+	}
+	txs, err := store.QueryTrackedTxByState(types.TxStateSigned, types.TxStateWaitingForHeight)
+	if err != nil {
+		return
+	}
+	for _, tx := range txs {
+		if tx.UnlockHeight > blockHeight {
+			if tx.State == types.TxStateSigned {
+				_ = store.TransitionTx(tx.Id, types.TxStateWaitingForHeight, 0)
+			}
+			continue
+		}
+
+		transaction := hex.EncodeToString(tx.Tx)
+		wireTransaction, err := CreateTxFromHex(transaction)
 		if err != nil {
-			log.Fatalf("Error getting block count: %v", err)
+			fmt.Println("error decodeing signed transaction btc broadcaster : ", err)
+			_ = store.FailTx(tx.Id, types.FailureBroadcast)
+			notifyBroadcastFailure(tx, types.TxStateFailed, err)
+			continue
 		}
-		txs := db.QuerySignedTx(dbconn, blockHeight)
-		for _, tx := range txs {
-			transaction := hex.EncodeToString(tx)
-			wireTransaction, err := CreateTxFromHex(transaction)
+		if len(tx.NyksTx) > 0 {
+			nyksTx, err := deserializeTx(tx.NyksTx)
+			if err == nil {
+				err = checkSweepIntegrity(client, nyksTx, wireTransaction)
+			}
+			if isIntegrityError(err) {
+				fmt.Println("Refusing to broadcast : ", err)
+				_ = store.FailTx(tx.Id, types.FailureBroadcast)
+				notifySweepIntegrity(tx, wireTransaction.TxHash().String(), err)
+				continue
+			}
 			if err != nil {
-				fmt.Println("error decodeing signed transaction btc broadcaster : ", err)
+				// inputs that cannot be looked up are reported by the node
+				fmt.Println("Failed to check sweep integrity : ", err)
 			}
-			BroadcastBtcTransaction(wireTransaction)
 		}
+		broadcastErr := broadcastTrackedTx(client, store, tx, wireTransaction)
+		recordRejections(store, tx, broadcastErr)
+		state := broadcastResultState(broadcastErr)
+		if state == "" {
+			if tx.State == types.TxStateSigned {
+				_ = store.TransitionTx(tx.Id, types.TxStateWaitingForHeight, 0)
+			}
+			continue
+		}
+		if state == types.TxStateFailed {
+			err = store.FailTx(tx.Id, types.FailureBroadcast)
+		} else {
+			err = store.TransitionTx(tx.Id, state, 0)
+		}
+		if err != nil {
+			fmt.Println("error updating broadcasted transaction state : ", err)
+		}
+		if state != types.TxStateBroadcast {
+			notifyBroadcastFailure(tx, state, broadcastErr)
+			continue
+		}
+		err = store.SetTrackedTxBroadcastHeight(tx.Id, blockHeight)
+		if err != nil {
+			fmt.Println("error updating broadcast height : ", err)
+		}
+	}
+}
+
+func notifyBroadcastFailure(tx types.TrackedTx, state types.TxState, err error) {
+	eventType := alert.BroadcastFailed
+	if state == types.TxStateConflicted {
+		eventType = alert.TxConflicted
 	}
+	alert.Notify(alert.Event{
+		Type:      eventType,
+		Severity:  alert.Critical,
+		Txid:      tx.Txid,
+		ReserveId: tx.ReserveId,
+		RoundId:   tx.RoundId,
+		Reason:    rejectionReason(err),
+		Message:   fmt.Sprintf("%s transaction could not be broadcast : %v", tx.TxType, err),
+	})
+}
+
+// configuredInterval reads a duration in seconds from the config.
+func configuredInterval(key string, fallback time.Duration) time.Duration {
+	seconds := viper.GetInt64(key)
+	if seconds <= 0 {
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
 }
 
 func DecodeBtcScript(script string) string {
@@ -360,148 +733,429 @@ func GetHeightFromScript(script string) int64 {
 	return height
 }
 
-func CheckPinning(dbconn *sql.DB) {
+// GetRefundHeightFromScript returns the height from which the refund branch
+// of a reserve script spending outPoint opens. The operand of
+// OP_CHECKLOCKTIMEVERIFY is that height, the one of OP_CHECKSEQUENCEVERIFY
+// counts blocks from the confirmation of outPoint. It returns 0 when the
+// height is not known.
+func GetRefundHeightFromScript(script string, outPoint wire.OutPoint) int64 {
+	parts := strings.Split(script, " ")
+	for i := len(parts) - 1; i > 0; i-- {
+		switch parts[i] {
+		case "OP_CHECKLOCKTIMEVERIFY":
+			return scriptNumber(parts[i-1])
+		case "OP_CHECKSEQUENCEVERIFY":
+			return relativeRefundHeight(scriptNumber(parts[i-1]), outPoint)
+		}
+	}
+	return 0
+}
+
+// scriptNumber reads a number pushed in a disassembled script, as OP_1 to
+// OP_16 or as little endian hex.
+func scriptNumber(part string) int64 {
+	if strings.HasPrefix(part, "OP_") {
+		n, err := strconv.ParseInt(strings.TrimPrefix(part, "OP_"), 10, 64)
+		if err != nil {
+			fmt.Println("Error reading number from script : ", part)
+			return 0
+		}
+		return n
+	}
+	return GetHeightFromScript(part)
+}
+
+// relativeRefundHeight turns a BIP68 relative locktime into the height it
+// ends at for outPoint. Locktimes in time units and outputs not confirmed yet
+// have no height.
+func relativeRefundHeight(sequence int64, outPoint wire.OutPoint) int64 {
+	if sequence&wire.SequenceLockTimeDisabled != 0 {
+		return 0
+	}
+	if sequence&wire.SequenceLockTimeIsSeconds != 0 {
+		fmt.Println("Refund branch uses a relative locktime in time units, it has no refund height")
+		return 0
+	}
+	client := getBitcoinRpcClient()
+	defer client.Shutdown()
+
+	height, err := outputHeight(client, outPoint)
+	if err != nil {
+		fmt.Println("Failed to get confirmation height of reserve output : ", err)
+		return 0
+	}
+	if height == 0 {
+		fmt.Printf("Reserve output %s is not confirmed, its refund height is not known yet\n", outPoint)
+		return 0
+	}
+	return height + sequence&wire.SequenceLockTimeMask
+}
+
+// CheckPinning watches the mempool for transactions pinning our broadcast
+// transactions: conflicting spends of their inputs, large low feerate
+// descendants and descendant chains at the mempool limits. Transactions
+// announced through the chain notifier are checked one by one. When a block
+// arrives or every pinning_scan_interval_seconds each tracked transaction is
+// checked again through the spends of its inputs and its mempool entry,
+// without walking the mempool.
+func CheckPinning(store db.Store, events <-chan chainnotify.Event) {
 	client := getBitcoinRpcClient()
 	defer client.Shutdown()
+	analyzer := pinning.NewAnalyzer(client)
+	idle := configuredInterval("pinning_scan_interval_seconds", time.Minute)
 
+	fullScan := true
 	for {
-		// Get the list of transactions in the mempool
-		txs := db.QuerySignedTxAll(dbconn)
-		for _, tx := range txs {
-			transaction := hex.EncodeToString(tx)
-			wireTransaction, err := CreateTxFromHex(transaction)
-			if err != nil {
-				fmt.Println("error decodeing signed transaction btc broadcaster : ", err)
-				continue
+		txs, err := store.QueryTrackedTxByState(types.TxStateBroadcast, types.TxStateInMempool)
+		if err != nil {
+			txs = nil
+		}
+		tracked := trackedMempoolTxs(txs)
+
+		if fullScan {
+			for _, tx := range tracked {
+				checkTrackedTx(client, analyzer, store, tx)
 			}
-			utxo := wireTransaction.TxHash().String()
+		}
 
-			txids, err := client.GetRawMempool()
-			if err != nil {
-				fmt.Println("Failed to get mempool transactions: ", err)
+		matched := chainnotify.Wait(events, idle, func(e chainnotify.Event) bool {
+			return e.Type == chainnotify.TxAdded || e.Type == chainnotify.BlockConnected || e.Type == chainnotify.BlockDisconnected
+		})
+		fullScan = matched == nil
+		for _, event := range matched {
+			if event.Type != chainnotify.TxAdded {
+				fullScan = true
 				continue
 			}
-
-			// Check each transaction in the mempool
-			for _, txid := range txids {
-				rawTx, err := client.GetRawTransaction(txid)
-				if err != nil {
-					fmt.Println("Failed to get raw transaction: ", err)
-					continue
-				}
-
-				decodedTx := rawTx.MsgTx()
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				// Check each input in the transaction
-				for _, vin := range decodedTx.TxIn {
-					if vin.PreviousOutPoint.Hash.String() == utxo {
-						fmt.Printf("Transaction %s in the mempool spends UTXO \n", txid)
-					}
-				}
+			if !fullScan && len(tracked) > 0 {
+				checkMempoolTx(client, analyzer, store, tracked, event.Hash, event.Tx)
 			}
 		}
 	}
 }
 
-func ReplaceByFee(tx *wire.MsgTx, amount int32) {
-	walletName := viper.GetString("btc_core_wallet_name")
-	client := getBitcoinRpcClient()
-	defer client.Shutdown()
+type trackedMempoolTx struct {
+	types.TrackedTx
+	txid      string
+	wireTx    *wire.MsgTx
+	spentByUs map[wire.OutPoint]bool
+}
 
-	newAmountAdded := float64(0)
+func trackedMempoolTxs(txs []types.TrackedTx) []trackedMempoolTx {
+	tracked := []trackedMempoolTx{}
+	for _, tx := range txs {
+		transaction := hex.EncodeToString(tx.Tx)
+		wireTransaction, err := CreateTxFromHex(transaction)
+		if err != nil {
+			fmt.Println("error decodeing signed transaction btc broadcaster : ", err)
+			continue
+		}
+		spentByUs := make(map[wire.OutPoint]bool)
+		for _, vin := range wireTransaction.TxIn {
+			spentByUs[vin.PreviousOutPoint] = true
+		}
+		tracked = append(tracked, trackedMempoolTx{TrackedTx: tx, txid: wireTransaction.TxHash().String(), wireTx: wireTransaction, spentByUs: spentByUs})
+	}
+	return tracked
+}
 
-	utxos, err := GetUnspentUTXOs(walletName)
+// checkTrackedTx looks for mempool transactions spending the inputs of tx
+// with gettxspendingprevout, then at its descendants.
+func checkTrackedTx(client *rpcclient.Client, analyzer *pinning.Analyzer, store db.Store, tx trackedMempoolTx) {
+	spenders, err := mempoolSpenders(client, tx.wireTx)
 	if err != nil {
-		fmt.Println("Failed to get unspent UTXOs: ", err)
+		fmt.Println("Failed to get mempool spends of tracked transaction : ", err)
 	}
-	for _, utxo := range utxos {
-		for _, vin := range tx.TxIn {
-			if utxo.TxID == vin.PreviousOutPoint.Hash.String() {
-				continue
-			}
+	for _, spender := range spenders {
+		if spender.String() == tx.txid {
+			continue
 		}
-
-		hash, err := chainhash.NewHashFromStr(utxo.TxID)
+		// our own replacements are tracked before they are broadcast
+		known, err := store.GetTrackedTxByTxid(spender.String())
 		if err != nil {
-			fmt.Println("Failed to create hash from string: ", err)
+			fmt.Println("Failed to look up mempool transaction : ", err)
+			continue
+		}
+		if known == nil {
+			conflictingTx(analyzer, store, tx, spender)
 			return
 		}
-		outPoint := wire.NewOutPoint(hash, utxo.Vout)
-		txIn := wire.NewTxIn(outPoint, nil, nil)
-		tx.AddTxIn(txIn)
+	}
 
-		input := tx.TxIn[int64(len(tx.TxIn))]
-		witnessInputs := make([]btcjson.RawTxWitnessInput, 1)
-		witnessInputs[1] = btcjson.RawTxWitnessInput{
-			Txid: input.PreviousOutPoint.Hash.String(),
-			Vout: input.PreviousOutPoint.Index,
-		}
+	findings, err := analyzer.AnalyzeDescendants(tx.wireTx)
+	if err == nil {
+		reportPinning(tx.TrackedTx, findings)
+	}
+}
 
-		tx, _, err := client.SignRawTransactionWithWallet3(tx, witnessInputs, rpcclient.SigHashType(txscript.SigHashAll|txscript.SigHashAnyOneCanPay))
+// mempoolSpenders returns the mempool transactions spending an input of tx,
+// once each.
+func mempoolSpenders(client *rpcclient.Client, tx *wire.MsgTx) ([]chainhash.Hash, error) {
+	type prevOut struct {
+		Txid string `json:"txid"`
+		Vout uint32 `json:"vout"`
+	}
+	prevOuts := make([]prevOut, len(tx.TxIn))
+	for i, txIn := range tx.TxIn {
+		prevOuts[i] = prevOut{Txid: txIn.PreviousOutPoint.Hash.String(), Vout: txIn.PreviousOutPoint.Index}
+	}
+	param, err := json.Marshal(prevOuts)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := client.RawRequest("gettxspendingprevout", []json.RawMessage{param})
+	if err != nil {
+		return nil, err
+	}
+	results := []struct {
+		SpendingTxid string `json:"spendingtxid"`
+	}{}
+	err = json.Unmarshal(raw, &results)
+	if err != nil {
+		return nil, err
+	}
 
-		newAmountAdded += utxo.Amount
+	spenders := []chainhash.Hash{}
+	seen := make(map[string]bool)
+	for _, result := range results {
+		if result.SpendingTxid == "" || seen[result.SpendingTxid] {
+			continue
+		}
+		seen[result.SpendingTxid] = true
+		hash, err := chainhash.NewHashFromStr(result.SpendingTxid)
+		if err != nil {
+			return nil, err
+		}
+		spenders = append(spenders, *hash)
+	}
+	return spenders, nil
+}
 
-		if newAmountAdded == float64(amount) {
-			break
+// checkMempoolTx compares a single mempool transaction announced by the
+// chain notifier with the tracked ones. decodedTx is fetched from the node
+// when the notifier did not carry it.
+func checkMempoolTx(client *rpcclient.Client, analyzer *pinning.Analyzer, store db.Store, tracked []trackedMempoolTx, txid chainhash.Hash, decodedTx *wire.MsgTx) {
+	for _, tx := range tracked {
+		if txid.String() == tx.txid || txid.String() == tx.ChildTxid {
+			return
 		}
+	}
+	// our own replacements are tracked before they are broadcast
+	known, err := store.GetTrackedTxByTxid(txid.String())
+	if err != nil {
+		fmt.Println("Failed to look up mempool transaction : ", err)
+		return
+	}
+	if known != nil {
+		return
+	}
 
-		if newAmountAdded > float64(amount) {
-			addr, err := client.GetNewAddress(walletName)
-			if err != nil {
-				fmt.Println("Error getting new address: ", err)
-				return
+	if decodedTx == nil {
+		rawTx, err := client.GetRawTransaction(&txid)
+		if err != nil {
+			fmt.Println("Failed to get raw transaction: ", err)
+			return
+		}
+		decodedTx = rawTx.MsgTx()
+	}
+
+	for _, tx := range tracked {
+		spendsOutput := false
+		conflicts := false
+		// Check each input in the transaction
+		for _, vin := range decodedTx.TxIn {
+			if vin.PreviousOutPoint.Hash.String() == tx.txid {
+				spendsOutput = true
 			}
+			if tx.spentByUs[vin.PreviousOutPoint] {
+				conflicts = true
+			}
+		}
 
-			// Generate the pay-to-address script.
-			destinationAddrByte, err := txscript.PayToAddrScript(addr)
+		if conflicts {
+			conflictingTx(analyzer, store, tx, txid)
+		} else if spendsOutput && stillInMempool(store, tx) {
+			findings, err := analyzer.AnalyzeDescendants(tx.wireTx)
 			if err != nil {
-				fmt.Println("Error generating pay-to-address script:", err)
-				return
+				fmt.Println("Failed to analyze descendants: ", err)
 			}
-			amount := newAmountAdded - float64(amount)
-			txOut := wire.NewTxOut(int64(amount), destinationAddrByte)
-			tx.AddTxOut(txOut)
-			break
+			reportPinning(tx.TrackedTx, findings)
 		}
+	}
+}
 
+// stillInMempool rereads tx, the tracked set may be stale, e.g. the
+// transaction was replaced since it was read.
+func stillInMempool(store db.Store, tx trackedMempoolTx) bool {
+	current, err := store.GetTrackedTxByTxid(tx.txid)
+	if err != nil || current == nil || current.Id != tx.Id {
+		return false
 	}
+	return current.State == types.TxStateBroadcast || current.State == types.TxStateInMempool
+}
 
-	if newAmountAdded < float64(amount) {
-		fmt.Println("Insufficient funds")
+// conflictingTx moves tx to conflicted once the mempool transaction
+// conflict spends one of its inputs.
+func conflictingTx(analyzer *pinning.Analyzer, store db.Store, tx trackedMempoolTx, conflict chainhash.Hash) {
+	if !stillInMempool(store, tx) {
 		return
 	}
+	fmt.Printf("Transaction %s in the mempool conflicts with tracked tx %s \n", conflict, tx.txid)
+	findings, err := analyzer.AnalyzeConflict(tx.wireTx, tx.Fee, &conflict)
+	if err != nil {
+		fmt.Println("Failed to analyze conflicting transaction: ", err)
+	}
+	reportPinning(tx.TrackedTx, findings)
+	_ = store.TransitionTx(tx.Id, types.TxStateConflicted, 0)
+	alert.Notify(alert.Event{
+		Type:      alert.TxConflicted,
+		Severity:  alert.Critical,
+		Txid:      tx.txid,
+		ReserveId: tx.ReserveId,
+		RoundId:   tx.RoundId,
+		Reason:    conflict.String(),
+		Message:   fmt.Sprintf("mempool transaction %s spends an input of our %s transaction", conflict, tx.TxType),
+		Details:   map[string]interface{}{"conflict": conflict.String()},
+	})
+}
 
-	BroadcastBtcTransaction(tx)
-	fmt.Printf("Broadcasted RBF transaction with txid %s\n", tx.TxHash().String())
+func reportPinning(tx types.TrackedTx, findings []pinning.Finding) {
+	for _, finding := range findings {
+		severity := alert.Warning
+		if finding.Kind == pinning.ConflictingSpend {
+			severity = alert.Critical
+		}
+		alert.Notify(alert.Event{
+			Type:      alert.PinningDetected,
+			Severity:  severity,
+			Txid:      finding.Txid,
+			ReserveId: tx.ReserveId,
+			RoundId:   tx.RoundId,
+			Reason:    string(finding.Kind),
+			Message:   finding.String(),
+			Details: map[string]interface{}{
+				"kind":         finding.Kind,
+				"culprit":      finding.Culprit,
+				"rule":         finding.Rule,
+				"current_fee":  finding.CurrentFee,
+				"required_fee": finding.RequiredFee,
+			},
+		})
+	}
 }
 
-func ConfirmTx(dbconn *sql.DB) {
+// ReplaceByFee replaces a tracked transaction with one paying amount more
+// fee, at least as much as BIP125 requires.
+func ReplaceByFee(store db.Store, tx *wire.MsgTx, amount int32) error {
+	tracked, err := replaceableTx(store, tx)
+	if err != nil {
+		return err
+	}
+
 	client := getBitcoinRpcClient()
 	defer client.Shutdown()
+	height, err := client.GetBlockCount()
+	if err != nil {
+		return err
+	}
 
-	for {
-		signed_txs := db.QuerySignedTxAll(dbconn)
+	_, err = BumpTrackedTx(client, store, feebump.NewPolicy(), *tracked, tracked.Fee+int64(amount), height)
+	if err != nil && !errors.Is(err, ErrApprovalRequired) {
+		notifyFeeBumpFailure(*tracked, feebump.RBF, err.Error())
+	}
+	return err
+}
 
-		for _, tx := range signed_txs {
-			transaction := hex.EncodeToString(tx)
-			wireTransaction, err := CreateTxFromHex(transaction)
-			txHash, err := chainhash.NewHashFromStr(wireTransaction.TxHash().String())
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
+// ProposeReplaceByFee builds the replacement ReplaceByFee would broadcast and
+// checks it against the fee budget and with testmempoolaccept, then gives its
+// coins back without broadcasting it.
+func ProposeReplaceByFee(store db.Store, tx *wire.MsgTx, amount int32) (*types.RBFProposal, error) {
+	tracked, err := replaceableTx(store, tx)
+	if err != nil {
+		return nil, err
+	}
+	err = checkNoPendingApproval(store, tracked.Id)
+	if err != nil {
+		return nil, err
+	}
 
-			txHashResult, err := client.GetRawTransactionVerbose(txHash)
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
+	client := getBitcoinRpcClient()
+	defer client.Shutdown()
+	height, err := client.GetBlockCount()
+	if err != nil {
+		return nil, err
+	}
+	current, err := deserializeTx(tracked.Tx)
+	if err != nil {
+		return nil, err
+	}
+	policy := feebump.NewPolicy()
+	state := feeBumpState(pinning.NewAnalyzer(client), *tracked, current, 0, height)
+	requested := tracked.Fee + int64(amount)
+	replacement, fee, err := proposeReplacement(client, store, policy, *tracked, current, state, requested)
+	if err != nil {
+		return nil, err
+	}
+	added := addedInputs(replacement, current)
+	defer releaseCoins(client, store, added)
 
-			fmt.Printf("Transaction details: %+v\n", txHashResult)
-			db.DeleteSignedTx(dbconn, tx)
-		}
+	txHex, err := txToHex(replacement)
+	if err != nil {
+		return nil, err
+	}
+	vsize := pinning.VirtualSize(replacement)
+	proposal := &types.RBFProposal{
+		Txid:         replacement.TxHash().String(),
+		Hex:          txHex,
+		OriginalFee:  tracked.Fee,
+		ReplacedFees: state.ReplacedFees,
+		RequestedFee: requested,
+		MinFee:       policy.MinReplacementFee(state, vsize),
+		Fee:          fee,
+		VSize:        vsize,
+		FeeRate:      fee * 1000 / vsize,
+		AddedInputs:  []string{},
+	}
+	for _, outPoint := range added {
+		proposal.AddedInputs = append(proposal.AddedInputs, outPoint.String())
+	}
+
+	spent, err := store.FeeSpentSince(time.Now().UTC().Add(-feebudget.Window))
+	if err != nil {
+		return nil, err
+	}
+	proposal.BudgetExceeded = feebudget.NewLimits().Check(feebudget.Spend{
+		Fee:   fee,
+		VSize: vsize,
+		Value: sweepValue(tracked.NyksTx),
+		Added: fee - tracked.Fee - tracked.ChildFee,
+		Spent: spent,
+	})
+
+	results, err := testMempoolAccept(client, replacement)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) > 0 {
+		proposal.Allowed = results[0].Allowed
+		proposal.RejectReason = results[0].RejectReason
+	}
+	return proposal, nil
+}
+
+// replaceableTx returns the tracked transaction tx if it can be replaced.
+func replaceableTx(store db.Store, tx *wire.MsgTx) (*types.TrackedTx, error) {
+	originalTxid := tx.TxHash().String()
+	tracked, err := store.GetTrackedTxByTxid(originalTxid)
+	if err != nil {
+		fmt.Println("Failed to query tracked transaction: ", err)
+		return nil, err
+	}
+	if tracked == nil {
+		return nil, fmt.Errorf("transaction %s is not tracked", originalTxid)
+	}
+	if tracked.State != types.TxStateBroadcast && tracked.State != types.TxStateInMempool {
+		return nil, fmt.Errorf("transaction %s is %s, only unconfirmed broadcast transactions can be replaced", originalTxid, tracked.State)
 	}
+	return tracked, nil
 }
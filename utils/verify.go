@@ -0,0 +1,250 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/twilight-project/rbf-node/db"
+	"github.com/twilight-project/rbf-node/txverify"
+	"github.com/twilight-project/rbf-node/types"
+)
+
+// RejectedError is a transaction refused before broadcast or by the node,
+// Err is the error of the node if it refused it.
+type RejectedError struct {
+	Rejections []types.Rejection
+	Err        error
+}
+
+func (e *RejectedError) Error() string {
+	reasons := make([]string, len(e.Rejections))
+	for i, rejection := range e.Rejections {
+		reasons[i] = rejection.String()
+	}
+	return "rejected : " + strings.Join(reasons, ", ")
+}
+
+func (e *RejectedError) Unwrap() error {
+	return e.Err
+}
+
+// verifyBroadcast checks tx before it is broadcast the way the node would:
+// every input through the script interpreter against the output it spends,
+// its locktime against the next block, then standardness and policy with
+// testmempoolaccept. It returns why the node would refuse it, an error when
+// the checks could not run. A transaction the node already has is not
+// refused, broadcasting it again only confirms that.
+func verifyBroadcast(client *rpcclient.Client, store db.Store, tx *wire.MsgTx) ([]types.Rejection, error) {
+	rejections, err := verifyScripts(client, store, tx, nil)
+	if err != nil || len(rejections) > 0 {
+		return rejections, err
+	}
+
+	if DryRun() {
+		// simulateBroadcast runs testmempoolaccept and records the verdict
+		return nil, nil
+	}
+	results, err := testMempoolAccept(client, tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range results {
+		if !result.Allowed && !alreadyKnown(result.RejectReason) {
+			rejections = append(rejections, types.Rejection{
+				Kind:   txverify.Classify(result.RejectReason),
+				Input:  -1,
+				Reason: result.RejectReason,
+			})
+		}
+	}
+	return rejections, nil
+}
+
+// verifyPackage runs the script and locktime checks of verifyBroadcast on
+// every transaction of a package, parents first. The outputs a transaction
+// spends from an earlier one of the package are read from it, the node does
+// not know them yet. submitpackage checks policy itself.
+func verifyPackage(client *rpcclient.Client, store db.Store, txs ...*wire.MsgTx) ([]types.Rejection, error) {
+	rejections := []types.Rejection{}
+	for i, tx := range txs {
+		txRejections, err := verifyScripts(client, store, tx, txs[:i])
+		if err != nil {
+			return nil, err
+		}
+		for _, rejection := range txRejections {
+			rejection.Reason = tx.TxHash().String() + " : " + rejection.Reason
+			rejections = append(rejections, rejection)
+		}
+	}
+	return rejections, nil
+}
+
+// verifyScripts runs every input of tx through the script interpreter, then
+// checks its locktime against the next block. Outputs spent from parents are
+// read from them.
+func verifyScripts(client *rpcclient.Client, store db.Store, tx *wire.MsgTx, parents []*wire.MsgTx) ([]types.Rejection, error) {
+	parentOutputs := make(map[wire.OutPoint]*wire.TxOut)
+	for _, parent := range parents {
+		parentHash := parent.TxHash()
+		for i, txOut := range parent.TxOut {
+			parentOutputs[*wire.NewOutPoint(&parentHash, uint32(i))] = txOut
+		}
+	}
+	fetcher := txscript.NewMultiPrevOutFetcher(nil)
+	for _, txIn := range tx.TxIn {
+		txOut, ok := parentOutputs[txIn.PreviousOutPoint]
+		if !ok {
+			var err error
+			txOut, err = verifyPrevOut(client, store, txIn.PreviousOutPoint)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if txOut != nil {
+			fetcher.AddPrevOut(txIn.PreviousOutPoint, txOut)
+		}
+	}
+	rejections := txverify.Scripts(tx, fetcher)
+	if len(rejections) > 0 {
+		if mined(client, tx) {
+			return nil, nil
+		}
+		return rejections, nil
+	}
+
+	tip, err := chainTip(client)
+	if err != nil {
+		return nil, err
+	}
+	rejection := txverify.Final(tx, tip.Blocks+1, tip.MedianTime)
+	if rejection != nil {
+		return []types.Rejection{*rejection}, nil
+	}
+	return nil, nil
+}
+
+// verifyPrevOut returns the output spent at outPoint from the utxo set, or
+// from a tracked transaction not broadcast yet when store is set. It returns
+// nil when neither has it.
+func verifyPrevOut(client *rpcclient.Client, store db.Store, outPoint wire.OutPoint) (*wire.TxOut, error) {
+	value, pkScript, err := prevOut(client, outPoint)
+	if err == nil {
+		return wire.NewTxOut(value, pkScript), nil
+	}
+	if !errors.Is(err, ErrSpentOrUnknown) {
+		return nil, err
+	}
+	if store == nil {
+		return nil, nil
+	}
+	parent, err := store.GetTrackedTxByTxid(outPoint.Hash.String())
+	if err != nil || parent == nil {
+		return nil, err
+	}
+	parentTx, err := deserializeTx(parent.Tx)
+	if err != nil {
+		return nil, err
+	}
+	if int(outPoint.Index) >= len(parentTx.TxOut) {
+		return nil, nil
+	}
+	return parentTx.TxOut[outPoint.Index], nil
+}
+
+// mined tells whether an output of tx is in the utxo set of the chain, the
+// outputs it spends are gone because it confirmed.
+func mined(client *rpcclient.Client, tx *wire.MsgTx) bool {
+	txHash := tx.TxHash()
+	for i := range tx.TxOut {
+		utxo, err := client.GetTxOut(&txHash, uint32(i), false)
+		if err == nil && utxo != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func alreadyKnown(reason string) bool {
+	return strings.Contains(reason, "txn-already-in-mempool") || strings.Contains(reason, "txn-already-known")
+}
+
+type chainTipInfo struct {
+	Blocks     int64 `json:"blocks"`
+	MedianTime int64 `json:"mediantime"`
+}
+
+// chainTip returns the height and median time past of the best block.
+func chainTip(client *rpcclient.Client) (chainTipInfo, error) {
+	tip := chainTipInfo{}
+	raw, err := client.RawRequest("getblockchaininfo", nil)
+	if err != nil {
+		return tip, err
+	}
+	err = json.Unmarshal(raw, &tip)
+	return tip, err
+}
+
+// errorRejections turns an error of sendrawtransaction or submitpackage into
+// the rejection it stands for.
+func errorRejections(err error) []types.Rejection {
+	return []types.Rejection{{Kind: txverify.Classify(err.Error()), Input: -1, Reason: err.Error()}}
+}
+
+// rejectionState returns the state a transaction the node refuses should
+// move to, empty when it should be retried.
+func rejectionState(rejections []types.Rejection) types.TxState {
+	if txverify.Retryable(rejections) {
+		return ""
+	}
+	for _, rejection := range rejections {
+		switch rejection.Kind {
+		case types.RejectConflict, types.RejectNonFinal, types.RejectInsufficientFee, types.RejectMempoolChain:
+		default:
+			return types.TxStateFailed
+		}
+	}
+	return types.TxStateConflicted
+}
+
+// rejectionReason is the kind of the first reason err refused a
+// transaction for, the stable part of a broadcast failure alert.
+func rejectionReason(err error) string {
+	var rejected *RejectedError
+	if errors.As(err, &rejected) && len(rejected.Rejections) > 0 {
+		return string(rejected.Rejections[0].Kind)
+	}
+	return ""
+}
+
+// recordRejections persists on tracked why broadcasting it failed with err,
+// and clears them once it is broadcast.
+func recordRejections(store db.Store, tracked types.TrackedTx, err error) {
+	if errors.Is(err, ErrApprovalRequired) {
+		return
+	}
+	if broadcastResultState(err) == types.TxStateBroadcast {
+		setRejections(store, tracked, nil)
+		return
+	}
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		setRejections(store, tracked, rejected.Rejections)
+		return
+	}
+	setRejections(store, tracked, errorRejections(err))
+}
+
+func setRejections(store db.Store, tracked types.TrackedTx, rejections []types.Rejection) {
+	if len(rejections) == 0 && len(tracked.Rejections) == 0 {
+		return
+	}
+	err := store.SetTrackedTxRejections(tracked.Id, rejections)
+	if err != nil {
+		fmt.Println("Failed to record broadcast rejections : ", err)
+	}
+}
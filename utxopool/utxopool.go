@@ -0,0 +1,300 @@
+package utxopool
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/spf13/viper"
+	"github.com/twilight-project/rbf-node/coinselect"
+)
+
+// Default policy values, overridable from the utxo_pool block of the config.
+const (
+	defaultSplitMaxFeeRate       = 5000 // sat/kvB
+	defaultConsolidateMaxFeeRate = 3000 // sat/kvB
+	defaultMinConsolidate        = 5
+	defaultMaxConsolidate        = 50
+	defaultMaxSplitOutputs       = 25
+	defaultSweepsToFund          = 10
+	defaultSweepVSize            = 500
+	defaultMinConfirmations      = 1
+)
+
+// defaultBands keeps twenty coins able to pay for a sweep up to 100 sat/vB.
+var defaultBands = []Band{{Min: 20000, Max: 100000, Count: 20}}
+
+// Band is a range of coin values in sats, Max excluded, the pool keeps Count
+// confirmed coins in.
+type Band struct {
+	Min   int64 `mapstructure:"min_sats" json:"min_sats"`
+	Max   int64 `mapstructure:"max_sats" json:"max_sats"`
+	Count int   `mapstructure:"count" json:"count"`
+}
+
+func (b Band) contains(value int64) bool {
+	return value >= b.Min && value < b.Max
+}
+
+type Policy struct {
+	Bands []Band
+	// coins below DustSats are consolidated once at least MinConsolidate of
+	// them are confirmed, at most MaxConsolidate at a time
+	DustSats       int64
+	MinConsolidate int
+	MaxConsolidate int
+	// splitting and consolidating only happen at or below these feerates
+	SplitMaxFeeRate       int64 // sat/kvB
+	ConsolidateMaxFeeRate int64 // sat/kvB
+	MaxSplitOutputs       int
+	// SweepsToFund is the number of sweeps of SweepVSize vbytes the pool
+	// should be able to fund at once.
+	SweepsToFund     int
+	SweepVSize       int64
+	MinConfirmations int64
+	// OutputType is the type of the outputs split and consolidated into
+	OutputType coinselect.ScriptType
+}
+
+func NewPolicy() *Policy {
+	p := &Policy{
+		Bands:                 append([]Band{}, defaultBands...),
+		MinConsolidate:        defaultMinConsolidate,
+		MaxConsolidate:        defaultMaxConsolidate,
+		SplitMaxFeeRate:       defaultSplitMaxFeeRate,
+		ConsolidateMaxFeeRate: defaultConsolidateMaxFeeRate,
+		MaxSplitOutputs:       defaultMaxSplitOutputs,
+		SweepsToFund:          defaultSweepsToFund,
+		SweepVSize:            defaultSweepVSize,
+		MinConfirmations:      defaultMinConfirmations,
+		OutputType:            coinselect.ChangeType(),
+	}
+	bands := []Band{}
+	err := viper.UnmarshalKey("utxo_pool.bands", &bands)
+	if err != nil {
+		fmt.Println("invalid utxo_pool.bands, using the default : ", err)
+	}
+	if len(bands) > 0 {
+		p.Bands = bands
+	}
+	sort.Slice(p.Bands, func(i, j int) bool { return p.Bands[i].Min < p.Bands[j].Min })
+
+	// anything smaller than the smallest band is dust to the pool by default
+	p.DustSats = p.Bands[0].Min
+	if v := viper.GetInt64("utxo_pool.dust_sats"); v > 0 {
+		p.DustSats = v
+	}
+	if v := viper.GetInt("utxo_pool.min_consolidate_inputs"); v > 1 {
+		p.MinConsolidate = v
+	}
+	if v := viper.GetInt("utxo_pool.max_consolidate_inputs"); v > 1 {
+		p.MaxConsolidate = v
+	}
+	if v := viper.GetInt64("utxo_pool.split_max_feerate_sat_per_kvb"); v > 0 {
+		p.SplitMaxFeeRate = v
+	}
+	if v := viper.GetInt64("utxo_pool.consolidate_max_feerate_sat_per_kvb"); v > 0 {
+		p.ConsolidateMaxFeeRate = v
+	}
+	if v := viper.GetInt("utxo_pool.max_split_outputs"); v > 0 {
+		p.MaxSplitOutputs = v
+	}
+	if v := viper.GetInt("utxo_pool.sweeps_to_fund"); v > 0 {
+		p.SweepsToFund = v
+	}
+	if v := viper.GetInt64("utxo_pool.sweep_vsize"); v > 0 {
+		p.SweepVSize = v
+	}
+	if viper.IsSet("utxo_pool.min_confirmations") {
+		p.MinConfirmations = viper.GetInt64("utxo_pool.min_confirmations")
+	}
+	return p
+}
+
+// Coin is a spendable wallet coin not leased to any transaction.
+type Coin struct {
+	coinselect.Coin
+	Confirmations int64
+}
+
+type BandHealth struct {
+	Band
+	Have    int `json:"have"`
+	Missing int `json:"missing"`
+}
+
+// Health describes how well the pool can fund sweeps at a feerate.
+type Health struct {
+	FeeRate     int64        `json:"feerate_sat_per_kvb"`
+	Coins       int          `json:"coins"`
+	Unconfirmed int          `json:"unconfirmed"`
+	Leased      int          `json:"leased"`
+	Value       int64        `json:"value_sats"`
+	Dust        int          `json:"dust"`
+	Bands       []BandHealth `json:"bands"`
+	// SweepFee is the fee of one sweep at FeeRate, FundableSweeps the
+	// number of sweeps the confirmed coins can pay for at once.
+	SweepFee       int64    `json:"sweep_fee_sats"`
+	FundableSweeps int      `json:"fundable_sweeps"`
+	SweepsToFund   int      `json:"sweeps_to_fund"`
+	Healthy        bool     `json:"healthy"`
+	Warnings       []string `json:"warnings"`
+}
+
+func (p *Policy) confirmed(coins []Coin) []Coin {
+	confirmed := []Coin{}
+	for _, coin := range coins {
+		if coin.Confirmations >= p.MinConfirmations {
+			confirmed = append(confirmed, coin)
+		}
+	}
+	return confirmed
+}
+
+// Assess counts the coins in each band and the sweeps they can fund at
+// feeRate sat/kvB.
+func (p *Policy) Assess(coins []Coin, feeRate int64) Health {
+	confirmed := p.confirmed(coins)
+	h := Health{
+		FeeRate:      feeRate,
+		Coins:        len(confirmed),
+		Unconfirmed:  len(coins) - len(confirmed),
+		SweepFee:     (p.SweepVSize*feeRate + 999) / 1000,
+		SweepsToFund: p.SweepsToFund,
+		Warnings:     []string{},
+	}
+	for _, band := range p.Bands {
+		bandHealth := BandHealth{Band: band}
+		for _, coin := range confirmed {
+			if band.contains(coin.Value) {
+				bandHealth.Have++
+			}
+		}
+		if bandHealth.Have < band.Count {
+			bandHealth.Missing = band.Count - bandHealth.Have
+			h.Warnings = append(h.Warnings, fmt.Sprintf("%d of %d coins between %d and %d sats", bandHealth.Have, band.Count, band.Min, band.Max))
+		}
+		h.Bands = append(h.Bands, bandHealth)
+	}
+	for _, coin := range confirmed {
+		h.Value += coin.Value
+		if coin.Value < p.DustSats {
+			h.Dust++
+		}
+	}
+
+	h.FundableSweeps = fundableSweeps(confirmed, feeRate, h.SweepFee)
+	h.Healthy = h.FundableSweeps >= p.SweepsToFund
+	if !h.Healthy {
+		h.Warnings = append(h.Warnings, fmt.Sprintf("can fund %d of %d sweeps at %d sat/kvB", h.FundableSweeps, p.SweepsToFund, feeRate))
+	}
+	return h
+}
+
+// fundableSweeps counts the sweeps paying sweepFee that coins can fund in
+// parallel, every coin funding one sweep on its own and the smaller ones
+// combined.
+func fundableSweeps(coins []Coin, feeRate int64, sweepFee int64) int {
+	if sweepFee <= 0 {
+		return len(coins)
+	}
+	sweeps := 0
+	rest := int64(0)
+	for _, coin := range coins {
+		value := coin.EffectiveValue(feeRate)
+		if value >= sweepFee {
+			sweeps++
+		} else if value > 0 {
+			rest += value
+		}
+	}
+	return sweeps + int(rest/sweepFee)
+}
+
+// Split pays Outputs back to the wallet from Coin, the rest goes to change.
+type Split struct {
+	Coin    Coin
+	Outputs []int64
+}
+
+// PlanSplit splits the largest confirmed coin above every band into the coins
+// missing from the bands, smallest band first, when feeRate is at most
+// SplitMaxFeeRate.
+func (p *Policy) PlanSplit(coins []Coin, feeRate int64) (*Split, bool) {
+	if feeRate > p.SplitMaxFeeRate {
+		return nil, false
+	}
+	health := p.Assess(coins, feeRate)
+	top := int64(0)
+	for _, band := range p.Bands {
+		if band.Max > top {
+			top = band.Max
+		}
+	}
+
+	confirmed := p.confirmed(coins)
+	largest := -1
+	for i, coin := range confirmed {
+		if coin.Value >= top && (largest < 0 || coin.Value > confirmed[largest].Value) {
+			largest = i
+		}
+	}
+	if largest < 0 {
+		return nil, false
+	}
+	source := confirmed[largest]
+
+	split := &Split{Coin: source}
+	outputWeight := coinselect.OutputWeight(p.OutputType)
+	weight := coinselect.TxOverheadWeight + coinselect.InputWeightSigHash(source.Type, txscript.SigHashDefault) + outputWeight
+	left := source.Value - coinselect.Fee(weight, feeRate) - coinselect.DustLimit(p.OutputType)
+	for _, band := range health.Bands {
+		value := (band.Min + band.Max) / 2
+		for i := 0; i < band.Missing && len(split.Outputs) < p.MaxSplitOutputs; i++ {
+			cost := value + coinselect.Fee(outputWeight, feeRate)
+			if cost > left {
+				break
+			}
+			split.Outputs = append(split.Outputs, value)
+			left -= cost
+		}
+	}
+	return split, len(split.Outputs) > 0
+}
+
+// PlanConsolidation picks the dust coins to merge into one, smallest first,
+// when feeRate is at most ConsolidateMaxFeeRate. Coins costing more to spend
+// than they are worth are left alone.
+func (p *Policy) PlanConsolidation(coins []Coin, feeRate int64) ([]Coin, bool) {
+	if feeRate > p.ConsolidateMaxFeeRate {
+		return nil, false
+	}
+	dust := []Coin{}
+	for _, coin := range p.confirmed(coins) {
+		if coin.Value < p.DustSats && coin.EffectiveValue(feeRate) > 0 {
+			dust = append(dust, coin)
+		}
+	}
+	if len(dust) < p.MinConsolidate {
+		return nil, false
+	}
+	sort.Slice(dust, func(i, j int) bool {
+		if dust[i].Value != dust[j].Value {
+			return dust[i].Value < dust[j].Value
+		}
+		return dust[i].OutPoint.String() < dust[j].OutPoint.String()
+	})
+	if len(dust) > p.MaxConsolidate {
+		dust = dust[:p.MaxConsolidate]
+	}
+
+	value := int64(0)
+	for _, coin := range dust {
+		value += coin.EffectiveValue(feeRate)
+	}
+	weight := coinselect.TxOverheadWeight + coinselect.OutputWeight(p.OutputType)
+	if value-coinselect.Fee(weight, feeRate) < coinselect.DustLimit(p.OutputType) {
+		return nil, false
+	}
+	return dust, true
+}